@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/leoleovich/3djuggler/gcodefeeder"
+	"github.com/leoleovich/3djuggler/juggler"
+)
+
+const defaultAttentionInterval = 30 * time.Second
+
+// Attention configures reminders on the LCD of the printer while a job waits for the button
+type Attention struct {
+	// Seconds between reminders. 30 if 0
+	Interval int
+	// Don't beep (M300), only show the job on the LCD
+	Mute bool
+}
+
+func (a *Attention) interval() time.Duration {
+	if a == nil || a.Interval <= 0 {
+		return defaultAttentionInterval
+	}
+	return time.Duration(a.Interval) * time.Second
+}
+
+// jobPrompt shows the job on the LCD and escalates reminders as the deadline approaches.
+// deadline returns the current Scheduled of the job, /reschedule moves it. timeout is how long the job waits
+// for the button in total
+func jobPrompt(job juggler.Job, deadline func() time.Time, attention *Attention, timeout time.Duration) gcodefeeder.Prompt {
+	message := fmt.Sprintf("%s: %s", job.Owner, job.Filename)
+	if job.Color != "" {
+		message = fmt.Sprintf("%s (%s)", message, job.Color)
+	}
+	return gcodefeeder.Prompt{
+		Message:  message,
+		Interval: attention.interval(),
+		Reminder: func(time.Duration) []string {
+			// Only the knob prompt without attention signalling
+			if attention == nil {
+				return nil
+			}
+			left := time.Until(deadline())
+			var cmds []string
+			beeps, pitch := 1, 880
+			switch {
+			case left < 2*time.Minute:
+				beeps, pitch = 3, 1760
+				cmds = append(cmds, fmt.Sprintf("M117 Press now! %s", message))
+			case left < timeout/2:
+				beeps = 2
+			}
+			if attention.Mute {
+				return cmds
+			}
+			for i := 0; i < beeps; i++ {
+				cmds = append(cmds, fmt.Sprintf("M300 S%d P200", pitch), "G4 P200")
+			}
+			return cmds
+		},
+	}
+}
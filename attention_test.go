@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/leoleovich/3djuggler/juggler"
+)
+
+func TestReminderFollowsTheDeadline(t *testing.T) {
+	var mu sync.Mutex
+	scheduled := time.Now().Add(time.Minute)
+	deadline := func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return scheduled
+	}
+	prompt := jobPrompt(juggler.Job{Owner: "bob", Filename: "cube.gcode"}, deadline, &Attention{}, 10*time.Minute)
+
+	urgent := func() bool {
+		for _, cmd := range prompt.Reminder(0) {
+			if strings.HasPrefix(cmd, "M117 Press now!") {
+				return true
+			}
+		}
+		return false
+	}
+	if !urgent() {
+		t.Fatal("a minute before the deadline the reminder is not urgent")
+	}
+	// /reschedule gave the job more time
+	mu.Lock()
+	scheduled = time.Now().Add(10 * time.Minute)
+	mu.Unlock()
+	if urgent() {
+		t.Fatal("reminder still shows the old deadline")
+	}
+}
@@ -0,0 +1,200 @@
+// Package audit keeps a JSON Lines log of job status changes, one event per line
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/leoleovich/3djuggler/juggler"
+)
+
+const (
+	// maxSize is the size of the file in bytes at which it is rotated
+	maxSize = 10 << 20
+	// keep is how many rotated files are kept, e.g. audit.jsonl.1 to audit.jsonl.5
+	keep = 5
+)
+
+// Event is a status change of a job
+type Event struct {
+	Time         time.Time         `json:"time"`
+	Printer      string            `json:"printer"`
+	JobID        int               `json:"job_id"`
+	Owner        string            `json:"owner"`
+	Filename     string            `json:"file_name"`
+	Source       string            `json:"source"`
+	From         juggler.JobStatus `json:"from"`
+	To           juggler.JobStatus `json:"to"`
+	FeederStatus string            `json:"feeder_status"`
+	// Reason is what made the status change, e.g. /cancel or the printer
+	Reason    string    `json:"reason"`
+	Progress  float64   `json:"progress"`
+	Fetched   time.Time `json:"fetched"`
+	Scheduled time.Time `json:"scheduled"`
+}
+
+// Log appends events to a file and rotates it when it grows too big
+type Log struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// Open opens the log at path for appending, creating it if needed
+func Open(path string) (*Log, error) {
+	l := &Log{path: path}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Log) open() error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+// Close closes the file
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// Write appends the event as a single line
+func (l *Log) Write(ev Event) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.size > 0 && l.size+int64(len(b)) > maxSize {
+		if err := l.rotate(); err != nil {
+			return fmt.Errorf("failed to rotate %s: %w", l.path, err)
+		}
+	}
+	n, err := l.file.Write(b)
+	l.size += int64(n)
+	return err
+}
+
+// rotate shifts audit.jsonl to audit.jsonl.1, audit.jsonl.1 to audit.jsonl.2 and so on, dropping the oldest one
+func (l *Log) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	for i := keep - 1; i > 0; i-- {
+		if err := os.Rename(l.rotated(i), l.rotated(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(l.path, l.rotated(1)); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+func (l *Log) rotated(i int) string {
+	return fmt.Sprintf("%s.%d", l.path, i)
+}
+
+// Since returns events of the printer after t, oldest first, including the rotated files.
+// An empty printer matches all of them. Only the last limit events are returned if there are more
+func (l *Log) Since(t time.Time, printer string, limit int) ([]Event, error) {
+	segments, err := l.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, seg := range segments {
+			seg.file.Close()
+		}
+	}()
+	// Writes go on meanwhile, the segments are read as they were when they were opened
+	var events []Event
+	for _, seg := range segments {
+		found, err := read(io.LimitReader(seg.file, seg.size), t, printer)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", seg.file.Name(), err)
+		}
+		events = append(events, found...)
+		if len(events) > limit {
+			events = events[len(events)-limit:]
+		}
+	}
+	return events, nil
+}
+
+// segment is an opened file of the log and its size when it was opened
+type segment struct {
+	file *os.File
+	size int64
+}
+
+// snapshot opens the log files, oldest first. The opened files survive the rotation
+func (l *Log) snapshot() ([]segment, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var segments []segment
+	for i := keep; i >= 0; i-- {
+		path := l.path
+		if i > 0 {
+			path = l.rotated(i)
+		}
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		var info os.FileInfo
+		if err == nil {
+			info, err = file.Stat()
+			if err != nil {
+				file.Close()
+			}
+		}
+		if err != nil {
+			for _, seg := range segments {
+				seg.file.Close()
+			}
+			return nil, err
+		}
+		segments = append(segments, segment{file: file, size: info.Size()})
+	}
+	return segments, nil
+}
+
+// read returns matching events. Lines which can't be decoded, e.g. cut by a crash, are skipped
+func read(r io.Reader, t time.Time, printer string) ([]Event, error) {
+	var events []Event
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var ev Event
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			continue
+		}
+		if ev.Time.After(t) && (printer == "" || ev.Printer == printer) {
+			events = append(events, ev)
+		}
+	}
+	return events, scanner.Err()
+}
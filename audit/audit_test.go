@@ -0,0 +1,75 @@
+package audit
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func open(t *testing.T) *Log {
+	t.Helper()
+	l, err := Open(filepath.Join(t.TempDir(), "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func TestSince(t *testing.T) {
+	l := open(t)
+	start := time.Now()
+	for i := 1; i <= 5; i++ {
+		printer := "mk3"
+		if i%2 == 0 {
+			printer = "mini"
+		}
+		if err := l.Write(Event{Time: start.Add(time.Duration(i) * time.Second), Printer: printer, JobID: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	events, err := l.Since(start.Add(time.Second), "mk3", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].JobID != 3 || events[1].JobID != 5 {
+		t.Fatalf("got %+v, want jobs 3 and 5", events)
+	}
+	events, err = l.Since(start, "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].JobID != 4 || events[1].JobID != 5 {
+		t.Fatalf("got %+v, want the last 2 jobs", events)
+	}
+}
+
+func TestSinceWhileWriting(t *testing.T) {
+	l := open(t)
+	start := time.Now()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= 200; i++ {
+			if err := l.Write(Event{Time: start, Printer: "mk3", JobID: i}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		events, err := l.Since(time.Time{}, "", 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j, ev := range events {
+			if ev.JobID != j+1 {
+				t.Fatalf("event %d is job %d, events are lost or cut", j, ev.JobID)
+			}
+		}
+	}
+	wg.Wait()
+}
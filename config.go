@@ -0,0 +1,514 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/leoleovich/3djuggler/juggler"
+	"github.com/leoleovich/3djuggler/moonraker"
+	"github.com/leoleovich/3djuggler/octoprint"
+	"github.com/leoleovich/3djuggler/prusalink"
+	log "github.com/sirupsen/logrus"
+)
+
+// envPrefix starts the environment variables which override the config, e.g. JUGGLER_INTERN_API_KEY
+const envPrefix = "JUGGLER_"
+
+// redacted replaces secrets in /config and in the log
+const redacted = "REDACTED"
+
+// configError lists everything wrong with the config at once
+type configError []string
+
+func (e configError) Error() string {
+	return "invalid config:\n  " + strings.Join(e, "\n  ")
+}
+
+func (e *configError) add(format string, args ...interface{}) {
+	*e = append(*e, fmt.Sprintf(format, args...))
+}
+
+// loadConfig reads the config file and returns it with the configs of all printers.
+// Environment variables override the file, secret files are read and everything is validated
+func loadConfig(path string) (*Config, []*PrinterConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't open main config: %w", err)
+	}
+	config, unknown, err := decodeConfig(b)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't decode %s: %w", path, err)
+	}
+	if unknown != nil {
+		log.Warningf("%s: %v, it is ignored", path, unknown)
+	}
+	config.environment(os.LookupEnv)
+	if config.Listen == "" {
+		config.Listen = defaultListen
+	}
+	if config.HistoryFile == "" {
+		config.HistoryFile = defaultHistoryFile
+	}
+	if config.WebhookDir == "" {
+		config.WebhookDir = defaultWebhookDir
+	}
+	printers, err := config.printers()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, p := range printers {
+		prefix := envPrefix
+		if len(config.Printers) > 0 {
+			prefix += envName(p.Name) + "_"
+		}
+		p.environment(prefix, os.LookupEnv)
+	}
+	if err := config.readSecrets(printers); err != nil {
+		return nil, nil, err
+	}
+	if err := config.validate(printers); err != nil {
+		return nil, nil, err
+	}
+	return config, printers, nil
+}
+
+// decodeConfig points at the line of a syntax or type error. Unknown fields, e.g. typos or fields of another
+// version of juggler, don't fail the config, the first one is returned as unknown
+func decodeConfig(b []byte) (config *Config, unknown error, err error) {
+	config = &Config{}
+	err = json.NewDecoder(bytes.NewReader(b)).Decode(config)
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		return nil, nil, fmt.Errorf("line %d: %v", line(b, syntaxErr.Offset), syntaxErr)
+	case errors.As(err, &typeErr):
+		return nil, nil, fmt.Errorf("line %d: %s must be %s, not %s", line(b, typeErr.Offset), typeErr.Field, typeErr.Type, typeErr.Value)
+	case err != nil:
+		return nil, nil, err
+	}
+	strict := json.NewDecoder(bytes.NewReader(b))
+	strict.DisallowUnknownFields()
+	if err := strict.Decode(&Config{}); err != nil {
+		unknown = errors.New(strings.TrimPrefix(err.Error(), "json: "))
+	}
+	return config, unknown, nil
+}
+
+func line(b []byte, offset int64) int {
+	if offset > int64(len(b)) {
+		offset = int64(len(b))
+	}
+	return bytes.Count(b[:offset], []byte("\n")) + 1
+}
+
+var nonAlphanumeric = regexp.MustCompile(`[^A-Z0-9]+`)
+
+// envName turns the printer name into a part of the name of an environment variable, e.g. mk3-1 into MK3_1
+func envName(name string) string {
+	return nonAlphanumeric.ReplaceAllString(strings.ToUpper(name), "_")
+}
+
+// override sets the fields to the environment variables which are set
+func override(lookup func(string) (string, bool), fields map[string]*string) bool {
+	set := false
+	for name, field := range fields {
+		if value, ok := lookup(name); ok {
+			*field = value
+			set = true
+		}
+	}
+	return set
+}
+
+// environment applies JUGGLER_LISTEN, JUGGLER_ADMIN_TOKEN and JUGGLER_INTERN_* overrides
+func (c *Config) environment(lookup func(string) (string, bool)) {
+	override(lookup, map[string]*string{
+		envPrefix + "LISTEN":           &c.Listen,
+		envPrefix + "ADMIN_TOKEN":      &c.AdminToken,
+		envPrefix + "ADMIN_TOKEN_FILE": &c.AdminTokenFile,
+		envPrefix + "HISTORY_FILE":     &c.HistoryFile,
+		envPrefix + "WEBHOOK_DIR":      &c.WebhookDir,
+	})
+	intern := c.InternEndpoint
+	if intern == nil {
+		intern = &InternEndpoint{}
+	}
+	set := override(lookup, map[string]*string{
+		envPrefix + "INTERN_API_APP":      &intern.APIApp,
+		envPrefix + "INTERN_API_KEY":      &intern.APIKey,
+		envPrefix + "INTERN_API_KEY_FILE": &intern.APIKeyFile,
+		envPrefix + "INTERN_API_URI":      &intern.APIURI,
+		envPrefix + "INTERN_PRINTER_NAME": &intern.PrinterName,
+		envPrefix + "INTERN_OFFICE_NAME":  &intern.OfficeName,
+	})
+	if set {
+		c.InternEndpoint = intern
+	}
+}
+
+// environment applies overrides of the printer, e.g. JUGGLER_SERIAL or JUGGLER_MK3_1_SERIAL with multiple printers
+func (p *PrinterConfig) environment(prefix string, lookup func(string) (string, bool)) {
+	override(lookup, map[string]*string{
+		prefix + "SERIAL":     &p.Serial,
+		prefix + "BACKEND":    &p.Backend,
+		prefix + "STATE_FILE": &p.StateFile,
+		prefix + "QUEUE_DIR":  &p.QueueDir,
+	})
+	m := p.Moonraker
+	if m == nil {
+		m = &moonraker.Config{}
+	}
+	if override(lookup, map[string]*string{
+		prefix + "MOONRAKER_URL":          &m.URL,
+		prefix + "MOONRAKER_API_KEY":      &m.APIKey,
+		prefix + "MOONRAKER_API_KEY_FILE": &m.APIKeyFile,
+	}) {
+		p.Moonraker = m
+	}
+	pl := p.PrusaLink
+	if pl == nil {
+		pl = &prusalink.Config{}
+	}
+	if override(lookup, map[string]*string{
+		prefix + "PRUSALINK_URL":          &pl.URL,
+		prefix + "PRUSALINK_API_KEY":      &pl.APIKey,
+		prefix + "PRUSALINK_API_KEY_FILE": &pl.APIKeyFile,
+	}) {
+		p.PrusaLink = pl
+	}
+	op := p.OctoPrint
+	if op == nil {
+		op = &octoprint.Config{}
+	}
+	if override(lookup, map[string]*string{
+		prefix + "OCTOPRINT_URL":          &op.URL,
+		prefix + "OCTOPRINT_API_KEY":      &op.APIKey,
+		prefix + "OCTOPRINT_API_KEY_FILE": &op.APIKeyFile,
+	}) {
+		p.OctoPrint = op
+	}
+}
+
+// readSecret reads file into value. Setting both is an error
+func readSecret(value *string, file, name string) error {
+	if file == "" {
+		return nil
+	}
+	if *value != "" {
+		return fmt.Errorf("%s: set either the key or the key file, not both", name)
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	*value = strings.TrimSpace(string(b))
+	if *value == "" {
+		return fmt.Errorf("%s: %s is empty", name, file)
+	}
+	return nil
+}
+
+// readSecrets resolves api_key_file, secret_file and AdminTokenFile references
+func (c *Config) readSecrets(printers []*PrinterConfig) error {
+	var errs configError
+	if err := readSecret(&c.AdminToken, c.AdminTokenFile, "AdminTokenFile"); err != nil {
+		errs.add("%v", err)
+	}
+	if ie := c.InternEndpoint; ie != nil {
+		if err := readSecret(&ie.APIKey, ie.APIKeyFile, "InternEnpoint.api_key_file"); err != nil {
+			errs.add("%v", err)
+		}
+	}
+	for i := range c.Webhooks {
+		wc := &c.Webhooks[i]
+		if err := readSecret(&wc.Secret, wc.SecretFile, "Webhooks."+wc.Name+".secret_file"); err != nil {
+			errs.add("%v", err)
+		}
+	}
+	for _, p := range printers {
+		var secrets []error
+		if p.Moonraker != nil {
+			secrets = append(secrets, readSecret(&p.Moonraker.APIKey, p.Moonraker.APIKeyFile, "Moonraker.api_key_file"))
+		}
+		if p.PrusaLink != nil {
+			secrets = append(secrets, readSecret(&p.PrusaLink.APIKey, p.PrusaLink.APIKeyFile, "PrusaLink.api_key_file"))
+		}
+		if p.OctoPrint != nil {
+			secrets = append(secrets, readSecret(&p.OctoPrint.APIKey, p.OctoPrint.APIKeyFile, "OctoPrint.api_key_file"))
+		}
+		for _, err := range secrets {
+			if err != nil {
+				errs.add("printer %s: %v", p.Name, err)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validate checks the whole config and reports all problems at once
+func (c *Config) validate(printers []*PrinterConfig) error {
+	var errs configError
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		errs.add("Listen: %v", err)
+	}
+	if ie := c.InternEndpoint; ie != nil {
+		if ie.APIApp == "" {
+			errs.add("InternEnpoint.api_app is required")
+		}
+		if ie.APIKey == "" {
+			errs.add("InternEnpoint.api_key or api_key_file is required")
+		}
+		if err := validURL(ie.APIURI); err != nil {
+			errs.add("InternEnpoint.api_uri: %v", err)
+		}
+	}
+
+	if len(c.Printers) > 0 {
+		// They would be silently ignored
+		for _, field := range c.PrinterConfig.set() {
+			errs.add("%s is set at the top level, it belongs to the printers in Printers", field)
+		}
+	}
+	c.validateWebhooks(&errs, printers)
+
+	stateFiles := make(map[string]string)
+	hotFolders := make(map[string]string)
+	for _, p := range printers {
+		p.validate(&errs)
+		if other, ok := stateFiles[p.StateFile]; ok {
+			errs.add("printer %s: StateFile %s is used by printer %s", p.Name, p.StateFile, other)
+		}
+		stateFiles[p.StateFile] = p.Name
+		if p.HotFolder != nil {
+			// Printers would take each other's jobs back on restart
+			dir := filepath.Clean(p.HotFolder.Dir)
+			if other, ok := hotFolders[dir]; ok {
+				errs.add("printer %s: HotFolder %s is used by printer %s", p.Name, dir, other)
+			}
+			hotFolders[dir] = p.Name
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// validateWebhooks checks the webhooks have unique names, since they name the outboxes, and know the statuses and printers
+func (c *Config) validateWebhooks(errs *configError, printers []*PrinterConfig) {
+	names := make(map[string]bool)
+	for i, wc := range c.Webhooks {
+		if !validName.MatchString(wc.Name) {
+			errs.add("Webhooks[%d]: invalid name %q", i, wc.Name)
+		} else if names[wc.Name] {
+			errs.add("Webhooks[%d]: name %s is used twice", i, wc.Name)
+		}
+		names[wc.Name] = true
+		if err := validURL(wc.URL); err != nil {
+			errs.add("Webhooks.%s.url: %v", wc.Name, err)
+		}
+	statuses:
+		for _, status := range wc.Statuses {
+			for _, known := range juggler.Statuses {
+				if status == known {
+					continue statuses
+				}
+			}
+			errs.add("Webhooks.%s.statuses: unknown status %q", wc.Name, status)
+		}
+	names:
+		for _, name := range wc.Printers {
+			for _, p := range printers {
+				if p.Name == name {
+					continue names
+				}
+			}
+			errs.add("Webhooks.%s.printers: unknown printer %q", wc.Name, name)
+		}
+	}
+}
+
+func (p *PrinterConfig) validate(errs *configError) {
+	fail := func(format string, args ...interface{}) {
+		errs.add("printer %s: %s", p.Name, fmt.Sprintf(format, args...))
+	}
+	switch p.Backend {
+	case backendSerial:
+		if p.Serial == "" {
+			fail("Serial is required")
+		}
+	case backendMoonraker:
+		if p.Moonraker == nil {
+			fail("Moonraker is required")
+		} else if err := validURL(p.Moonraker.URL); err != nil {
+			fail("Moonraker.url: %v", err)
+		}
+	case backendPrusaLink:
+		if p.PrusaLink == nil {
+			fail("PrusaLink is required")
+		} else if err := validURL(p.PrusaLink.URL); err != nil {
+			fail("PrusaLink.url: %v", err)
+		}
+	case backendOctoPrint:
+		if p.OctoPrint == nil {
+			fail("OctoPrint is required")
+		} else if err := validURL(p.OctoPrint.URL); err != nil {
+			fail("OctoPrint.url: %v", err)
+		}
+	default:
+		fail("unknown Backend %q", p.Backend)
+	}
+	if p.Backend != backendSerial {
+		// These talk to the printer over the serial port
+		for field, set := range map[string]bool{
+			"SDPrint":           p.SDPrint,
+			"Monitor":           p.Monitor,
+			"KnobStart":         p.KnobStart,
+			"Attention":         p.Attention != nil,
+			"TranscriptDir":     p.TranscriptDir != "",
+			"TemperatureReport": p.TemperatureReport != 0,
+		} {
+			if set {
+				fail("%s requires the serial backend", field)
+			}
+		}
+	}
+	switch p.QueuePolicy {
+	case policyInternFirst, policyLocalFirst, policyAlternate:
+	default:
+		fail("unknown QueuePolicy %q", p.QueuePolicy)
+	}
+	switch p.ShutdownPolicy {
+	case shutdownCancel, shutdownPause, shutdownRefuse:
+	default:
+		fail("unknown ShutdownPolicy %q", p.ShutdownPolicy)
+	}
+	if p.ButtonTimeout < 0 {
+		fail("ButtonTimeout can't be negative")
+	}
+	if p.MaxUpload < 0 {
+		fail("MaxUpload can't be negative")
+	}
+	if p.TemperatureReport < 0 {
+		fail("TemperatureReport can't be negative")
+	}
+	if p.Attention != nil && p.Attention.Interval < 0 {
+		fail("Attention.Interval can't be negative")
+	}
+	if p.HotFolder != nil && p.HotFolder.Dir == "" {
+		fail("HotFolder.dir is required")
+	}
+}
+
+// set returns the names of the fields which are set
+func (p *PrinterConfig) set() []string {
+	var fields []string
+	v := reflect.ValueOf(p).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if v.Type().Field(i).PkgPath == "" && !v.Field(i).IsZero() {
+			fields = append(fields, v.Type().Field(i).Name)
+		}
+	}
+	return fields
+}
+
+func validURL(raw string) error {
+	if raw == "" {
+		return errors.New("is required")
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("%q is not an http(s) URL", raw)
+	}
+	return nil
+}
+
+// secrets returns the keys and tokens of the config
+func (c *Config) secrets(printers []*PrinterConfig) []string {
+	secrets := []string{c.AdminToken}
+	if c.InternEndpoint != nil {
+		secrets = append(secrets, c.InternEndpoint.APIKey)
+	}
+	for _, wc := range c.Webhooks {
+		secrets = append(secrets, wc.Secret)
+	}
+	for _, p := range printers {
+		if p.Moonraker != nil {
+			secrets = append(secrets, p.Moonraker.APIKey)
+		}
+		if p.PrusaLink != nil {
+			secrets = append(secrets, p.PrusaLink.APIKey)
+		}
+		if p.OctoPrint != nil {
+			secrets = append(secrets, p.OctoPrint.APIKey)
+		}
+	}
+	return secrets
+}
+
+// logRedactor is a logrus hook which masks secrets of the config, e.g. in errors which quote a request
+type logRedactor struct {
+	mu      sync.RWMutex
+	secrets []string
+}
+
+// minSecretLength keeps short values, which are probably not secrets, from masking half of the log
+const minSecretLength = 6
+
+// add masks the secrets from now on. Replaced secrets stay masked, they may still be in errors
+func (h *logRedactor) add(secrets []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+next:
+	for _, s := range secrets {
+		if len(s) < minSecretLength {
+			continue
+		}
+		for _, known := range h.secrets {
+			if known == s {
+				continue next
+			}
+		}
+		h.secrets = append(h.secrets, s)
+	}
+}
+
+func (h *logRedactor) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (h *logRedactor) Fire(entry *log.Entry) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for _, s := range h.secrets {
+		entry.Message = strings.ReplaceAll(entry.Message, s, redacted)
+		for k, v := range entry.Data {
+			if text, ok := v.(string); ok {
+				entry.Data[k] = strings.ReplaceAll(text, s, redacted)
+			} else if err, ok := v.(error); ok && strings.Contains(err.Error(), s) {
+				entry.Data[k] = strings.ReplaceAll(err.Error(), s, redacted)
+			}
+		}
+	}
+	return nil
+}
+
+// redactor masks secrets in the log of the whole process
+var redactor = &logRedactor{}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/leoleovich/3djuggler/moonraker"
+	log "github.com/sirupsen/logrus"
+)
+
+// load reads the config from a file like juggler does
+func load(t *testing.T, config string) (*Config, []*PrinterConfig, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "3djuggler.json")
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return loadConfig(path)
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		// want are parts of the error, the config is valid if empty
+		want []string
+	}{
+		{"defaults", `{}`, nil},
+		{"unknown field is ignored", `{"Serail": "/dev/ttyUSB0"}`, nil},
+		{"syntax error", "{\n\"Listen\": }", []string{"line 2"}},
+		{"type error", `{"ButtonTimeout": "600"}`, []string{"ButtonTimeout must be int"}},
+		{"listen without port", `{"Listen": "localhost"}`, []string{"Listen:"}},
+		{"printer fields next to Printers", `{"Serial": "/dev/ttyUSB0", "KnobStart": true, "Printers": [{"Name": "mk3"}]}`,
+			[]string{"KnobStart is set at the top level", "Serial is set at the top level"}},
+		{"duplicate printer", `{"Printers": [{"Name": "mk3"}, {"Name": "mk3"}]}`, []string{`duplicate printer name "mk3"`}},
+		{"shared state file", `{"Printers": [{"Name": "a", "StateFile": "/tmp/s.json"}, {"Name": "b", "StateFile": "/tmp/s.json"}]}`,
+			[]string{"StateFile /tmp/s.json is used by printer a"}},
+		{"backend without config", `{"Backend": "moonraker"}`, []string{"Moonraker is required"}},
+		{"serial option of network printer", `{"Backend": "octoprint", "OctoPrint": {"url": "http://octopi.local"}, "KnobStart": true}`,
+			[]string{"KnobStart requires the serial backend"}},
+		{"unknown backend", `{"Backend": "telnet"}`, []string{`unknown Backend "telnet"`}},
+		{"negative numbers", `{"ButtonTimeout": -1, "MaxUpload": -1}`,
+			[]string{"ButtonTimeout can't be negative", "MaxUpload can't be negative"}},
+		{"intern without key", `{"InternEnpoint": {"api_app": "juggler", "api_uri": "https://intern.example.com"}}`,
+			[]string{"InternEnpoint.api_key or api_key_file is required"}},
+		{"webhook", `{"Webhooks": [{"name": "chat", "url": "ftp://chat", "statuses": ["Done"], "printers": ["mk4"]}]}`,
+			[]string{"Webhooks.chat.url", `unknown status "Done"`, `unknown printer "mk4"`}},
+	}
+	for _, tt := range tests {
+		_, _, err := load(t, tt.config)
+		if len(tt.want) == 0 {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: config is valid, want %q", tt.name, tt.want)
+			continue
+		}
+		// Every problem is reported at once
+		for _, want := range tt.want {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("%s: %q doesn't mention %q", tt.name, err, want)
+			}
+		}
+	}
+}
+
+func TestUnknownField(t *testing.T) {
+	config, unknown, err := decodeConfig([]byte(`{"Listen": "[::1]:9999", "Serail": "/dev/ttyUSB0"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unknown == nil || unknown.Error() != `unknown field "Serail"` {
+		t.Fatalf("unknown field is reported as %v", unknown)
+	}
+	if config.Listen != "[::1]:9999" {
+		t.Fatalf("Listen is %q, the known fields must be read", config.Listen)
+	}
+}
+
+func TestEnvironment(t *testing.T) {
+	intern := func(c *Config) *InternEndpoint {
+		if c.InternEndpoint == nil {
+			return &InternEndpoint{}
+		}
+		return c.InternEndpoint
+	}
+	moonrakerOf := func(p *PrinterConfig) *moonraker.Config {
+		if p.Moonraker == nil {
+			return &moonraker.Config{}
+		}
+		return p.Moonraker
+	}
+	tests := []struct {
+		env, value string
+		got        func(c *Config, p *PrinterConfig) string
+	}{
+		{"JUGGLER_LISTEN", "[::]:9999", func(c *Config, _ *PrinterConfig) string { return c.Listen }},
+		{"JUGGLER_ADMIN_TOKEN_FILE", "/run/secrets/admin", func(c *Config, _ *PrinterConfig) string { return c.AdminTokenFile }},
+		{"JUGGLER_INTERN_API_KEY", "intern-key", func(c *Config, _ *PrinterConfig) string { return intern(c).APIKey }},
+		{"JUGGLER_INTERN_OFFICE_NAME", "LON", func(c *Config, _ *PrinterConfig) string { return intern(c).OfficeName }},
+		{"JUGGLER_MK3_1_SERIAL", "/dev/ttyUSB1", func(_ *Config, p *PrinterConfig) string { return p.Serial }},
+		{"JUGGLER_MK3_1_MOONRAKER_URL", "http://voron.local", func(_ *Config, p *PrinterConfig) string { return moonrakerOf(p).URL }},
+		{"JUGGLER_MK3_1_MOONRAKER_API_KEY_FILE", "/run/secrets/moonraker",
+			func(_ *Config, p *PrinterConfig) string { return moonrakerOf(p).APIKeyFile }},
+	}
+	for _, tt := range tests {
+		lookup := func(name string) (string, bool) {
+			if name == tt.env {
+				return tt.value, true
+			}
+			return "", false
+		}
+		c := &Config{}
+		p := &PrinterConfig{Name: "mk3-1"}
+		c.environment(lookup)
+		p.environment(envPrefix+envName(p.Name)+"_", lookup)
+		if got := tt.got(c, p); got != tt.value {
+			t.Errorf("%s: got %q, want %q", tt.env, got, tt.value)
+		}
+	}
+
+	// Sections are not made up without variables
+	c := &Config{}
+	p := &PrinterConfig{Name: "mk3-1"}
+	none := func(string) (string, bool) { return "", false }
+	c.environment(none)
+	p.environment(envPrefix, none)
+	if c.InternEndpoint != nil || p.Moonraker != nil || p.PrusaLink != nil || p.OctoPrint != nil {
+		t.Fatal("environment without variables added sections to the config")
+	}
+}
+
+func TestReadSecret(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	tests := []struct {
+		name, value, file string
+		want              string
+		// err is part of the error, the secret is read if empty
+		err string
+	}{
+		{"no file", "key", "", "key", ""},
+		{"file", "", write("key", " key\n"), "key", ""},
+		{"key and file", "key", write("both", "key"), "", "not both"},
+		{"empty file", "", write("empty", "\n"), "", "is empty"},
+		{"missing file", "", filepath.Join(dir, "missing"), "", "no such file"},
+	}
+	for _, tt := range tests {
+		value := tt.value
+		err := readSecret(&value, tt.file, "api_key_file")
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: got %v, want %q", tt.name, err, tt.err)
+		case tt.err == "" && value != tt.want:
+			t.Errorf("%s: read %q, want %q", tt.name, value, tt.want)
+		}
+	}
+
+	// Secret files of the config are read
+	keyFile := write("moonraker", "moonraker-key\n")
+	_, printers, err := load(t, `{"Backend": "moonraker", "Moonraker": {"url": "http://voron.local", "api_key_file": "`+keyFile+`"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key := printers[0].Moonraker.APIKey; key != "moonraker-key" {
+		t.Fatalf("Moonraker.api_key is %q", key)
+	}
+}
+
+func TestRedaction(t *testing.T) {
+	view := configView{
+		AdminToken: "admin-token",
+		Printers: []*PrinterConfig{{
+			Name:      "voron",
+			Moonraker: &moonraker.Config{URL: "http://voron.local", APIKey: "moonraker-key", APIKeyFile: "/run/secrets/moonraker"},
+		}},
+	}
+	tree, err := redact(view)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"admin-token", "moonraker-key"} {
+		if strings.Contains(string(b), secret) {
+			t.Errorf("/config shows %s: %s", secret, b)
+		}
+	}
+	// Files and addresses are not secrets
+	for _, kept := range []string{"/run/secrets/moonraker", "http://voron.local"} {
+		if !strings.Contains(string(b), kept) {
+			t.Errorf("/config lost %s: %s", kept, b)
+		}
+	}
+
+	r := &logRedactor{}
+	r.add([]string{"moonraker-key", "", "short"})
+	entry := log.WithField("error", errors.New("GET /?key=moonraker-key failed")).WithField("printer", "short")
+	entry.Message = "moonraker-key was rejected"
+	if err := r.Fire(entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Message != "REDACTED was rejected" || entry.Data["error"] != "GET /?key=REDACTED failed" {
+		t.Fatalf("log shows %q, %v", entry.Message, entry.Data["error"])
+	}
+	// Short values would mask half of the log
+	if entry.Data["printer"] != "short" {
+		t.Fatalf("printer is logged as %v", entry.Data["printer"])
+	}
+}
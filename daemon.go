@@ -1,225 +1,678 @@
 package main
 
 import (
-	"crypto/tls"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
+	"sync"
 	"time"
 
+	"github.com/leoleovich/3djuggler/audit"
 	"github.com/leoleovich/3djuggler/gcodefeeder"
+	"github.com/leoleovich/3djuggler/history"
 	"github.com/leoleovich/3djuggler/juggler"
+	"github.com/leoleovich/3djuggler/queue"
+	"github.com/leoleovich/3djuggler/webhook"
 	log "github.com/sirupsen/logrus"
 )
 
+// Daemon is an event loop. Handler commands, job source responses, printer changes and timers
+// are events which are handled one by one by the loop goroutine, the only one which changes the job
 type Daemon struct {
-	config     *Config
-	jobfile    string
-	job        *juggler.Job
-	ie         *InternEndpoint
-	feeder     *gcodefeeder.Feeder
-	statusChan chan juggler.JobStatus
+	config  *PrinterConfig
+	jobfile string
+	log     *log.Entry
+	// sources are asked for jobs in this order, see fetchOrder
+	sources []JobSource
+	printer Printer
+	// audit records status changes of jobs. Disabled if nil
+	audit *audit.Log
+	// history keeps records of the jobs which are over. Disabled if nil
+	history *history.Store
+	// webhooks are told about status changes of jobs
+	webhooks []*webhook.Hook
+
+	// mu guards job and config. The loop changes them, handlers read them with Job() and settings()
+	mu  sync.RWMutex
+	job *juggler.Job
+
+	events chan event
+	// workers call the sources, by the name of the source
+	workers map[string]*worker
+
+	// Fields below belong to the loop
+
+	// estopped is latched by /estop and cleared only by /estop/reset
+	estopped bool
+	// queue holds jobs submitted to juggler directly. Disabled if nil
+	queue *queue.Queue
+	// lastSource is the Source of the last assigned job
+	lastSource string
+	// fetching and checking are set while the call to the job source is in flight
+	fetching bool
+	checking bool
+	// sending is set while the job is sent to the printer, which takes minutes for uploads of network printers
+	sending bool
+	// buttonTimer fires when the job is not started on time
+	buttonTimer *time.Timer
+	// stopPrompt stops prompting on the printer
+	stopPrompt context.CancelFunc
+	// stopping is set once the daemon was asked to exit, it takes no more jobs
+	stopping bool
+	// interrupted is set when the print was paused for the exit
+	interrupted bool
+	// trail is the record of the current job, stored in history once the job is over
+	trail *history.Record
+	// recent are the records of statsWindow, started is when the daemon was started. See stats
+	recent  []history.Record
+	started time.Time
 }
 
+// event is a piece of work done by the loop
+type event struct {
+	name  string
+	fn    func() error
+	reply chan error
+}
+
+// Start runs the daemon in the background. HTTP handlers are served by Server
 func (daemon *Daemon) Start() {
-	var err error
-	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-	http.HandleFunc("/info", daemon.InfoHandler)
-	http.HandleFunc("/start", daemon.StartHandler)
-	http.HandleFunc("/pause", daemon.PauseHandler)
-	http.HandleFunc("/reschedule", daemon.RescheduleHandler)
-	http.HandleFunc("/cancel", daemon.CancelHandler)
-	http.HandleFunc("/version", daemon.VersionHandler)
-	go func() { log.Fatal(http.ListenAndServe(daemon.config.Listen, nil)) }()
-	log.Debug("Started http server on ", daemon.config.Listen)
-
-	daemon.statusChan = make(chan juggler.JobStatus, 10)
-	var oldStatus juggler.JobStatus
-
-	if err := daemon.ie.reschedule(); err != nil {
-		log.Error("reschedule failed: ", err)
-	}
-	for range time.Tick(pollingInterval) {
+	daemon.events = make(chan event)
+	daemon.workers = make(map[string]*worker)
+	for _, src := range daemon.sources {
+		w := newWorker()
+		daemon.workers[src.Name()] = w
+		go w.run()
+	}
+	daemon.started = time.Now()
+	go func() {
+		daemon.loadRecent()
+		daemon.restore()
+		daemon.run()
+	}()
+}
+
+// handlers returns the HTTP API of the daemon by path
+func (daemon *Daemon) handlers() map[string]http.HandlerFunc {
+	return map[string]http.HandlerFunc{
+		"info":           daemon.InfoHandler,
+		"start":          daemon.StartHandler,
+		"pause":          daemon.PauseHandler,
+		"reschedule":     daemon.RescheduleHandler,
+		"cancel":         daemon.CancelHandler,
+		"estop":          daemon.EmergencyStopHandler,
+		"estop/reset":    daemon.EmergencyStopResetHandler,
+		"stats":          daemon.StatsHandler,
+		"queue":          daemon.QueueHandler,
+		"queue/move":     daemon.QueueMoveHandler,
+		"queue/priority": daemon.QueuePriorityHandler,
+		"queue/remove":   daemon.QueueRemoveHandler,
+	}
+}
+
+// run is the event loop
+func (daemon *Daemon) run() {
+	ticker := time.NewTicker(pollingInterval)
+	defer ticker.Stop()
+	var changes <-chan struct{}
+	if p, ok := daemon.printer.(notifyingPrinter); ok {
+		changes = p.Changes()
+	}
+	jobs := daemon.sourceChanges()
+
+	if err := daemon.enter(daemon.job.Status); err != nil {
+		daemon.log.Error(err)
+	}
+	for {
 		select {
-		case daemon.job.Status = <-daemon.statusChan:
-			log.Debugf("Assigning status '%s'", daemon.job.Status)
-			if err := daemon.ie.reportJobStatusChange(daemon.job); err != nil {
-				log.Error("Can't report it to intern: ", err)
-			}
-		default:
-			log.Debug("No status updates")
+		case ev := <-daemon.events:
+			daemon.log.Debugf("Handling %s", ev.name)
+			ev.reply <- ev.fn()
+		case <-changes:
+			daemon.syncPrinter()
+		case <-jobs:
+			daemon.fetchIfIdle()
+		case <-ticker.C:
+			daemon.tick()
 		}
-		log.Infof("My status is: '%s'", daemon.job.Status)
+	}
+}
 
-		if err = daemon.ie.reportStat(); err != nil {
-			log.Error(err)
-		}
+// do runs fn on the loop and returns its error. It must not be called from the loop itself
+func (daemon *Daemon) do(name string, fn func() error) error {
+	reply := make(chan error, 1)
+	daemon.events <- event{name: name, fn: fn, reply: reply}
+	return <-reply
+}
 
-		switch daemon.job.Status {
-		case juggler.StatusWaitingJob, juggler.StatusButtonTimeout:
-			daemon.job.ID = 0
-			if err = daemon.ie.nextJob(); err != nil {
-				log.Error(err)
-				break
+// settings returns the config of the printer. The loop reads daemon.config directly, as only the loop replaces it
+func (daemon *Daemon) settings() *PrinterConfig {
+	daemon.mu.RLock()
+	defer daemon.mu.RUnlock()
+	return daemon.config
+}
+
+// Job returns a copy of the current job
+func (daemon *Daemon) Job() juggler.Job {
+	daemon.mu.RLock()
+	defer daemon.mu.RUnlock()
+	return *daemon.job
+}
+
+// update changes the job. Loop only
+func (daemon *Daemon) update(fn func(job *juggler.Job)) {
+	daemon.mu.Lock()
+	defer daemon.mu.Unlock()
+	fn(daemon.job)
+}
+
+// setStatus validates the status change against the transition table, records it with the reason
+// in the audit log, reports it to the job source and runs the actions of the new status. Loop only
+func (daemon *Daemon) setStatus(status juggler.JobStatus, reason string) error {
+	from := daemon.job.Status
+	if from == status {
+		return nil
+	}
+	if !from.CanTransition(status) {
+		return &juggler.TransitionError{From: from, To: status}
+	}
+	if daemon.estopped && status != juggler.StatusEmergencyStopped {
+		return errors.New("printer is emergency stopped, call /estop/reset first")
+	}
+	daemon.log.Infof("Status change from '%s' to '%s': %s", from, status, reason)
+	if status == juggler.StatusButtonTimeout {
+		buttonTimeouts.Inc(daemon.config.Name)
+	}
+	daemon.update(func(job *juggler.Job) { job.Status = status })
+	daemon.record(from, status, reason)
+	daemon.track(daemon.Job(), status, reason)
+	daemon.notify(from, status, reason)
+	daemon.save()
+	daemon.report()
+	if from == juggler.StatusWaitingButton {
+		daemon.stopWaitingButton()
+	}
+	return daemon.enter(status)
+}
+
+// enter runs the actions of the status the job has just got. Loop only
+func (daemon *Daemon) enter(status juggler.JobStatus) error {
+	switch status {
+	case juggler.StatusWaitingJob, juggler.StatusButtonTimeout:
+		daemon.update(func(job *juggler.Job) { job.ID = 0 })
+		daemon.save()
+		daemon.fetch()
+	case juggler.StatusWaitingButton:
+		daemon.log.Info("Job ", daemon.job.ID, " is waiting")
+		daemon.schedule(daemon.job.Scheduled)
+		if daemon.config.KnobStart || daemon.config.Attention != nil {
+			daemon.prompt()
+		}
+	case juggler.StatusSending:
+		// tick retries if printing fails to start
+		daemon.send()
+	case juggler.StatusCancelling, juggler.StatusFinished:
+		if !daemon.printer.Status().Terminal() {
+			daemon.log.Info("Stopping printer")
+			if err := daemon.printer.Cancel(); err != nil {
+				daemon.log.Error("Failed to stop printer: ", err)
 			}
-			daemon.job.ID = daemon.ie.job.ID
-			daemon.job.Filename = daemon.ie.job.Filename
-			daemon.job.FileContent = daemon.ie.job.FileContent
-			daemon.job.Progress = daemon.ie.job.Progress
-			daemon.job.Owner = daemon.ie.job.Owner
-			daemon.job.Color = daemon.ie.job.Color
-			daemon.job.Fetched = time.Now()
-			daemon.job.Scheduled = time.Now().Add(waitingForButtonInterval)
-
-			daemon.UpdateStatus(juggler.StatusWaitingButton)
-			fallthrough
+		}
+		job := daemon.Job()
+		if src := daemon.source(&job); src != nil {
+			daemon.workerOf(src).push("", func() {
+				daemon.log.Infof("Deleting from %s", src.Name())
+				if err := src.Complete(&job); err != nil {
+					daemon.log.Error(err)
+				}
+			})
+		}
+		return daemon.setStatus(juggler.StatusWaitingJob, "job is over")
+	case juggler.StatusEmergencyStopped:
+		daemon.log.Warning("Printer is emergency stopped. Reset the printer and call /estop/reset")
+	}
+	return nil
+}
 
-		case juggler.StatusWaitingButton:
-			log.Info("Job ", daemon.job.ID, " is waiting")
-			err = daemon.ie.getJob(daemon.job.ID)
-			if err != nil {
-				log.Error("Can't get job status from intern: ", err)
-			} else {
-				log.Info("Job status on intern: ", daemon.ie.job.Status)
+// tick polls whatever can't notify the loop. Loop only
+func (daemon *Daemon) tick() {
+	status := daemon.job.Status
+	daemon.log.Infof("My status is: '%s'", status)
+	var stats *Stats
+	for _, src := range daemon.sources {
+		src := src
+		if s, ok := src.(statsSource); ok {
+			if stats == nil {
+				stats = daemon.stats()
 			}
-			if err == nil && daemon.ie.job.Status == juggler.StatusCancelling {
-				log.Info("The job is cancelling")
-				daemon.UpdateStatus(juggler.StatusCancelling)
-				break
+			st := stats
+			daemon.workerOf(src).push("heartbeat", func() {
+				if err := s.HeartbeatStats(status, st); err != nil {
+					daemon.log.Error(err)
+				}
+			})
+			continue
+		}
+		daemon.workerOf(src).push("heartbeat", func() {
+			if err := src.Heartbeat(status); err != nil {
+				daemon.log.Error(err)
 			}
+		})
+	}
 
-			if daemon.job.Scheduled.After(time.Now()) {
-				log.Info("Waiting ", daemon.job.Scheduled.Unix()-time.Now().Unix(), " more seconds for somebody to press the button")
-			} else {
-				log.Warning("Nobody pressed the button on time")
-				log.Warning("Timeout while waiting for a job. Switching back to ", daemon.job.Status)
-				daemon.UpdateStatus(juggler.StatusButtonTimeout)
+	switch status {
+	case juggler.StatusWaitingJob, juggler.StatusButtonTimeout:
+		daemon.fetch()
+	case juggler.StatusWaitingButton:
+		daemon.log.Info("Waiting ", int(time.Until(daemon.job.Scheduled).Seconds()), " more seconds for somebody to press the button")
+		daemon.checkSource()
+	case juggler.StatusSending:
+		// Printing failed to start
+		daemon.send()
+	case juggler.StatusPrinting, juggler.StatusPaused:
+		daemon.checkSource()
+		daemon.syncPrinter()
+	case juggler.StatusLocalPrint:
+		if busy, known := daemon.localPrint(); known && !busy {
+			daemon.log.Info("Local print is over")
+			daemon.update(func(job *juggler.Job) {
+				job.Filename = ""
+				job.Progress = 0
+			})
+			if err := daemon.setStatus(juggler.StatusWaitingJob, "local print is over"); err != nil {
+				daemon.log.Error(err)
 			}
+			break
+		}
+		daemon.log.Infof("Printer is busy with a local print (%.0f%%)", daemon.job.Progress)
+	case juggler.StatusEmergencyStopped:
+		daemon.log.Warning("Printer is emergency stopped. Reset the printer and call /estop/reset")
+	}
+}
 
-		case juggler.StatusSending:
-			if oldStatus != juggler.StatusWaitingButton && oldStatus != juggler.StatusPaused {
-				log.Warningf("Forbidden status change sequence, from %s to %s. Ignoring", oldStatus, daemon.job.Status)
-				continue
-			}
+// report queues the status change of the job to its source. Loop only
+func (daemon *Daemon) report() {
+	daemon.reportAs("")
+}
 
-			log.Info("Sending to printer")
-			log.Debug("FileSize: ", len(daemon.job.FileContent))
-			err := os.WriteFile(daemon.jobfile, []byte(daemon.job.FileContent), 0644)
-			if err != nil {
-				log.Error(err)
-				break
-			}
+// reportAs queues the report with the worker key. Loop only
+func (daemon *Daemon) reportAs(key string) {
+	job := daemon.Job()
+	src := daemon.source(&job)
+	if job.ID == 0 || src == nil {
+		return
+	}
+	daemon.workerOf(src).push(key, func() {
+		if err := src.Update(&job); err != nil {
+			daemon.log.Errorf("Can't report it to %s: %v", src.Name(), err)
+		}
+	})
+}
 
-			daemon.feeder, err = gcodefeeder.NewFeeder(
-				daemon.config.Serial,
-				daemon.jobfile,
-			)
-			if err != nil {
-				log.Error("Failed to create Feeder: ", err)
-				break
-			}
-			daemon.UpdateStatus(juggler.StatusPrinting)
+// fetchIfIdle fetches the next job unless the daemon has one. Loop only
+func (daemon *Daemon) fetchIfIdle() {
+	if status := daemon.job.Status; status == juggler.StatusWaitingJob || status == juggler.StatusButtonTimeout {
+		daemon.fetch()
+	}
+}
+
+// fetch asks the sources for the next job unless the printer is busy. Loop only
+func (daemon *Daemon) fetch() {
+	// The jobfile is still read by the job which was sent
+	if daemon.fetching || daemon.sending || daemon.stopping {
+		return
+	}
+	if busy, known := daemon.localPrint(); !known {
+		daemon.log.Info("Waiting for the printer to report its status")
+		return
+	} else if busy {
+		daemon.log.Info("Printer is busy with a local print, not fetching jobs")
+		if err := daemon.setStatus(juggler.StatusLocalPrint, "local print on the printer"); err != nil {
+			daemon.log.Error(err)
+		}
+		return
+	}
+
+	daemon.fetching = true
+	daemon.next(daemon.fetchOrder())
+}
+
+// next asks the first of sources for a job on its worker and goes on with the rest if it has none
+func (daemon *Daemon) next(sources []JobSource) {
+	src := sources[0]
+	daemon.workerOf(src).push("", func() {
+		next, ok, err := src.Next()
+		if err != nil {
+			daemon.log.Errorf("Can't get the next job from %s: %v", src.Name(), err)
+		}
+		if err == nil && ok {
+			next.Source = src.Name()
+			_ = daemon.do("next job", func() error {
+				daemon.fetching = false
+				return daemon.assign(next)
+			})
+			return
+		}
+		if len(sources) > 1 {
+			daemon.next(sources[1:])
+			return
+		}
+		daemon.log.Debug("Nothing to print")
+		_ = daemon.do("no job", func() error {
+			daemon.fetching = false
+			return nil
+		})
+	})
+}
 
-			go func() {
-				if err = daemon.feeder.Feed(); err != nil {
-					log.Error(err)
+// assign makes next the current job. Loop only
+func (daemon *Daemon) assign(next juggler.Job) error {
+	if daemon.stopping {
+		daemon.log.Infof("Giving job %d back, exiting", next.ID)
+		daemon.giveBack(next)
+		// The local queue takes the job back with giveBack, intern releases it with Reschedule
+		if src := daemon.source(&next); src != nil {
+			daemon.workerOf(src).push("", func() {
+				if err := src.Reschedule(); err != nil {
+					daemon.log.Errorf("%s reschedule failed: %v", src.Name(), err)
 				}
-			}()
+			})
+		}
+		return nil
+	}
+	if status := daemon.job.Status; status != juggler.StatusWaitingJob && status != juggler.StatusButtonTimeout {
+		daemon.log.Warningf("Giving job %d back in '%s' status", next.ID, status)
+		daemon.giveBack(next)
+		return nil
+	}
+	daemon.log.Infof("Got job %d of %s from %s", next.ID, next.Owner, next.Source)
+	// Job file is kept until the next job, so the job can wait for the button across restarts
+	if err := os.WriteFile(daemon.jobfile, []byte(next.FileContent), 0644); err != nil {
+		daemon.giveBack(next)
+		return err
+	}
+	daemon.update(func(job *juggler.Job) {
+		job.ID = next.ID
+		job.Filename = next.Filename
+		job.FileContent = next.FileContent
+		job.Progress = next.Progress
+		job.Owner = next.Owner
+		job.Color = next.Color
+		job.Source = next.Source
+		job.MMU = nil
+		job.Fetched = time.Now()
+		job.Scheduled = time.Now().Add(daemon.config.buttonTimeout())
+	})
+	daemon.lastSource = next.Source
+	daemon.trail = &history.Record{
+		JobID:    next.ID,
+		Printer:  daemon.config.Name,
+		Owner:    next.Owner,
+		Filename: next.Filename,
+		Source:   next.Source,
+		Color:    next.Color,
+		Fetched:  daemon.job.Fetched,
+		Filament: filamentLength(next.FileContent),
+	}
+	return daemon.setStatus(juggler.StatusWaitingButton, "fetched from "+next.Source)
+}
 
-		case juggler.StatusPrinting:
-			log.Infof("Job %d is currently printing", daemon.job.ID)
-			// Check status from intern
-			err = daemon.ie.getJob(daemon.job.ID)
+// checkSource picks up the job cancelled in its source. Loop only
+func (daemon *Daemon) checkSource() {
+	src := daemon.source(daemon.job)
+	if daemon.checking || src == nil {
+		return
+	}
+	daemon.checking = true
+	id := daemon.job.ID
+	daemon.workerOf(src).push("", func() {
+		job, err := src.Get(id)
+		_ = daemon.do("job status", func() error {
+			daemon.checking = false
 			if err != nil {
-				log.Error("Can't report status to intern: ", err)
+				daemon.log.Errorf("Can't get job status from %s: %v", src.Name(), err)
+				return nil
 			}
-			if err == nil && daemon.ie.job.Status == juggler.StatusCancelling {
-				log.Info("Cancelling the job")
-				daemon.UpdateStatus(juggler.StatusCancelling)
-				break
+			status := job.Status
+			daemon.log.Infof("Job status on %s: %s", src.Name(), status)
+			if daemon.job.ID != id || status != juggler.StatusCancelling {
+				return nil
 			}
-			daemon.job.Progress = float64(daemon.feeder.Progress())
-			daemon.job.FeederStatus = daemon.feeder.Status()
-
-			switch daemon.job.FeederStatus {
-			case gcodefeeder.Printing:
-				// We need to update percentage of print
-				if err := daemon.ie.reportJobStatusChange(daemon.job); err != nil {
-					log.Error("Can't report it to intern: ", err)
-				}
-			case gcodefeeder.Finished:
-				daemon.UpdateStatus(juggler.StatusFinished)
-			case gcodefeeder.Error:
-				daemon.UpdateStatus(juggler.StatusCancelling)
-			case gcodefeeder.ManuallyPaused, gcodefeeder.FSensorBusy, gcodefeeder.MMUBusy:
-				daemon.UpdateStatus(juggler.StatusPaused)
-			default:
-				log.Warning("Printing. Feeder status is: ", daemon.feeder.Status())
+			daemon.log.Info("The job is cancelling")
+			return daemon.setStatus(juggler.StatusCancelling, "cancelled on "+src.Name())
+		})
+	})
+}
+
+// send starts printing the job on a goroutine and moves it to Printing once the printer took it.
+// If printing fails to start, the job stays in Sending and tick sends it again. Loop only
+func (daemon *Daemon) send() {
+	if daemon.sending {
+		return
+	}
+	daemon.sending = true
+	job := daemon.Job()
+	daemon.log.Info("Sending to printer")
+	daemon.log.Debug("FileSize: ", len(job.FileContent))
+	go func() {
+		err := daemon.printer.Print(&job, daemon.jobfile)
+		_ = daemon.do("sent", func() error {
+			daemon.sending = false
+			if err != nil {
+				daemon.log.Error("Failed to start printing: ", err)
+				return nil
 			}
-		case juggler.StatusPaused:
-			daemon.job.FeederStatus = daemon.feeder.Status()
-			log.Infof("Job %d is currently paused", daemon.job.ID)
-			switch daemon.job.FeederStatus {
-			case gcodefeeder.Printing:
-				daemon.UpdateStatus(juggler.StatusPrinting)
-			case gcodefeeder.Error:
-				daemon.UpdateStatus(juggler.StatusCancelling)
-			default:
-				log.Warning("Paused. Feeder status is: ", daemon.feeder.Status())
+			if daemon.job.ID != job.ID || daemon.job.Status != juggler.StatusSending {
+				daemon.log.Infof("Job %d went to '%s' while it was sent, stopping printer", job.ID, daemon.job.Status)
+				if err := daemon.printer.Cancel(); err != nil {
+					daemon.log.Error("Failed to stop printer: ", err)
+				}
+				daemon.fetchIfIdle()
+				return nil
 			}
-		case juggler.StatusCancelling:
-			fallthrough
-		case juggler.StatusFinished:
-			if daemon.feeder != nil && daemon.feeder.Status() != gcodefeeder.Finished {
-				log.Info("Stopping feeder")
-				daemon.feeder.Cancel()
+			return daemon.setStatus(juggler.StatusPrinting, "sent to the printer")
+		})
+	}()
+}
+
+// syncPrinter follows the status of the printer while the job is in it. Loop only
+func (daemon *Daemon) syncPrinter() {
+	if daemon.interrupted {
+		return
+	}
+	status := daemon.job.Status
+	if status != juggler.StatusPrinting && status != juggler.StatusPaused {
+		return
+	}
+	previous := daemon.job.FeederStatus
+	daemon.update(func(job *juggler.Job) {
+		job.Progress = daemon.printer.Progress()
+		job.FeederStatus = daemon.printer.Status()
+	})
+	daemon.updateMMU()
+
+	var err error
+	switch daemon.job.FeederStatus {
+	case gcodefeeder.Printing, gcodefeeder.Uploading:
+		if status == juggler.StatusPaused {
+			err = daemon.setStatus(juggler.StatusPrinting, "resumed on the printer")
+			break
+		}
+		daemon.log.Infof("Job %d is currently printing", daemon.job.ID)
+		// We need to update percentage of print
+		daemon.reportAs("progress")
+	case gcodefeeder.Finished:
+		if status == juggler.StatusPaused {
+			// Paused print can't finish on its own, it was stopped on the printer
+			err = daemon.setStatus(juggler.StatusCancelling, "stopped on the printer")
+			break
+		}
+		err = daemon.setStatus(juggler.StatusFinished, "printer finished")
+	case gcodefeeder.Cancelled:
+		err = daemon.setStatus(juggler.StatusCancelling, "cancelled on the printer")
+	case gcodefeeder.Connecting:
+		daemon.log.Infof("Job %d is waiting for the printer to connect", daemon.job.ID)
+	case gcodefeeder.Error, gcodefeeder.ConnectionFail:
+		err = daemon.setStatus(juggler.StatusCancelling, reasonPrinterError)
+	case gcodefeeder.ManuallyPaused, gcodefeeder.FSensorBusy, gcodefeeder.MMUBusy, gcodefeeder.MMUAttention:
+		if status == juggler.StatusPrinting {
+			err = daemon.setStatus(juggler.StatusPaused, "paused on the printer")
+			break
+		}
+		daemon.log.Infof("Job %d is currently paused", daemon.job.ID)
+		// Tell the source why we are paused, e.g. MMU went from busy to needing attention
+		if daemon.job.FeederStatus != previous {
+			daemon.report()
+		}
+	default:
+		daemon.log.Warningf("%s. Feeder status is: %s", status, daemon.job.FeederStatus)
+	}
+	if err != nil {
+		daemon.log.Error(err)
+	}
+}
+
+// schedule (re)arms the button timeout. Loop only
+func (daemon *Daemon) schedule(at time.Time) {
+	daemon.update(func(job *juggler.Job) { job.Scheduled = at })
+	daemon.save()
+	if daemon.buttonTimer != nil {
+		daemon.buttonTimer.Stop()
+	}
+	id := daemon.job.ID
+	daemon.buttonTimer = time.AfterFunc(time.Until(at), func() {
+		_ = daemon.do("button timeout", func() error {
+			if daemon.job.ID != id || daemon.job.Status != juggler.StatusWaitingButton || daemon.job.Scheduled.After(time.Now()) {
+				return nil
 			}
+			daemon.log.Warning("Nobody pressed the button on time")
+			return daemon.setStatus(juggler.StatusButtonTimeout, "nobody pressed the button")
+		})
+	})
+}
 
-			log.Info("Deleting from intern")
-			err = daemon.ie.deleteJob(daemon.job)
-			if err != nil {
-				log.Error(err)
+// stopWaitingButton stops the button timeout and the prompt on the printer. Loop only
+func (daemon *Daemon) stopWaitingButton() {
+	if daemon.buttonTimer != nil {
+		daemon.buttonTimer.Stop()
+		daemon.buttonTimer = nil
+	}
+	if daemon.stopPrompt != nil {
+		daemon.stopPrompt()
+		daemon.stopPrompt = nil
+	}
+}
+
+// prompt shows the waiting job on the printer until the job leaves StatusWaitingButton.
+// With KnobStart a click on the knob is treated as /start. Loop only
+func (daemon *Daemon) prompt() {
+	p, ok := daemon.printer.(buttonPrinter)
+	if !ok {
+		daemon.log.Warning("Printer backend doesn't support KnobStart and Attention")
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	// released is closed when the prompt doesn't hold the printer anymore
+	released := make(chan struct{})
+	daemon.stopPrompt = func() {
+		cancel()
+		<-released
+	}
+	job := daemon.Job()
+	// Reminders run on the prompt goroutine, they read the deadline with the lock
+	deadline := func() time.Time { return daemon.Job().Scheduled }
+	prompt := jobPrompt(job, deadline, daemon.config.Attention, daemon.config.buttonTimeout())
+	// The goroutine doesn't read the config, a reload replaces it on the loop
+	knobStart := daemon.config.KnobStart
+	go func() {
+		clicked := false
+		for ctx.Err() == nil && !clicked {
+			err := p.WaitForButton(ctx, prompt)
+			if err == nil {
+				clicked = knobStart
+				continue
+			}
+			if ctx.Err() == nil {
+				daemon.log.Error("Failed to prompt on the printer: ", err)
+				select {
+				case <-ctx.Done():
+				case <-time.After(pollingInterval):
+				}
+			}
+		}
+		close(released)
+		if !clicked {
+			return
+		}
+		daemon.log.Infof("Job %d was started with the knob", job.ID)
+		err := daemon.do("knob", func() error {
+			if daemon.job.ID != job.ID || daemon.job.Status != juggler.StatusWaitingButton {
+				return nil
 			}
-			daemon.UpdateStatus(juggler.StatusWaitingJob)
-		default:
-			log.Error("Job ", daemon.job, " is in a weird state")
+			return daemon.setStatus(juggler.StatusSending, "knob")
+		})
+		if err != nil {
+			daemon.log.Error(err)
 		}
+	}()
+}
 
-		oldStatus = daemon.job.Status
+// localPrint checks whether somebody started a print on the printer itself. known is false until the printer answers.
+// Loop only
+func (daemon *Daemon) localPrint() (busy bool, known bool) {
+	p, ok := daemon.printer.(localPrinter)
+	if !ok {
+		return false, true
+	}
+	lp, known := p.LocalPrint()
+	if lp.Active {
+		daemon.update(func(job *juggler.Job) {
+			job.Filename = lp.File
+			job.Progress = float64(lp.Progress)
+		})
 	}
+	return lp.Active, known
 }
 
-func (daemon *Daemon) UpdateStatus(status juggler.JobStatus) {
-	select {
-	case daemon.statusChan <- status:
-		log.Debugf("Requesting status change to: '%s'", status)
-	default:
-		log.Error("Unable to request status change. statusChan is full")
+// updateMMU copies the MMU state into the job if the printer backend knows about it. Loop only
+func (daemon *Daemon) updateMMU() {
+	if p, ok := daemon.printer.(mmuPrinter); ok {
+		mmu := p.MMU()
+		daemon.update(func(job *juggler.Job) { job.MMU = &mmu })
+	}
+}
+
+// info is the job as /info shows it
+func (daemon *Daemon) info() *juggler.Job {
+	current := daemon.Job()
+	return &juggler.Job{
+		ID:          current.ID,
+		Owner:       current.Owner,
+		Filename:    current.Filename,
+		Progress:    current.Progress,
+		Status:      current.Status,
+		Color:       current.Color,
+		Fetched:     current.Fetched,
+		Scheduled:   current.Scheduled,
+		PrinterName: daemon.settings().PrinterName,
+		MMU:         current.MMU,
 	}
 }
 
 // InfoHandler gives provides with json containing job status and some other important fields
 func (daemon *Daemon) InfoHandler(w http.ResponseWriter, _ *http.Request) {
-	log.Infof("Received info handler request")
+	daemon.log.Infof("Received info handler request")
 	// Add headers to allow AJAX
 	juggler.SetHeaders(w)
 
-	job := &juggler.Job{
-		ID:          daemon.job.ID,
-		Owner:       daemon.job.Owner,
-		Filename:    daemon.job.Filename,
-		Progress:    daemon.job.Progress,
-		Status:      daemon.job.Status,
-		Color:       daemon.job.Color,
-		Fetched:     daemon.job.Fetched,
-		Scheduled:   daemon.job.Scheduled,
-		PrinterName: daemon.config.InternEndpoint.PrinterName,
-	}
+	job := daemon.info()
 
 	b, err := json.Marshal(job)
 	if err != nil {
-		log.Errorf("Failed to respond on /info request: %v", err)
+		daemon.log.Errorf("Failed to respond on /info request: %v", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -227,98 +680,135 @@ func (daemon *Daemon) InfoHandler(w http.ResponseWriter, _ *http.Request) {
 }
 
 // StartHandler acknowledged start of the job
-func (daemon *Daemon) StartHandler(w http.ResponseWriter, _ *http.Request) {
-	log.Infof("Received start handler request")
+func (daemon *Daemon) StartHandler(w http.ResponseWriter, r *http.Request) {
+	daemon.log.Infof("Received start handler request")
 	// Add headers to allow AJAX
 	juggler.SetHeaders(w)
 
-	if daemon.job.Status == juggler.StatusWaitingButton {
-		// Initial start
-		daemon.UpdateStatus(juggler.StatusSending)
-		for daemon.job.Status != juggler.StatusSending {
-			log.Infof("Waiting for %s status to be set", juggler.StatusSending)
-			time.Sleep(1 * time.Second)
-		}
-		return
-	} else if daemon.job.Status == juggler.StatusPaused {
-		// Unpause
-		daemon.feeder.Start()
-		daemon.UpdateStatus(juggler.StatusPrinting)
-		for daemon.job.Status != juggler.StatusPrinting {
-			log.Infof("Waiting for %s status to be set", juggler.StatusPrinting)
-			time.Sleep(1 * time.Second)
+	code := http.StatusBadRequest
+	err := daemon.do("start", func() error {
+		switch daemon.job.Status {
+		case juggler.StatusWaitingButton:
+			// Initial start
+			return daemon.setStatus(juggler.StatusSending, "/start by "+client(r))
+		case juggler.StatusPaused:
+			// Unpause
+			if err := daemon.printer.Resume(); err != nil {
+				code = http.StatusConflict
+				return fmt.Errorf("failed to unpause printer: %w", err)
+			}
+			return daemon.setStatus(juggler.StatusPrinting, "/start by "+client(r))
 		}
-		return
+		return fmt.Errorf("Ignore buttonpress in '%v' status", daemon.job.Status)
+	})
+	if err != nil {
+		daemon.log.Info(err)
+		http.Error(w, err.Error(), code)
 	}
-
-	errS := fmt.Sprintf("Ignore buttonpress in '%v' status", daemon.job.Status)
-	log.Info(errS)
-	http.Error(w, errS, http.StatusBadRequest)
 }
 
 // RescheduleHandler resets the time when the job will start
 func (daemon *Daemon) RescheduleHandler(w http.ResponseWriter, _ *http.Request) {
-	log.Infof("Received reschedule handler request")
+	daemon.log.Infof("Received reschedule handler request")
 	// Add headers to allow AJAX
 	juggler.SetHeaders(w)
 
-	if daemon.job.Status != juggler.StatusWaitingButton {
-		errS := fmt.Sprintf("Ignore reschedule in '%v' status", daemon.job.Status)
-		log.Info(errS)
-		http.Error(w, errS, http.StatusBadRequest)
-		return
+	err := daemon.do("reschedule", func() error {
+		if daemon.job.Status != juggler.StatusWaitingButton {
+			return fmt.Errorf("Ignore reschedule in '%v' status", daemon.job.Status)
+		}
+		daemon.update(func(job *juggler.Job) { job.Fetched = time.Now() })
+		daemon.schedule(time.Now().Add(daemon.config.buttonTimeout()))
+		return nil
+	})
+	if err != nil {
+		daemon.log.Info(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 	}
-
-	daemon.job.Fetched = time.Now()
-	daemon.job.Scheduled = time.Now().Add(waitingForButtonInterval)
 }
 
 // CancelHandler cancels job execution
-func (daemon *Daemon) CancelHandler(w http.ResponseWriter, _ *http.Request) {
-	log.Infof("Received cancel handler request")
+func (daemon *Daemon) CancelHandler(w http.ResponseWriter, r *http.Request) {
+	daemon.log.Infof("Received cancel handler request")
 	// Add headers to allow AJAX
 	juggler.SetHeaders(w)
 
-	if daemon.job.ID == 0 {
-		errS := "Ignore cancel, no job scheduled"
-		log.Info(errS)
-		http.Error(w, errS, http.StatusBadRequest)
-		return
+	err := daemon.do("cancel", func() error {
+		if daemon.job.ID == 0 {
+			return errors.New("Ignore cancel, no job scheduled")
+		}
+		daemon.update(func(job *juggler.Job) { job.Scheduled = time.Time{} })
+		return daemon.setStatus(juggler.StatusCancelling, "/cancel by "+client(r))
+	})
+	if err != nil {
+		daemon.log.Info(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 	}
+}
+
+// PauseHandler pauses job execution
+func (daemon *Daemon) PauseHandler(w http.ResponseWriter, r *http.Request) {
+	daemon.log.Infof("Received pause handler request")
+	// Add headers to allow AJAX
+	juggler.SetHeaders(w)
 
-	daemon.job.Scheduled = time.Time{}
-	daemon.UpdateStatus(juggler.StatusCancelling)
-	for daemon.job.Status != juggler.StatusCancelling {
-		log.Infof("Waiting for %s status to be set", juggler.StatusCancelling)
-		time.Sleep(1 * time.Second)
+	code := http.StatusBadRequest
+	err := daemon.do("pause", func() error {
+		if daemon.job.Status != juggler.StatusPrinting {
+			return errors.New("Ignore pause, not printing")
+		}
+		if err := daemon.printer.Pause(); err != nil {
+			code = http.StatusConflict
+			return fmt.Errorf("failed to pause printer: %w", err)
+		}
+		return daemon.setStatus(juggler.StatusPaused, "/pause by "+client(r))
+	})
+	if err != nil {
+		daemon.log.Info(err)
+		http.Error(w, err.Error(), code)
 	}
 }
 
-// CancelHandler cancels job execution
-func (daemon *Daemon) PauseHandler(w http.ResponseWriter, _ *http.Request) {
-	log.Infof("Received pause handler request")
+// EmergencyStopHandler halts the printer right away and latches the daemon in the emergency stopped state
+func (daemon *Daemon) EmergencyStopHandler(w http.ResponseWriter, r *http.Request) {
+	daemon.log.Warning("Received emergency stop handler request")
 	// Add headers to allow AJAX
 	juggler.SetHeaders(w)
 
-	if daemon.job.Status != juggler.StatusPrinting {
-		errS := "Ignore pause, not printing"
-		log.Info(errS)
-		http.Error(w, errS, http.StatusBadRequest)
-		return
+	// Don't wait for the loop, it may be busy talking to the printer
+	stopErr := daemon.printer.EmergencyStop()
+	err := daemon.do("emergency stop", func() error {
+		daemon.estopped = true
+		return daemon.setStatus(juggler.StatusEmergencyStopped, "/estop by "+client(r))
+	})
+	if stopErr != nil {
+		err = stopErr
 	}
-
-	daemon.feeder.Pause()
-	daemon.UpdateStatus(juggler.StatusPaused)
-	for daemon.job.Status != juggler.StatusPaused {
-		log.Infof("Waiting for %s status to be set", juggler.StatusPaused)
-		time.Sleep(1 * time.Second)
+	if err != nil {
+		daemon.log.Error("Emergency stop failed: ", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
-// VersionHandler cancels job execution
-func (daemon *Daemon) VersionHandler(w http.ResponseWriter, _ *http.Request) {
-	log.Infof("Received version handler request")
+// EmergencyStopResetHandler leaves the emergency stopped state. The printer itself has to be reset by a human
+func (daemon *Daemon) EmergencyStopResetHandler(w http.ResponseWriter, r *http.Request) {
+	daemon.log.Info("Received emergency stop reset handler request")
 	// Add headers to allow AJAX
 	juggler.SetHeaders(w)
-	fmt.Fprint(w, gitCommit)
+
+	err := daemon.do("emergency stop reset", func() error {
+		if !daemon.estopped {
+			return errors.New("Ignore reset, not emergency stopped")
+		}
+		daemon.estopped = false
+		daemon.log.Info("Emergency stop was reset")
+		if daemon.job.ID != 0 {
+			return daemon.setStatus(juggler.StatusCancelling, "/estop/reset by "+client(r))
+		}
+		return daemon.setStatus(juggler.StatusWaitingJob, "/estop/reset by "+client(r))
+	})
+	if err != nil {
+		daemon.log.Info(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
 }
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/leoleovich/3djuggler/gcodefeeder"
+	"github.com/leoleovich/3djuggler/juggler"
+	log "github.com/sirupsen/logrus"
+)
+
+const testTimeout = 5 * time.Second
+
+// fakePrinter follows the requests of the daemon. The test changes its status with set
+type fakePrinter struct {
+	changes chan struct{}
+
+	mu       sync.Mutex
+	status   gcodefeeder.Status
+	progress float64
+	printed  []int
+}
+
+func newFakePrinter() *fakePrinter {
+	return &fakePrinter{changes: make(chan struct{}, 1), status: gcodefeeder.Ready}
+}
+
+// set changes the status as if the printer did it and tells the daemon
+func (p *fakePrinter) set(status gcodefeeder.Status) {
+	p.mu.Lock()
+	p.status = status
+	p.mu.Unlock()
+	select {
+	case p.changes <- struct{}{}:
+	default:
+	}
+}
+
+func (p *fakePrinter) Print(job *juggler.Job, _ string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.printed = append(p.printed, job.ID)
+	p.status = gcodefeeder.Printing
+	return nil
+}
+
+func (p *fakePrinter) Pause() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.status != gcodefeeder.Printing {
+		return errors.New("not printing")
+	}
+	p.status = gcodefeeder.ManuallyPaused
+	return nil
+}
+
+func (p *fakePrinter) Resume() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status = gcodefeeder.Printing
+	return nil
+}
+
+func (p *fakePrinter) Cancel() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status = gcodefeeder.Finished
+	return nil
+}
+
+func (p *fakePrinter) EmergencyStop() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status = gcodefeeder.Error
+	return nil
+}
+
+func (p *fakePrinter) Status() gcodefeeder.Status {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status
+}
+
+func (p *fakePrinter) Progress() float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.progress
+}
+
+func (p *fakePrinter) Changes() <-chan struct{} {
+	return p.changes
+}
+
+// fakeSource hands out its jobs once and records what the daemon reports
+type fakeSource struct {
+	// name is "fake" if empty
+	name string
+	// blocked holds Reschedule until it is closed, if set
+	blocked chan struct{}
+
+	mu          sync.Mutex
+	jobs        []juggler.Job
+	updates     []juggler.JobStatus
+	completed   []int
+	rescheduled int
+}
+
+func (s *fakeSource) Name() string {
+	if s.name == "" {
+		return "fake"
+	}
+	return s.name
+}
+
+func (s *fakeSource) Next() (juggler.Job, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.jobs) == 0 {
+		return juggler.Job{}, false, nil
+	}
+	job := s.jobs[0]
+	s.jobs = s.jobs[1:]
+	return job, true, nil
+}
+
+func (s *fakeSource) Get(id int) (juggler.Job, error) {
+	return juggler.Job{ID: id, Status: juggler.StatusPrinting}, nil
+}
+
+func (s *fakeSource) Update(job *juggler.Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.updates = append(s.updates, job.Status)
+	return nil
+}
+
+func (s *fakeSource) Complete(job *juggler.Job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.completed = append(s.completed, job.ID)
+	return nil
+}
+
+func (s *fakeSource) Heartbeat(juggler.JobStatus) error { return nil }
+
+func (s *fakeSource) Reschedule() error {
+	if s.blocked != nil {
+		<-s.blocked
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rescheduled++
+	return nil
+}
+
+// count returns how many times the source was told about status
+func (s *fakeSource) count(status juggler.JobStatus) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, update := range s.updates {
+		if update == status {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *fakeSource) completedJobs() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]int(nil), s.completed...)
+}
+
+// reported checks the source was told about the statuses in this order
+func (s *fakeSource) reported(t *testing.T, want ...juggler.JobStatus) {
+	t.Helper()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := 0
+	for _, status := range s.updates {
+		if i < len(want) && status == want[i] {
+			i++
+		}
+	}
+	if i < len(want) {
+		t.Fatalf("source got %q, want %q in this order", s.updates, want)
+	}
+}
+
+func newTestDaemon(t *testing.T, printer Printer, src JobSource, config PrinterConfig, more ...JobSource) *Daemon {
+	t.Helper()
+	daemon := testDaemon(t, printer, src, config)
+	daemon.sources = append(daemon.sources, more...)
+	daemon.Start()
+	settle(t, daemon)
+	return daemon
+}
+
+// settle waits for the started daemon to finish what the test began, so it doesn't write to the removed TempDir
+func settle(t *testing.T, daemon *Daemon) {
+	t.Cleanup(func() {
+		daemon.flush(testTimeout)
+		_ = daemon.do("test is over", func() error { return nil })
+		daemon.flush(testTimeout)
+	})
+}
+
+// testDaemon is not started, so the test can change it first
+func testDaemon(t *testing.T, printer Printer, src JobSource, config PrinterConfig) *Daemon {
+	t.Helper()
+	dir := t.TempDir()
+	config.Name = "test"
+	config.StateFile = filepath.Join(dir, "state.json")
+	daemon := &Daemon{
+		config:  &config,
+		jobfile: filepath.Join(dir, "job.gcode"),
+		job:     &juggler.Job{Status: juggler.StatusWaitingJob},
+		log:     log.WithField("printer", config.Name),
+		sources: []JobSource{src},
+		printer: printer,
+	}
+	return daemon
+}
+
+// waitJob waits until the job of the daemon is in status
+func waitJob(t *testing.T, daemon *Daemon, status juggler.JobStatus) juggler.Job {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for {
+		job := daemon.Job()
+		if job.Status == status {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job is in '%s', want '%s'", job.Status, status)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// call runs the handler like the server does and returns the response code
+func call(handler http.HandlerFunc) int {
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, "/", nil))
+	return w.Code
+}
+
+// flush waits for the calls to the job source. The loop goes first, the status seen by waitJob is not reported yet
+func flush(t *testing.T, daemon *Daemon) {
+	t.Helper()
+	_ = daemon.do("test flush", func() error { return nil })
+	if !daemon.flush(testTimeout) {
+		t.Fatal("calls to the job source did not finish")
+	}
+}
+
+func TestPauseAndCancel(t *testing.T) {
+	printer := newFakePrinter()
+	src := &fakeSource{jobs: []juggler.Job{{ID: 1, Filename: "cube.gcode", FileContent: "G28\n"}}}
+	daemon := newTestDaemon(t, printer, src, PrinterConfig{})
+
+	waitJob(t, daemon, juggler.StatusWaitingButton)
+	if code := call(daemon.StartHandler); code != http.StatusOK {
+		t.Fatalf("/start returned %d", code)
+	}
+	waitJob(t, daemon, juggler.StatusPrinting)
+
+	if code := call(daemon.PauseHandler); code != http.StatusOK {
+		t.Fatalf("/pause returned %d", code)
+	}
+	waitJob(t, daemon, juggler.StatusPaused)
+	if s := printer.Status(); s != gcodefeeder.ManuallyPaused {
+		t.Fatalf("printer is %s, want ManuallyPaused", s)
+	}
+	// Paused job can't be paused again
+	if code := call(daemon.PauseHandler); code != http.StatusBadRequest {
+		t.Fatalf("second /pause returned %d, want %d", code, http.StatusBadRequest)
+	}
+
+	if code := call(daemon.CancelHandler); code != http.StatusOK {
+		t.Fatalf("/cancel returned %d", code)
+	}
+	waitJob(t, daemon, juggler.StatusWaitingJob)
+	if s := printer.Status(); !s.Terminal() {
+		t.Fatalf("printer is %s after /cancel", s)
+	}
+	flush(t, daemon)
+	src.reported(t, juggler.StatusWaitingButton, juggler.StatusSending, juggler.StatusPrinting,
+		juggler.StatusPaused, juggler.StatusCancelling)
+	if completed := src.completedJobs(); len(completed) != 1 || completed[0] != 1 {
+		t.Fatalf("completed %v, want job 1", completed)
+	}
+	// The printer was printing when /cancel came, the print ended Cancelled
+	failures(t, daemon, map[string]int{"Cancelled": 1})
+}
+
+func TestPausedAndStoppedOnThePrinter(t *testing.T) {
+	printer := newFakePrinter()
+	src := &fakeSource{jobs: []juggler.Job{{ID: 2, FileContent: "G28\n"}}}
+	daemon := newTestDaemon(t, printer, src, PrinterConfig{})
+
+	waitJob(t, daemon, juggler.StatusWaitingButton)
+	call(daemon.StartHandler)
+	waitJob(t, daemon, juggler.StatusPrinting)
+
+	printer.set(gcodefeeder.FSensorBusy)
+	job := waitJob(t, daemon, juggler.StatusPaused)
+	if job.FeederStatus != gcodefeeder.FSensorBusy {
+		t.Fatalf("feeder status is %s, want FSensorBusy", job.FeederStatus)
+	}
+	// A paused print which is over was stopped on the printer, it did not finish
+	printer.set(gcodefeeder.Finished)
+	waitJob(t, daemon, juggler.StatusWaitingJob)
+	flush(t, daemon)
+	src.reported(t, juggler.StatusPrinting, juggler.StatusPaused, juggler.StatusCancelling)
+	src.mu.Lock()
+	for _, status := range src.updates {
+		if status == juggler.StatusFinished {
+			t.Fatal("stopped print was reported as finished")
+		}
+	}
+	src.mu.Unlock()
+
+	// The failure is counted by the status the print ended in, not by the status it was paused in
+	failures(t, daemon, map[string]int{"Cancelled": 1})
+}
+
+// failures checks the failures of the stats of the daemon
+func failures(t *testing.T, daemon *Daemon, want map[string]int) {
+	t.Helper()
+	var stats *Stats
+	_ = daemon.do("stats", func() error {
+		stats = daemon.stats()
+		return nil
+	})
+	if !reflect.DeepEqual(stats.Failures, want) {
+		t.Fatalf("failures are %v, want %v", stats.Failures, want)
+	}
+}
+
+func TestPrinterError(t *testing.T) {
+	printer := newFakePrinter()
+	src := &fakeSource{jobs: []juggler.Job{{ID: 7, FileContent: "G28\n"}}}
+	daemon := newTestDaemon(t, printer, src, PrinterConfig{})
+
+	waitJob(t, daemon, juggler.StatusWaitingButton)
+	call(daemon.StartHandler)
+	waitJob(t, daemon, juggler.StatusPrinting)
+	printer.set(gcodefeeder.Error)
+	waitJob(t, daemon, juggler.StatusWaitingJob)
+	failures(t, daemon, map[string]int{"Error": 1})
+}
+
+// slowPrinter takes the job only once uploaded is closed, like a network printer uploading a large file
+type slowPrinter struct {
+	*fakePrinter
+	uploaded chan struct{}
+}
+
+func (p *slowPrinter) Print(job *juggler.Job, jobfile string) error {
+	<-p.uploaded
+	return p.fakePrinter.Print(job, jobfile)
+}
+
+func TestCancelWhileSending(t *testing.T) {
+	printer := &slowPrinter{fakePrinter: newFakePrinter(), uploaded: make(chan struct{})}
+	src := &fakeSource{jobs: []juggler.Job{{ID: 3, FileContent: "G28\n"}}}
+	daemon := newTestDaemon(t, printer, src, PrinterConfig{})
+
+	waitJob(t, daemon, juggler.StatusWaitingButton)
+	if code := call(daemon.StartHandler); code != http.StatusOK {
+		t.Fatalf("/start returned %d", code)
+	}
+	waitJob(t, daemon, juggler.StatusSending)
+	// The loop is not held up by the upload
+	if code := call(daemon.CancelHandler); code != http.StatusOK {
+		t.Fatalf("/cancel returned %d", code)
+	}
+	waitJob(t, daemon, juggler.StatusWaitingJob)
+
+	// The printer took the job after it was cancelled, so it is stopped
+	close(printer.uploaded)
+	deadline := time.Now().Add(testTimeout)
+	for {
+		printer.mu.Lock()
+		stopped := len(printer.printed) == 1 && printer.status == gcodefeeder.Finished
+		printer.mu.Unlock()
+		if stopped {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("printer was not stopped after the cancelled job was sent")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if job := daemon.Job(); job.Status != juggler.StatusWaitingJob {
+		t.Fatalf("job is in '%s' after the upload, want '%s'", job.Status, juggler.StatusWaitingJob)
+	}
+}
+
+func TestButtonTimeout(t *testing.T) {
+	printer := newFakePrinter()
+	src := &fakeSource{jobs: []juggler.Job{{ID: 3, FileContent: "G28\n"}}}
+	daemon := newTestDaemon(t, printer, src, PrinterConfig{ButtonTimeout: 1})
+
+	waitJob(t, daemon, juggler.StatusWaitingButton)
+	waitJob(t, daemon, juggler.StatusButtonTimeout)
+	// Nothing was printed, the job is given back to its source
+	flush(t, daemon)
+	src.reported(t, juggler.StatusWaitingButton, juggler.StatusButtonTimeout)
+	printer.mu.Lock()
+	printed := printer.printed
+	printer.mu.Unlock()
+	if len(printed) != 0 {
+		t.Fatalf("printed %v", printed)
+	}
+	if code := call(daemon.StartHandler); code != http.StatusBadRequest {
+		t.Fatalf("/start after the timeout returned %d, want %d", code, http.StatusBadRequest)
+	}
+}
+
+func TestSlowSourceDoesNotHoldUpOthers(t *testing.T) {
+	printer := newFakePrinter()
+	src := &fakeSource{jobs: []juggler.Job{{ID: 4, FileContent: "G28\n"}}}
+	slow := &fakeSource{name: "slow", blocked: make(chan struct{})}
+	daemon := newTestDaemon(t, printer, src, PrinterConfig{}, slow)
+	// Unblocked before the daemon settles
+	defer close(slow.blocked)
+
+	waitJob(t, daemon, juggler.StatusWaitingButton)
+	call(daemon.StartHandler)
+	waitJob(t, daemon, juggler.StatusPrinting)
+	if !daemon.workerOf(src).flush(testTimeout) {
+		t.Fatal("calls to the source waited for the slow one")
+	}
+	src.reported(t, juggler.StatusWaitingButton, juggler.StatusSending, juggler.StatusPrinting)
+}
+
+func TestStopKeepsPausedJobPaused(t *testing.T) {
+	printer := newFakePrinter()
+	src := &fakeSource{jobs: []juggler.Job{{ID: 5, FileContent: "G28\n"}}}
+	daemon := newTestDaemon(t, printer, src, PrinterConfig{ShutdownPolicy: shutdownPause})
+
+	waitJob(t, daemon, juggler.StatusWaitingButton)
+	call(daemon.StartHandler)
+	waitJob(t, daemon, juggler.StatusPrinting)
+	call(daemon.PauseHandler)
+	waitJob(t, daemon, juggler.StatusPaused)
+	flush(t, daemon)
+	if n := src.count(juggler.StatusPaused); n != 1 {
+		t.Fatalf("source was told about the pause %d times, want 1", n)
+	}
+
+	if err := daemon.Stop(false); err != nil {
+		t.Fatal(err)
+	}
+	flush(t, daemon)
+	// The job was paused already, still the source hears that it stays paused for the exit
+	if n := src.count(juggler.StatusPaused); n != 2 {
+		t.Fatalf("source was told about the pause %d times, want 2", n)
+	}
+	if job := daemon.Job(); job.Status != juggler.StatusPaused {
+		t.Fatalf("job is in '%s' after the exit, want Paused", job.Status)
+	}
+}
+
+func TestJobFetchedWhileStopping(t *testing.T) {
+	printer := newFakePrinter()
+	// The job comes once the daemon is stopping: Next waits behind Reschedule of the restart
+	src := &fakeSource{jobs: []juggler.Job{{ID: 6, FileContent: "G28\n"}}, blocked: make(chan struct{})}
+	daemon := newTestDaemon(t, printer, src, PrinterConfig{})
+
+	if err := daemon.Stop(false); err != nil {
+		t.Fatal(err)
+	}
+	close(src.blocked)
+	deadline := time.Now().Add(testTimeout)
+	for src.count(juggler.StatusButtonTimeout) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("job fetched while stopping was not given back")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	flush(t, daemon)
+	if job := daemon.Job(); job.Status != juggler.StatusWaitingJob || job.ID != 0 {
+		t.Fatalf("job %d is in '%s', want no job", job.ID, job.Status)
+	}
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	if src.rescheduled != 2 {
+		t.Fatalf("rescheduled %d times, want 2: on the start and for the job", src.rescheduled)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/leoleovich/3djuggler/audit"
+	"github.com/leoleovich/3djuggler/juggler"
+	log "github.com/sirupsen/logrus"
+)
+
+// Events returned by /events unless limit is given
+const defaultEventsLimit = 1000
+
+// record writes the status change of the current job to the audit log. Loop only
+func (daemon *Daemon) record(from, to juggler.JobStatus, reason string) {
+	if daemon.audit == nil {
+		return
+	}
+	job := daemon.Job()
+	err := daemon.audit.Write(audit.Event{
+		Time:         time.Now(),
+		Printer:      daemon.config.Name,
+		JobID:        job.ID,
+		Owner:        job.Owner,
+		Filename:     job.Filename,
+		Source:       job.Source,
+		From:         from,
+		To:           to,
+		FeederStatus: job.FeederStatus.String(),
+		Reason:       reason,
+		Progress:     job.Progress,
+		Fetched:      job.Fetched,
+		Scheduled:    job.Scheduled,
+	})
+	if err != nil {
+		daemon.log.Error("Failed to write the audit log: ", err)
+	}
+}
+
+// EventsHandler gives the audit log. since (RFC 3339) returns only newer events,
+// printer filters by the printer and limit caps the number of the most recent events
+func (s *Server) EventsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Infof("Received events handler request")
+	// Add headers to allow AJAX
+	juggler.SetHeaders(w)
+	if s.audit == nil {
+		http.Error(w, "audit log is disabled", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	var since time.Time
+	if v := query.Get("since"); v != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			http.Error(w, "since must be an RFC 3339 time, e.g. 2021-01-02T15:04:05Z", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := defaultEventsLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	events, err := s.audit.Since(since, query.Get("printer"), limit)
+	if err != nil {
+		log.Error("Failed to read the audit log: ", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if events == nil {
+		events = []audit.Event{}
+	}
+	s.respondJSON(w, events)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/leoleovich/3djuggler/internal/websocket"
+)
+
+// FakeMoonraker pretends to be a Klipper printer which prints every file in duration
+type FakeMoonraker struct {
+	duration time.Duration
+
+	sync.Mutex
+	files    map[string]int
+	state    string
+	filename string
+	message  string
+	progress float64
+}
+
+func (m *FakeMoonraker) tick(step time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	if m.state != "printing" {
+		return
+	}
+	m.progress += float64(step) / float64(m.duration)
+	if m.progress >= 1 {
+		m.progress = 1
+		m.state = "complete"
+		log.Printf("Finished %s", m.filename)
+	}
+}
+
+func (m *FakeMoonraker) status() map[string]interface{} {
+	m.Lock()
+	defer m.Unlock()
+	return map[string]interface{}{
+		"print_stats": map[string]interface{}{
+			"state":    m.state,
+			"filename": m.filename,
+			"message":  m.message,
+		},
+		"virtual_sdcard": map[string]interface{}{
+			"progress": m.progress,
+		},
+	}
+}
+
+// transition changes the state if the printer is in one of from states
+func (m *FakeMoonraker) transition(w http.ResponseWriter, to string, from ...string) {
+	m.Lock()
+	defer m.Unlock()
+	for _, s := range from {
+		if m.state == s {
+			log.Printf("%s -> %s", m.state, to)
+			m.state = to
+			writeResult(w, "ok")
+			return
+		}
+	}
+	http.Error(w, fmt.Sprintf("can't go from %s to %s", m.state, to), http.StatusBadRequest)
+}
+
+func writeResult(w http.ResponseWriter, result interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"result": result}); err != nil {
+		log.Printf("writing response: %v", err)
+	}
+}
+
+func (m *FakeMoonraker) upload(w http.ResponseWriter, r *http.Request) {
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	n, err := io.Copy(io.Discard, file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m.Lock()
+	m.files[header.Filename] = int(n)
+	m.Unlock()
+	log.Printf("Uploaded %s (%d bytes)", header.Filename, n)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	writeResult(w, map[string]interface{}{"item": map[string]interface{}{"path": header.Filename, "root": "gcodes"}})
+}
+
+func (m *FakeMoonraker) start(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("filename")
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.files[name]; !ok {
+		http.Error(w, "no such file "+name, http.StatusNotFound)
+		return
+	}
+	if m.state == "printing" || m.state == "paused" {
+		http.Error(w, "printer is busy", http.StatusBadRequest)
+		return
+	}
+	log.Printf("Printing %s", name)
+	m.state = "printing"
+	m.filename = name
+	m.progress = 0
+	m.message = ""
+	writeResult(w, "ok")
+}
+
+func (m *FakeMoonraker) websocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		log.Printf("websocket: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	subscribed := make(chan struct{})
+	go func() {
+		for {
+			data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			var req struct {
+				Method string `json:"method"`
+				ID     int    `json:"id"`
+			}
+			if err := json.Unmarshal(data, &req); err != nil || req.Method != "printer.objects.subscribe" {
+				continue
+			}
+			resp, _ := json.Marshal(map[string]interface{}{
+				"jsonrpc": "2.0",
+				"id":      req.ID,
+				"result":  map[string]interface{}{"eventtime": 0, "status": m.status()},
+			})
+			if err := conn.WriteMessage(resp); err != nil {
+				return
+			}
+			close(subscribed)
+		}
+	}()
+
+	<-subscribed
+	for range time.Tick(1 * time.Second) {
+		msg, _ := json.Marshal(map[string]interface{}{
+			"jsonrpc": "2.0",
+			"method":  "notify_status_update",
+			"params":  []interface{}{m.status(), 0},
+		})
+		if err := conn.WriteMessage(msg); err != nil {
+			return
+		}
+	}
+}
+
+func main() {
+	var listen string
+	m := &FakeMoonraker{files: map[string]int{}, state: "standby"}
+	flag.StringVar(&listen, "listen", ":7125", "Where to listen")
+	flag.DurationVar(&m.duration, "duration", 1*time.Minute, "How long every print takes")
+	flag.Parse()
+
+	http.HandleFunc("/server/files/upload", m.upload)
+	http.HandleFunc("/printer/print/start", m.start)
+	http.HandleFunc("/printer/print/pause", func(w http.ResponseWriter, _ *http.Request) {
+		m.transition(w, "paused", "printing")
+	})
+	http.HandleFunc("/printer/print/resume", func(w http.ResponseWriter, _ *http.Request) {
+		m.transition(w, "printing", "paused")
+	})
+	http.HandleFunc("/printer/print/cancel", func(w http.ResponseWriter, _ *http.Request) {
+		m.transition(w, "cancelled", "printing", "paused")
+	})
+	http.HandleFunc("/printer/emergency_stop", func(w http.ResponseWriter, _ *http.Request) {
+		m.Lock()
+		log.Printf("Emergency stop")
+		m.state = "error"
+		m.message = "Shutdown due to M112 command"
+		m.Unlock()
+		writeResult(w, "ok")
+	})
+	http.HandleFunc("/printer/objects/query", func(w http.ResponseWriter, _ *http.Request) {
+		writeResult(w, map[string]interface{}{"eventtime": 0, "status": m.status()})
+	})
+	http.HandleFunc("/websocket", m.websocket)
+
+	go func() {
+		for range time.Tick(1 * time.Second) {
+			m.tick(1 * time.Second)
+		}
+	}()
+
+	log.Printf("Listening on %s", listen)
+	if err := http.ListenAndServe(listen, nil); err != nil {
+		log.Fatalf("serving HTTP: %v", err)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type state int
+
+const (
+	idle state = iota
+	printing
+	paused
+	finished
+	stopped
+)
+
+func (s state) String() string {
+	return []string{"idle", "printing", "paused", "finished", "stopped"}[s]
+}
+
+// FakePrinter is a printer which prints every file in duration
+type FakePrinter struct {
+	duration time.Duration
+	apiKey   string
+
+	sync.Mutex
+	state    state
+	jobID    int
+	filename string
+	progress float64
+}
+
+func (p *FakePrinter) tick(step time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+	if p.state != printing {
+		return
+	}
+	p.progress += 100 * float64(step) / float64(p.duration)
+	if p.progress >= 100 {
+		p.progress = 100
+		p.state = finished
+		log.Printf("Finished %s", p.filename)
+	}
+}
+
+func (p *FakePrinter) print(name string) error {
+	p.Lock()
+	defer p.Unlock()
+	if p.state == printing || p.state == paused {
+		return fmt.Errorf("printer is busy")
+	}
+	p.jobID++
+	p.filename = name
+	p.progress = 0
+	p.state = printing
+	log.Printf("Printing %s as job %d", name, p.jobID)
+	return nil
+}
+
+// transition changes the state if the printer is in one of from states
+func (p *FakePrinter) transition(to state, from ...state) error {
+	p.Lock()
+	defer p.Unlock()
+	for _, s := range from {
+		if p.state == s {
+			log.Printf("%s -> %s", p.state, to)
+			p.state = to
+			return nil
+		}
+	}
+	return fmt.Errorf("can't go from %s to %s", p.state, to)
+}
+
+// auth wraps handlers with X-Api-Key check
+func (p *FakePrinter) auth(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if p.apiKey != "" && r.Header.Get("X-Api-Key") != p.apiKey {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		log.Println(r.Method, r.URL.Path)
+		h(w, r)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("writing response: %v", err)
+	}
+}
+
+func (p *FakePrinter) prusaLink() {
+	states := map[state]string{idle: "IDLE", printing: "PRINTING", paused: "PAUSED", finished: "FINISHED", stopped: "STOPPED"}
+
+	http.HandleFunc("/api/v1/files/", p.auth(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		n, err := io.Copy(io.Discard, r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		name := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		log.Printf("Uploaded %s (%d bytes)", name, n)
+		if r.Header.Get("Print-After-Upload") == "?1" {
+			if err := p.print(name); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	http.HandleFunc("/api/v1/status", p.auth(func(w http.ResponseWriter, _ *http.Request) {
+		p.Lock()
+		resp := map[string]interface{}{
+			"printer": map[string]interface{}{"state": states[p.state]},
+		}
+		if p.jobID != 0 {
+			resp["job"] = map[string]interface{}{"id": p.jobID, "progress": p.progress}
+		}
+		p.Unlock()
+		writeJSON(w, resp)
+	}))
+
+	http.HandleFunc("/api/v1/job/", p.auth(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/job/"), "/")
+		id, err := strconv.Atoi(parts[0])
+		p.Lock()
+		current := p.jobID
+		p.Unlock()
+		if err != nil || id != current {
+			http.Error(w, "no such job", http.StatusNotFound)
+			return
+		}
+		switch {
+		case r.Method == http.MethodDelete:
+			err = p.transition(stopped, printing, paused)
+		case r.Method == http.MethodPut && len(parts) == 2 && parts[1] == "pause":
+			err = p.transition(paused, printing)
+		case r.Method == http.MethodPut && len(parts) == 2 && parts[1] == "resume":
+			err = p.transition(printing, paused)
+		default:
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
+
+func (p *FakePrinter) octoPrint() {
+	states := map[state]string{idle: "Operational", printing: "Printing", paused: "Paused", finished: "Operational", stopped: "Operational"}
+
+	http.HandleFunc("/api/files/local", p.auth(func(w http.ResponseWriter, r *http.Request) {
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		n, err := io.Copy(io.Discard, file)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("Uploaded %s (%d bytes)", header.Filename, n)
+		if r.FormValue("print") == "true" {
+			if err := p.print(header.Filename); err != nil {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	http.HandleFunc("/api/printer/command", p.auth(func(w http.ResponseWriter, r *http.Request) {
+		var cmd struct {
+			Commands []string `json:"commands"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&cmd); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, c := range cmd.Commands {
+			log.Printf("Command %s", c)
+			if c == "M112" {
+				p.Lock()
+				p.state = stopped
+				p.Unlock()
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	http.HandleFunc("/api/job", p.auth(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			p.Lock()
+			resp := map[string]interface{}{
+				"state":    states[p.state],
+				"job":      map[string]interface{}{"file": map[string]interface{}{"name": p.filename}},
+				"progress": map[string]interface{}{"completion": p.progress},
+			}
+			p.Unlock()
+			writeJSON(w, resp)
+			return
+		}
+		var cmd struct {
+			Command string `json:"command"`
+			Action  string `json:"action"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&cmd); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var err error
+		switch {
+		case cmd.Command == "cancel":
+			err = p.transition(stopped, printing, paused)
+		case cmd.Command == "pause" && cmd.Action == "pause":
+			err = p.transition(paused, printing)
+		case cmd.Command == "pause" && cmd.Action == "resume":
+			err = p.transition(printing, paused)
+		default:
+			http.Error(w, "unknown command", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
+
+func main() {
+	var listen, api string
+	p := &FakePrinter{}
+	flag.StringVar(&listen, "listen", ":8080", "Where to listen")
+	flag.StringVar(&api, "api", "prusalink", "API to pretend: prusalink or octoprint")
+	flag.StringVar(&p.apiKey, "apikey", "", "Require this X-Api-Key")
+	flag.DurationVar(&p.duration, "duration", 1*time.Minute, "How long every print takes")
+	flag.Parse()
+
+	switch api {
+	case "prusalink":
+		p.prusaLink()
+	case "octoprint":
+		p.octoPrint()
+	default:
+		log.Fatalf("unknown api %q", api)
+	}
+
+	go func() {
+		for range time.Tick(1 * time.Second) {
+			p.tick(1 * time.Second)
+		}
+	}()
+
+	log.Printf("Pretending to be %s on %s", api, listen)
+	if err := http.ListenAndServe(listen, nil); err != nil {
+		log.Fatalf("serving HTTP: %v", err)
+	}
+}
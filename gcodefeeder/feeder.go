@@ -5,6 +5,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"regexp"
 	"strconv"
@@ -28,6 +29,10 @@ const (
 	MMUBusy
 	Finished
 	Error
+	MMUAttention
+	Uploading
+	// Cancelled is reported by network printers when the print was stopped on the printer or in its UI
+	Cancelled
 )
 
 var strStatus = []string{
@@ -40,6 +45,9 @@ var strStatus = []string{
 	"MMUBusy",
 	"Finished",
 	"Error",
+	"MMUAttention",
+	"Uploading",
+	"Cancelled",
 }
 
 func (s Status) String() string {
@@ -49,58 +57,379 @@ func (s Status) String() string {
 	return strStatus[s]
 }
 
+// transitions lists every status change the feeder is allowed to make.
+// Statuses without an entry are terminal. A feeder starts in Connecting, Ready is the status of an idle printer
+var transitions = map[Status][]Status{
+	Connecting:     {Printing, Uploading, ConnectionFail, Error, Finished},
+	Ready:          {Printing, Uploading, Error, Finished},
+	Uploading:      {Printing, Error, Finished},
+	Printing:       {ManuallyPaused, FSensorBusy, MMUBusy, MMUAttention, Error, Finished},
+	ManuallyPaused: {Printing, Error, Finished},
+	FSensorBusy:    {Printing, ManuallyPaused, MMUBusy, MMUAttention, Error, Finished},
+	MMUBusy:        {Printing, ManuallyPaused, FSensorBusy, MMUAttention, Error, Finished},
+	MMUAttention:   {Printing, ManuallyPaused, MMUBusy, Error, Finished},
+}
+
+// CanTransition reports whether the feeder may go from s to next
+func (s Status) CanTransition(next Status) bool {
+	for _, allowed := range transitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// Terminal reports whether no further transitions are possible from s
+func (s Status) Terminal() bool {
+	return len(transitions[s]) == 0
+}
+
+// TransitionError is returned when a status change is not allowed by the transition table
+type TransitionError struct {
+	From Status
+	To   Status
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("illegal feeder status change from %s to %s", e.From, e.To)
+}
+
+// ErrStopped is returned by requests which arrive after Feed has returned
+var ErrStopped = errors.New("feeder is stopped")
+
+var commentRegexp = regexp.MustCompile(";.*")
+
+// Variables rather than constants, so tests don't wait for real printers
+var (
+	// connectTimeout is how long the printer has to greet us with "start" before the feeder gives up
+	connectTimeout = 30 * time.Second
+	// startDelay lets the printer finish booting after it greeted us
+	startDelay = 2 * time.Second
+)
+
+type eventKind int
+
+const (
+	// printer greeted us and is ready to receive commands
+	evStart eventKind = iota
+	// printer acknowledged the last command
+	evAck
+	evFSensor
+	evMMU
+	// printer was reset in the middle of the print
+	evReset
+	evReadError
+	// printer reported SD print progress
+	evSDProgress
+	// printer finished the SD print
+	evSDDone
+)
+
+// event is sent by the read goroutine to the owner goroutine
+type event struct {
+	kind eventKind
+	err  error
+	// MMU line and the status it asks for
+	message string
+	status  Status
+	// SD print progress in percent
+	progress int
+}
+
+// command asks the owner goroutine to move the feeder into status
+type command struct {
+	status Status
+	reply  chan error
+}
+
+// Feeder streams a gcode file to the printer.
+// All status changes of a running feeder are made by a single owner goroutine (Feed).
+// Everybody else (the read goroutine, Pause, Start, Cancel) talks to it through channels.
 type Feeder struct {
 	deviceName string
 	fileName   string
-	printerAck chan bool
-	progress   int
-	status     Status
 
-	tty            serial.Port
+	tty            io.ReadWriteCloser
 	writer         *bufio.Writer
 	reader         *bufio.Reader
 	progressRegexp *regexp.Regexp
 
-	sync.Mutex
-	cancelFunc context.CancelFunc
+	events   chan event
+	commands chan command
+	// done is closed when Feed returns
+	done chan struct{}
+
+	// mu guards the fields below
+	mu       sync.Mutex
+	status   Status
+	progress int
+	running  bool
+	closed   bool
+	stats    stats
+	mmu      MMUState
+	// temps are the last temperatures reported by the printer, known once reported is set
+	temps    Temperatures
+	reported bool
+	// slot requested by the last Tn command which is not acknowledged yet
+	pendingSlot int
+	// file name on the SD card, empty when streaming
+	sdName string
+	// following is set when the SD print was started before, e.g. by a previous run of the host
+	following bool
+	cancelled bool
+	// park moves the head away from the print before the heaters are turned off
+	park bool
+	// message is shown on the LCD before the first command of the file
+	message string
+	// tempInterval is how often the printer is asked to report its temperatures (M155), in seconds. Not asked if 0
+	tempInterval int
+	// notify is signalled on every status change
+	notify chan<- struct{}
 }
 
 func NewFeeder(deviceName, fileName string) (*Feeder, error) {
-	f := Feeder{
-		deviceName:     deviceName,
-		fileName:       fileName,
-		printerAck:     make(chan bool),
-		progressRegexp: regexp.MustCompile("M73 P([0-9]+).*"),
+	if _, err := os.Stat(fileName); os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to open %s: %w", fileName, err)
 	}
-	f.status = Connecting
-	err := f.connect()
+
+	tty, err := Connect(deviceName)
 	if err != nil {
-		f.status = ConnectionFail
 		return nil, fmt.Errorf("failed to connect to %s: %w", deviceName, err)
 	}
-	f.status = Ready
+	f := newFeeder(tty, fileName)
+	f.deviceName = deviceName
+	return f, nil
+}
 
+// NewFeederWithPort creates a feeder on top of an already opened transport, e.g. a Replayer
+func NewFeederWithPort(port io.ReadWriteCloser, fileName string) (*Feeder, error) {
 	if _, err := os.Stat(fileName); os.IsNotExist(err) {
 		return nil, fmt.Errorf("failed to open %s: %w", fileName, err)
 	}
+	return newFeeder(port, fileName), nil
+}
 
-	return &f, nil
+func newFeeder(tty io.ReadWriteCloser, fileName string) *Feeder {
+	return &Feeder{
+		fileName:       fileName,
+		tty:            tty,
+		writer:         bufio.NewWriter(tty),
+		reader:         bufio.NewReader(tty),
+		progressRegexp: regexp.MustCompile("M73 P([0-9]+).*"),
+		events:         make(chan event),
+		commands:       make(chan command),
+		done:           make(chan struct{}),
+		status:         Connecting,
+		stats:          stats{Stats: Stats{AckLatency: newHistogram()}},
+		mmu:            MMUState{Slot: -1},
+		pendingSlot:    -1,
+	}
+}
+
+// Record writes a timestamped transcript of the serial conversation to w.
+// It must be called before Feed
+func (f *Feeder) Record(w io.Writer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tty = NewRecorder(f.tty, w)
+	f.writer = bufio.NewWriter(f.tty)
+	f.reader = bufio.NewReader(f.tty)
 }
 
-func (f *Feeder) Cancel() {
-	f.Lock()
-	defer f.Unlock()
+// SetMessage shows msg on the LCD (M117) when the print starts.
+// It must be called before Feed
+func (f *Feeder) SetMessage(msg string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.message = msg
+}
+
+// ReportTemperatures asks the printer to report its temperatures every interval seconds (M155) before the file.
+// Without it temperatures are followed only if the firmware reports them on its own.
+// It must be called before Feed
+func (f *Feeder) ReportTemperatures(interval int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tempInterval = interval
+}
+
+// Notify makes the feeder signal ch without blocking on every status change.
+// It must be called before Feed
+func (f *Feeder) Notify(ch chan<- struct{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.notify = ch
+}
+
+// Park stops the print like Cancel, but lifts the head and homes X and Y first,
+// so the part can be inspected or the print restarted by hand
+func (f *Feeder) Park() error {
+	f.mu.Lock()
+	f.park = true
+	f.mu.Unlock()
+	return f.Cancel()
+}
+
+// Done is closed when Feed has returned and the connection is closed
+func (f *Feeder) Done() <-chan struct{} {
+	return f.done
+}
+
+// Cancel stops the print, turns off heaters and closes the connection
+func (f *Feeder) Cancel() error {
 	log.Debug("Feeder: Cancel is called")
-	// Feed, read and write function will terminate when context is cancelled
-	defer f.cancelFunc()
-	instructions := []string{
+	return f.request(Finished)
+}
+
+// EmergencyStop writes M112 straight to the port, bypassing the ack queue and the owner goroutine.
+// A newline goes first to terminate a command which may be half written.
+// The feeder then fails, the printer has to be reset before it accepts anything else
+func (f *Feeder) EmergencyStop() error {
+	log.Warning("Feeder: emergency stop")
+	if _, err := f.tty.Write([]byte("\nM112\n")); err != nil {
+		return err
+	}
+	go func() {
+		if err := f.request(Error); err != nil && !errors.Is(err, ErrStopped) {
+			log.Debug("Feeder: ", err)
+		}
+	}()
+	return nil
+}
+
+// Pause stops sending commands until Start is called
+func (f *Feeder) Pause() error {
+	return f.request(ManuallyPaused)
+}
+
+// Start resumes sending commands after Pause or after the printer paused itself
+func (f *Feeder) Start() error {
+	return f.request(Printing)
+}
+
+func (f *Feeder) Progress() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.progress
+}
+
+func (f *Feeder) Status() Status {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.status
+}
+
+// request hands the status change to the owner goroutine, or applies it directly if Feed was not called yet
+func (f *Feeder) request(status Status) error {
+	f.mu.Lock()
+	if !f.running {
+		defer f.mu.Unlock()
+		if err := f.transitionLocked(status); err != nil {
+			return err
+		}
+		if status == Finished {
+			f.shutdownLocked(true)
+		}
+		return nil
+	}
+	f.mu.Unlock()
+
+	reply := make(chan error, 1)
+	select {
+	case f.commands <- command{status: status, reply: reply}:
+		return <-reply
+	case <-f.done:
+		if s := f.Status(); s == status {
+			return nil
+		}
+		return ErrStopped
+	}
+}
+
+func (f *Feeder) setStatus(status Status) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.transitionLocked(status)
+}
+
+func (f *Feeder) transitionLocked(status Status) error {
+	if f.status == status {
+		return nil
+	}
+	if !f.status.CanTransition(status) {
+		return &TransitionError{From: f.status, To: status}
+	}
+	log.Debugf("Feeder: status %s -> %s", f.status, status)
+	f.stats.transition(time.Now(), f.status, status)
+	f.status = status
+	if f.notify != nil {
+		select {
+		case f.notify <- struct{}{}:
+		default:
+			// Previous signal is not consumed yet, it covers this change as well
+		}
+	}
+	return nil
+}
+
+// Stats returns performance counters of the feeder
+func (f *Feeder) Stats() Stats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.stats.snapshot(time.Now())
+}
+
+// Temperatures returns the last temperatures reported by the printer. ok is false until it reports them
+func (f *Feeder) Temperatures() (t Temperatures, ok bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.temps, f.reported
+}
+
+// MMU returns the active slot and the last MMU problem
+func (f *Feeder) MMU() MMUState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.mmu
+}
+
+func (f *Feeder) setProgress(progress int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.progress = progress
+}
+
+// shutdownLocked turns off heaters if cooldown is set and closes the connection. It is safe to call it multiple times
+func (f *Feeder) shutdownLocked(cooldown bool) {
+	if f.closed {
+		return
+	}
+	f.closed = true
+	if !cooldown {
+		f.tty.Close()
+		return
+	}
+
+	var instructions []string
+	if f.park {
+		instructions = append(instructions,
+			// lift the head relatively to the print
+			"G91\n",
+			"G1 Z10 F720\n",
+			"G90\n",
+			// and move it out of the way
+			"G28 X Y\n",
+		)
+	}
+	instructions = append(instructions,
 		//  turn off temperature
 		"M104 S0\n",
 		// turn off heatbed
 		"M140 S0\n",
 		// turn off fan
 		"M107\n",
-	}
+	)
 	for _, instruction := range instructions {
 		_, err := f.writer.Write([]byte(instruction))
 		if err != nil {
@@ -112,117 +441,188 @@ func (f *Feeder) Cancel() {
 	}
 
 	f.tty.Close()
-	f.status = Finished
 }
 
-func (f *Feeder) Progress() int {
-	return f.progress
-}
-
-func (f *Feeder) Status() Status {
-	return f.status
-}
-
-func (f *Feeder) connect() error {
+// Connect opens the serial port of the printer with DTR and RTS off, so boards which reset on DTR keep running.
+// Unix raises both for a moment while the port is opened, see NewPort to open it only once
+func Connect(deviceName string) (serial.Port, error) {
 	mode := &serial.Mode{
-		BaudRate: 115200,
+		BaudRate:          115200,
+		InitialStatusBits: &serial.ModemOutputBits{DTR: false, RTS: false},
 	}
-	tty, err := serial.Open(f.deviceName, mode)
-	if err != nil {
-		return err
+	return serial.Open(deviceName, mode)
+}
+
+// emit hands the event to the owner goroutine. It returns false if the owner is gone
+func (f *Feeder) emit(ctx context.Context, ev event) bool {
+	select {
+	case f.events <- ev:
+		return true
+	case <-ctx.Done():
+		return false
 	}
-	f.tty = tty
-	return nil
 }
 
 func (f *Feeder) read(ctx context.Context) {
-	defer f.Cancel()
-
 	seenStart := false
 
 	for {
-		select {
-		case <-ctx.Done():
+		buf, _, err := f.reader.ReadLine()
+		if err != nil {
+			f.emit(ctx, event{kind: evReadError, err: fmt.Errorf("error reading from printer: %w", err)})
 			return
-		default:
-			buf, _, err := f.reader.ReadLine()
-			if err != nil {
-				log.Errorf("Feeder: Error reading from printer: %v", err)
-				f.status = Error
-				return
+		}
+		bufStr := string(buf)
+
+		log.Debug("Feeder: READING: ", bufStr)
+		f.mu.Lock()
+		if parseTemperatures(bufStr, &f.temps) {
+			f.reported = true
+		}
+		f.mu.Unlock()
+		ev := event{kind: -1}
+		if sdEvent, ok := parseSD(bufStr); ok {
+			ev = sdEvent
+		} else if strings.HasPrefix(bufStr, "ok") && seenStart {
+			ev.kind = evAck
+		} else if strings.Contains(bufStr, "fsensor") {
+			ev.kind = evFSensor
+		} else if strings.Contains(bufStr, "MMU") {
+			status, ok := parseMMU(bufStr)
+			if !ok {
+				continue
 			}
-			bufStr := string(buf)
-
-			log.Debug("Feeder: READING: ", bufStr)
-			if strings.HasPrefix(bufStr, "ok") && seenStart {
-				f.printerAck <- true
-			} else if strings.Contains(bufStr, "fsensor") {
-				f.status = FSensorBusy
-			} else if strings.Contains(bufStr, "MMU") {
-				if strings.Contains(bufStr, "DISABLED") {
-					continue
-				}
-				f.status = MMUBusy
-			} else if strings.Contains(bufStr, "start") {
-				// When serial connection is established:
-				// Prusa MK3 returns "start"
-				// Prusa MK4 (Firmware Buddy) returns "start"
-				// We consider this event as "ready to print"
-				//
-				// If the first "start" is given - it says printer is ready
-				// If the second "start" is given - somebody reset the printer
-				if !seenStart {
-					time.Sleep(2 * time.Second)
-					seenStart = true
-					f.printerAck <- true
-				} else if seenStart && strings.HasSuffix(bufStr, "start") {
-					// This is most likely a reset button press on MK3
-					log.Warning("Feeder: Second 'start' sequence")
-					return
-				}
+			ev = event{kind: evMMU, status: status, message: bufStr}
+		} else if strings.Contains(bufStr, "start") {
+			// When serial connection is established:
+			// Prusa MK3 returns "start"
+			// Prusa MK4 (Firmware Buddy) returns "start"
+			// We consider this event as "ready to print"
+			//
+			// If the first "start" is given - it says printer is ready
+			// If the second "start" is given - somebody reset the printer
+			if !seenStart {
+				time.Sleep(startDelay)
+				seenStart = true
+				ev.kind = evStart
+			} else if strings.HasSuffix(bufStr, "start") {
+				// This is most likely a reset button press on MK3
+				log.Warning("Feeder: Second 'start' sequence")
+				f.emit(ctx, event{kind: evReset})
+				return
 			}
 		}
+		if ev.kind < 0 {
+			continue
+		}
+		if !f.emit(ctx, ev) {
+			return
+		}
 	}
 }
 
-func (f *Feeder) write(ctx context.Context, command string) error {
-	r := regexp.MustCompile(";.*")
-	rcmd := r.ReplaceAllString(command, "")
-	if rcmd == "" {
-		return nil
-	}
-
-	log.Debug("Feeder: WRITING: ", rcmd)
-	_, err := f.writer.Write([]byte(rcmd + "\n"))
+func (f *Feeder) write(command string) error {
+	log.Debug("Feeder: WRITING: ", command)
+	n, err := f.writer.Write([]byte(command + "\n"))
 	if err != nil {
 		return err
 	}
-	f.writer.Flush()
+	if err := f.writer.Flush(); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.stats.sent(time.Now(), n)
+	if slot, ok := parseTool(command); ok {
+		f.pendingSlot = slot
+	}
+	streaming := f.sdName == ""
+	f.mu.Unlock()
 
-	if s := f.progressRegexp.ReplaceAllString(rcmd, "$1"); s != rcmd {
+	// M73 in the file is only meaningful when the printer executes it right away
+	if s := f.progressRegexp.ReplaceAllString(command, "$1"); streaming && s != command {
 		// Ignore errors because not all gcodes have proper progress injected
-		f.progress, err = strconv.Atoi(s)
+		progress, err := strconv.Atoi(s)
 		if err != nil {
 			log.Debug("Feeder: Progress parsing error.", err, "Continue...")
+		} else {
+			f.setProgress(progress)
 		}
 	}
+	return nil
+}
 
-	select {
-	case <-f.printerAck:
-		break
-	case <-ctx.Done():
-		return errors.New("Context is Done")
+// nextCommand returns the next line of the file with comments stripped, skipping empty lines
+func nextCommand(scanner *bufio.Scanner) (string, bool) {
+	for scanner.Scan() {
+		if cmd := strings.TrimSpace(commentRegexp.ReplaceAllString(scanner.Text(), "")); cmd != "" {
+			return cmd, true
+		}
 	}
-	return nil
+	return "", false
 }
 
+// acked accounts for a command acknowledged by the printer
+func (f *Feeder) acked() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stats.acked(time.Now())
+	// Tool change is complete once the printer acknowledges it
+	if f.pendingSlot >= 0 {
+		f.mmu.Slot = f.pendingSlot
+		f.pendingSlot = -1
+	}
+	switch f.status {
+	case FSensorBusy, MMUBusy, MMUAttention:
+		// Printer resumed on its own after the filament sensor or MMU were resolved
+		f.mmu.Attention = false
+		if err := f.transitionLocked(Printing); err != nil {
+			log.Warning("Feeder: ", err)
+		}
+	}
+}
+
+func (f *Feeder) mmuEvent(ev event) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.mmu.Message = ev.message
+	if err := f.transitionLocked(ev.status); err != nil {
+		log.Debug("Feeder: ignoring MMU message: ", err)
+		return
+	}
+	f.mmu.Attention = ev.status == MMUAttention
+}
+
+// Feed sends the file to the printer and blocks until it is printed, cancelled or failed
 func (f *Feeder) Feed() error {
-	defer f.Cancel()
+	f.mu.Lock()
+	if f.running || f.closed {
+		f.mu.Unlock()
+		return ErrStopped
+	}
+	f.running = true
+	f.mu.Unlock()
+	defer close(f.done)
 
 	ctx, cancel := context.WithCancel(context.Background())
-	f.cancelFunc = cancel
-	f.reader = bufio.NewReader(f.tty)
-	f.writer = bufio.NewWriter(f.tty)
+	defer cancel()
+	defer func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		// SD print goes on without us unless it was cancelled
+		f.shutdownLocked((f.sdName == "" && !f.following) || f.cancelled)
+	}()
+
+	// Followed SD print has no file on our side
+	var file io.Reader = strings.NewReader("")
+	if !f.following {
+		gcode, err := os.Open(f.fileName)
+		if err != nil {
+			_ = f.setStatus(Error)
+			return err
+		}
+		defer gcode.Close()
+		file = gcode
+	}
 
 	go f.read(ctx)
 
@@ -231,44 +631,162 @@ func (f *Feeder) Feed() error {
 	// Issue a "firmware buddy" specific command to differentiate between mk3 and mk4
 	_, _ = f.writer.Write([]byte("M118 start\n"))
 	_ = f.writer.Flush()
-	// Be sure we receive initial reset from printer
-	<-f.printerAck
-	f.Start()
 
-	file, err := os.Open(f.fileName)
-	if err != nil {
-		f.status = Error
-		return err
+	return f.run(bufio.NewScanner(file))
+}
+
+// run is the owner goroutine loop. It is the only place which changes the status of a running feeder
+func (f *Feeder) run(scanner *bufio.Scanner) error {
+	next := func() (string, bool) { return nextCommand(scanner) }
+	var upload *sdUpload
+	if f.sdName != "" || f.following {
+		upload = &sdUpload{name: f.sdName, scanner: scanner}
+		if f.following {
+			upload.step = sdStepStarted
+		}
+		next = upload.next
+	}
+	var preamble []string
+	if f.tempInterval > 0 {
+		// Temperatures are reported by the printer on its own, so the read goroutine can follow them
+		preamble = append(preamble, fmt.Sprintf("M155 S%d", f.tempInterval))
+	}
+	if msg := f.message; msg != "" {
+		preamble = append(preamble, "M117 "+msg)
 	}
-	defer file.Close()
+	file := next
+	next = func() (string, bool) {
+		if len(preamble) == 0 {
+			return file()
+		}
+		cmd := preamble[0]
+		preamble = preamble[1:]
+		return cmd, true
+	}
+	// Printer is ready for the next command
+	ready := false
+	// SD print is started, from now on we only watch it
+	monitoring := false
+	var poll <-chan time.Time
+	connect := time.NewTimer(connectTimeout)
+	defer connect.Stop()
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		for f.status == ManuallyPaused {
-			select {
-			case <-ctx.Done():
-				return errors.New("Context is Done")
-			default:
-				time.Sleep(5 * time.Second)
-				log.Info("Feeder: paused manually")
+	for {
+		if s := f.Status(); ready && !monitoring && (s == Printing || s == Uploading) {
+			cmd, ok := next()
+			if !ok {
+				if err := scanner.Err(); err != nil {
+					_ = f.setStatus(Error)
+					return err
+				}
+				if upload == nil {
+					return f.setStatus(Finished)
+				}
+				monitoring = true
+				ticker := time.NewTicker(sdPollingInterval)
+				defer ticker.Stop()
+				poll = ticker.C
+				continue
+			}
+			if err := f.write(cmd); err != nil {
+				_ = f.setStatus(Error)
+				return err
+			}
+			if upload != nil && upload.started() {
+				if err := f.setStatus(Printing); err != nil {
+					log.Warning("Feeder: ", err)
+				}
 			}
+			ready = false
 		}
-		f.status = Printing
-		err = f.write(ctx, line)
-		if err != nil {
-			f.status = Error
-			return err
+
+		select {
+		case ev := <-f.events:
+			switch ev.kind {
+			case evStart:
+				// Be sure we receive initial reset from printer before sending anything
+				connect.Stop()
+				ready = true
+				next := Printing
+				if upload != nil && !upload.started() {
+					next = Uploading
+				}
+				if err := f.setStatus(next); err != nil {
+					log.Warning("Feeder: ", err)
+				}
+			case evAck:
+				ready = true
+				f.acked()
+			case evFSensor:
+				if err := f.setStatus(FSensorBusy); err != nil {
+					log.Debug("Feeder: ignoring filament sensor message: ", err)
+				}
+			case evMMU:
+				f.mmuEvent(ev)
+			case evSDProgress:
+				if monitoring {
+					f.setProgress(ev.progress)
+				}
+			case evSDDone:
+				if monitoring {
+					f.setProgress(100)
+					return f.setStatus(Finished)
+				}
+			case evReset:
+				_ = f.setStatus(Error)
+				return errors.New("printer was reset during the print")
+			case evReadError:
+				if f.Status() == Connecting {
+					_ = f.setStatus(ConnectionFail)
+				} else {
+					_ = f.setStatus(Error)
+				}
+				return ev.err
+			}
+		case <-connect.C:
+			if f.Status() == Connecting {
+				_ = f.setStatus(ConnectionFail)
+				return fmt.Errorf("printer did not greet us in %s", connectTimeout)
+			}
+		case <-poll:
+			if err := f.write("M27"); err != nil {
+				_ = f.setStatus(Error)
+				return err
+			}
+		case cmd := <-f.commands:
+			err := f.setStatus(cmd.status)
+			if err == nil && upload != nil {
+				err = f.sdRequest(cmd.status, upload)
+			}
+			cmd.reply <- err
+			if err == nil && cmd.status == Finished {
+				log.Info("Feeder: cancelled")
+				return nil
+			}
+			if err == nil && cmd.status == Error {
+				return errors.New("emergency stop")
+			}
 		}
 	}
-	f.status = Finished
-	return nil
-}
-
-func (f *Feeder) Pause() {
-	f.status = ManuallyPaused
 }
 
-func (f *Feeder) Start() {
-	f.status = Printing
+// sdRequest tells the printer about the requested status while it prints from the SD card
+func (f *Feeder) sdRequest(status Status, upload *sdUpload) error {
+	if status == Finished {
+		f.mu.Lock()
+		f.cancelled = true
+		f.mu.Unlock()
+		if upload.uploading() {
+			// Close the half written file
+			return f.write("M29 " + upload.name)
+		}
+	}
+	// The printer takes M25, M24 and M524 as soon as the file is printing, even before we watch it
+	if !upload.started() {
+		return nil
+	}
+	if cmd := sdCommand(status); cmd != "" {
+		return f.write(cmd)
+	}
+	return nil
 }
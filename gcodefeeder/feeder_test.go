@@ -0,0 +1,432 @@
+package gcodefeeder
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testTimeout = 5 * time.Second
+
+func TestMain(m *testing.M) {
+	startDelay = 0
+	os.Exit(m.Run())
+}
+
+// fakePort is the serial port of a fake printer. Lines written by the feeder arrive on sent, say answers them
+type fakePort struct {
+	in      *io.PipeReader
+	printer *io.PipeWriter
+	out     *io.PipeWriter
+	sent    chan string
+}
+
+func newFakePort() *fakePort {
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	p := &fakePort{in: inR, printer: inW, out: outW, sent: make(chan string, 1000)}
+	go func() {
+		scanner := bufio.NewScanner(outR)
+		for scanner.Scan() {
+			if line := scanner.Text(); line != "" {
+				p.sent <- line
+			}
+		}
+		close(p.sent)
+	}()
+	return p
+}
+
+func (p *fakePort) Read(b []byte) (int, error)  { return p.in.Read(b) }
+func (p *fakePort) Write(b []byte) (int, error) { return p.out.Write(b) }
+
+func (p *fakePort) Close() error {
+	p.in.Close()
+	p.out.Close()
+	return nil
+}
+
+// say sends a line from the printer. Lines after the feeder closed the port are dropped
+func (p *fakePort) say(line string) {
+	_, _ = p.printer.Write([]byte(line + "\n"))
+}
+
+// expect waits for the next line from the feeder
+func (p *fakePort) expect(t *testing.T, want string) {
+	t.Helper()
+	select {
+	case got, ok := <-p.sent:
+		if !ok {
+			t.Fatalf("port is closed, want %q", want)
+		}
+		if got != want {
+			t.Fatalf("feeder sent %q, want %q", got, want)
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("feeder did not send %q", want)
+	}
+}
+
+// silent checks the feeder sends nothing for a while
+func (p *fakePort) silent(t *testing.T) {
+	t.Helper()
+	select {
+	case got, ok := <-p.sent:
+		if ok {
+			t.Fatalf("feeder sent %q, want nothing", got)
+		}
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// handshake greets the feeder, which sends nothing but the file afterwards
+func (p *fakePort) handshake(t *testing.T) {
+	t.Helper()
+	p.expect(t, "M118 start")
+	p.say("start")
+}
+
+func writeGcode(t *testing.T, lines ...string) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "job.gcode")
+	if err := os.WriteFile(name, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+// feed runs Feed in the background, its error arrives on the channel
+func feed(f *Feeder) <-chan error {
+	done := make(chan error, 1)
+	go func() { done <- f.Feed() }()
+	return done
+}
+
+func wait(t *testing.T, done <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(testTimeout):
+		t.Fatal("Feed did not return")
+	}
+	return nil
+}
+
+func waitStatus(t *testing.T, f *Feeder, want Status) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for f.Status() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("status is %s, want %s", f.Status(), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		from, to Status
+		want     bool
+	}{
+		{Connecting, Printing, true},
+		{Connecting, Uploading, true},
+		{Connecting, ConnectionFail, true},
+		{Connecting, ManuallyPaused, false},
+		{Connecting, FSensorBusy, false},
+		{Ready, Printing, true},
+		{Ready, ManuallyPaused, false},
+		{Uploading, Printing, true},
+		{Uploading, ManuallyPaused, false},
+		{Printing, FSensorBusy, true},
+		{Printing, Connecting, false},
+		{Printing, Uploading, false},
+		{FSensorBusy, Printing, true},
+		{FSensorBusy, Uploading, false},
+		// A filament sensor message must not take over a pause somebody asked for
+		{ManuallyPaused, FSensorBusy, false},
+		{ManuallyPaused, MMUBusy, false},
+		{MMUAttention, FSensorBusy, false},
+		{MMUAttention, MMUBusy, true},
+		{Finished, Printing, false},
+		{Error, Printing, false},
+		{ConnectionFail, Printing, false},
+	}
+	for _, tt := range tests {
+		if got := tt.from.CanTransition(tt.to); got != tt.want {
+			t.Errorf("%s -> %s: got %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestTerminal(t *testing.T) {
+	for _, s := range []Status{Finished, Error, ConnectionFail, Cancelled} {
+		if !s.Terminal() {
+			t.Errorf("%s is not terminal", s)
+		}
+	}
+	for _, s := range []Status{Connecting, Ready, Uploading, Printing, ManuallyPaused, FSensorBusy, MMUBusy, MMUAttention} {
+		if s.Terminal() {
+			t.Errorf("%s is terminal", s)
+		}
+	}
+}
+
+func TestTransitionError(t *testing.T) {
+	f := newFeeder(newFakePort(), "")
+	f.status = Finished
+	err := f.setStatus(Printing)
+	var transitionErr *TransitionError
+	if !errors.As(err, &transitionErr) || transitionErr.From != Finished || transitionErr.To != Printing {
+		t.Fatalf("got %v, want Finished -> Printing TransitionError", err)
+	}
+	if f.Status() != Finished {
+		t.Fatalf("status is %s, want Finished", f.Status())
+	}
+}
+
+func TestFeedPrintsFile(t *testing.T) {
+	port := newFakePort()
+	f := newFeeder(port, writeGcode(t, "G28 ; home", "", "M73 P50", "G1 X10"))
+	if f.Status() != Connecting {
+		t.Fatalf("new feeder is %s, want Connecting", f.Status())
+	}
+	done := feed(f)
+
+	port.handshake(t)
+	for _, cmd := range []string{"G28", "M73 P50", "G1 X10"} {
+		port.expect(t, cmd)
+		waitStatus(t, f, Printing)
+		port.say("ok")
+	}
+	if err := wait(t, done); err != nil {
+		t.Fatal(err)
+	}
+	if f.Status() != Finished || f.Progress() != 50 {
+		t.Fatalf("status %s, progress %d, want Finished, 50", f.Status(), f.Progress())
+	}
+	// Heaters are turned off once the file is printed
+	for _, cmd := range []string{"M104 S0", "M140 S0", "M107"} {
+		port.expect(t, cmd)
+	}
+	if s := f.Stats(); s.Commands != 3 {
+		t.Fatalf("%d commands acknowledged, want 3", s.Commands)
+	}
+}
+
+func TestReportTemperatures(t *testing.T) {
+	port := newFakePort()
+	f := newFeeder(port, writeGcode(t, "G28"))
+	f.ReportTemperatures(5)
+	done := feed(f)
+
+	port.handshake(t)
+	port.expect(t, "M155 S5")
+	port.say("ok")
+	port.expect(t, "G28")
+	port.say("T:210.0 /215.0 B:60.0 /60.0 @:44 B@:0")
+	port.say("ok")
+	if err := wait(t, done); err != nil {
+		t.Fatal(err)
+	}
+	if temps, ok := f.Temperatures(); !ok || temps.Hotend != 210 || temps.HotendTarget != 215 {
+		t.Fatalf("temperatures are %+v, %v", temps, ok)
+	}
+}
+
+func TestFilamentSensorHoldsTheFile(t *testing.T) {
+	port := newFakePort()
+	f := newFeeder(port, writeGcode(t, "G1 X1", "G1 X2"))
+	done := feed(f)
+	port.handshake(t)
+
+	port.expect(t, "G1 X1")
+	port.say("fsensor: filament runout")
+	waitStatus(t, f, FSensorBusy)
+	// Nothing is sent until the printer acknowledges the command it paused on
+	port.silent(t)
+	if f.Status() != FSensorBusy {
+		t.Fatalf("status is %s, want FSensorBusy", f.Status())
+	}
+
+	port.say("ok")
+	port.expect(t, "G1 X2")
+	waitStatus(t, f, Printing)
+	port.say("ok")
+	if err := wait(t, done); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestManualPauseIsNotOverwritten(t *testing.T) {
+	port := newFakePort()
+	f := newFeeder(port, writeGcode(t, "G1 X1", "G1 X2"))
+	done := feed(f)
+	port.handshake(t)
+
+	port.expect(t, "G1 X1")
+	if err := f.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	port.say("fsensor: filament runout")
+	port.say("ok")
+	port.silent(t)
+	if f.Status() != ManuallyPaused {
+		t.Fatalf("status is %s, want ManuallyPaused", f.Status())
+	}
+
+	if err := f.Start(); err != nil {
+		t.Fatal(err)
+	}
+	port.expect(t, "G1 X2")
+	port.say("ok")
+	if err := wait(t, done); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	port := newFakePort()
+	f := newFeeder(port, writeGcode(t, "G1 X1", "G1 X2"))
+	done := feed(f)
+	port.handshake(t)
+
+	port.expect(t, "G1 X1")
+	if err := f.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+	if err := wait(t, done); err != nil {
+		t.Fatal(err)
+	}
+	if f.Status() != Finished {
+		t.Fatalf("status is %s, want Finished", f.Status())
+	}
+	port.expect(t, "M104 S0")
+	// Feeder is stopped, requests can't change anything anymore
+	if err := f.Start(); !errors.Is(err, ErrStopped) {
+		t.Fatalf("Start after Cancel: got %v, want ErrStopped", err)
+	}
+}
+
+func TestConnectionFail(t *testing.T) {
+	defer func(timeout time.Duration) { connectTimeout = timeout }(connectTimeout)
+	connectTimeout = 50 * time.Millisecond
+
+	port := newFakePort()
+	f := newFeeder(port, writeGcode(t, "G1 X1"))
+	done := feed(f)
+	port.expect(t, "M118 start")
+	if err := wait(t, done); err == nil {
+		t.Fatal("Feed succeeded without the printer")
+	}
+	if f.Status() != ConnectionFail {
+		t.Fatalf("status is %s, want ConnectionFail", f.Status())
+	}
+}
+
+func TestPortClosedWhileConnecting(t *testing.T) {
+	port := newFakePort()
+	f := newFeeder(port, writeGcode(t, "G1 X1"))
+	done := feed(f)
+	port.expect(t, "M118 start")
+	port.printer.Close()
+	if err := wait(t, done); err == nil {
+		t.Fatal("Feed succeeded without the printer")
+	}
+	if f.Status() != ConnectionFail {
+		t.Fatalf("status is %s, want ConnectionFail", f.Status())
+	}
+}
+
+func TestResetFailsThePrint(t *testing.T) {
+	port := newFakePort()
+	f := newFeeder(port, writeGcode(t, "G1 X1", "G1 X2"))
+	done := feed(f)
+	port.handshake(t)
+
+	port.expect(t, "G1 X1")
+	port.say("start")
+	if err := wait(t, done); err == nil {
+		t.Fatal("Feed succeeded after the reset")
+	}
+	if f.Status() != Error {
+		t.Fatalf("status is %s, want Error", f.Status())
+	}
+}
+
+// TestConcurrentRequests is meant for -race: requests of other goroutines run alongside the read loop
+func TestConcurrentRequests(t *testing.T) {
+	lines := make([]string, 500)
+	for i := range lines {
+		lines[i] = "G1 X1"
+	}
+	port := newFakePort()
+	f := newFeeder(port, writeGcode(t, lines...))
+	done := feed(f)
+
+	// The printer acknowledges everything and reports temperatures now and then
+	go func() {
+		n := 0
+		for line := range port.sent {
+			if line == "M118 start" {
+				port.say("start")
+				continue
+			}
+			n++
+			if n%10 == 0 {
+				port.say("T:210.0 /210.0 B:60.0 /60.0 @:44 B@:0")
+			}
+			port.say("ok")
+		}
+	}()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				var err error
+				if i%2 == 0 {
+					err = f.Pause()
+				} else {
+					err = f.Start()
+				}
+				var transitionErr *TransitionError
+				if err != nil && !errors.As(err, &transitionErr) && !errors.Is(err, ErrStopped) {
+					t.Errorf("unexpected error: %v", err)
+				}
+				_ = f.Status()
+				_ = f.Progress()
+				_ = f.Stats()
+				_ = f.MMU()
+				_, _ = f.Temperatures()
+			}
+		}(i)
+	}
+	time.Sleep(200 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	if err := f.Start(); err != nil && !errors.Is(err, ErrStopped) {
+		t.Fatal(err)
+	}
+	if err := wait(t, done); err != nil {
+		t.Fatal(err)
+	}
+	if f.Status() != Finished {
+		t.Fatalf("status is %s, want Finished", f.Status())
+	}
+}
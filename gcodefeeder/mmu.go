@@ -0,0 +1,76 @@
+package gcodefeeder
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// MMUState describes the multi material unit as seen by the feeder
+type MMUState struct {
+	// Slot is the active filament slot, -1 if unknown
+	Slot int `json:"slot"`
+	// Attention is set when the MMU stopped and waits for the operator
+	Attention bool `json:"attention"`
+	// Message is the last MMU message received from the printer
+	Message string `json:"message,omitempty"`
+}
+
+var toolRegexp = regexp.MustCompile(`^T([0-9]+)\b`)
+
+// mmuAttentionMessages are substrings of MMU2/MMU3 messages which mean the MMU gave up and needs a human.
+// "failed" covers "load failed" and "unload failed"
+var mmuAttentionMessages = []string{
+	"needs user attention",
+	"failed",
+	"error",
+	"not responding",
+	"didnt trigger",
+	"didn't trigger",
+	"stuck",
+	"jam",
+}
+
+// mmuRecoveringMessages are substrings of MMU messages which mean the MMU recovers on its own
+var mmuRecoveringMessages = []string{
+	"retry",
+	"retrying",
+	"starts responding",
+	"recovered",
+}
+
+// parseMMU classifies an MMU line from the printer. ok is false for lines which do not change the feeder status
+func parseMMU(line string) (status Status, ok bool) {
+	lower := strings.ToLower(line)
+	if strings.Contains(lower, "disabled") || strings.Contains(lower, "enabled") {
+		return 0, false
+	}
+	// MMU3 firmware traces the printer<->MMU protocol, e.g. "MMU2:>T0" and "MMU2:<T0 A"
+	if strings.Contains(line, "MMU2:>") || strings.Contains(line, "MMU2:<") {
+		return 0, false
+	}
+	for _, m := range mmuRecoveringMessages {
+		if strings.Contains(lower, m) {
+			return MMUBusy, true
+		}
+	}
+	for _, m := range mmuAttentionMessages {
+		if strings.Contains(lower, m) {
+			return MMUAttention, true
+		}
+	}
+	return MMUBusy, true
+}
+
+// parseTool returns the slot selected by a Tn command
+func parseTool(command string) (int, bool) {
+	m := toolRegexp.FindStringSubmatch(command)
+	if m == nil {
+		return 0, false
+	}
+	slot, err := strconv.Atoi(m[1])
+	if err != nil {
+		return 0, false
+	}
+	return slot, true
+}
@@ -0,0 +1,29 @@
+package gcodefeeder
+
+import "testing"
+
+func TestParseMMU(t *testing.T) {
+	tests := []struct {
+		line   string
+		status Status
+		ok     bool
+	}{
+		{"MMU2:Load failed", MMUAttention, true},
+		{"MMU2:Unload failed", MMUAttention, true},
+		{"MMU needs user attention", MMUAttention, true},
+		{"MMU2:FINDA didn't trigger", MMUAttention, true},
+		{"MMU2:Filament jam", MMUAttention, true},
+		{"MMU2:Load failed, retrying", MMUBusy, true},
+		{"MMU starts responding", MMUBusy, true},
+		{"MMU2:Feeding to FINDA", MMUBusy, true},
+		{"MMU2:>T0", 0, false},
+		{"MMU2:<T0 A", 0, false},
+		{"MMU mode disabled", 0, false},
+	}
+	for _, tt := range tests {
+		status, ok := parseMMU(tt.line)
+		if ok != tt.ok || ok && status != tt.status {
+			t.Errorf("%q: got %s, %v, want %s, %v", tt.line, status, ok, tt.status, tt.ok)
+		}
+	}
+}
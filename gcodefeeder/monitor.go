@@ -0,0 +1,201 @@
+package gcodefeeder
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// monitorPollingInterval is how often the monitor asks the printer for the SD print status
+const monitorPollingInterval = 5 * time.Second
+
+// monitorGracePeriod is how long the monitor waits for the first answer before it assumes the printer is idle
+const monitorGracePeriod = 3 * monitorPollingInterval
+
+// LocalPrint describes a print started on the printer itself, from its SD card or USB drive
+type LocalPrint struct {
+	Active   bool   `json:"active"`
+	Paused   bool   `json:"paused"`
+	Progress int    `json:"progress"`
+	File     string `json:"file,omitempty"`
+}
+
+// Monitor watches the printer without sending it any job.
+// It polls M27 and listens to host action messages to detect local prints
+type Monitor struct {
+	tty    io.ReadWriteCloser
+	reader *bufio.Reader
+	writer *bufio.Writer
+	cancel context.CancelFunc
+	opened time.Time
+
+	mu       sync.Mutex
+	print    LocalPrint
+	answered bool
+	err      error
+}
+
+func NewMonitor(deviceName string) (*Monitor, error) {
+	tty, err := Connect(deviceName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", deviceName, err)
+	}
+	return NewMonitorWithPort(tty), nil
+}
+
+// NewMonitorWithPort starts watching an already opened transport
+func NewMonitorWithPort(port io.ReadWriteCloser) *Monitor {
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &Monitor{
+		tty:    port,
+		reader: bufio.NewReader(port),
+		writer: bufio.NewWriter(port),
+		cancel: cancel,
+		opened: time.Now(),
+	}
+	go m.read()
+	go m.poll(ctx)
+	return m
+}
+
+// Close stops watching and releases the port
+func (m *Monitor) Close() error {
+	m.cancel()
+	return m.tty.Close()
+}
+
+// EmergencyStop writes M112 straight to the port
+func (m *Monitor) EmergencyStop() error {
+	log.Warning("Monitor: emergency stop")
+	_, err := m.tty.Write([]byte("\nM112\n"))
+	return err
+}
+
+// LocalPrint returns the last known local print
+func (m *Monitor) LocalPrint() LocalPrint {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.print
+}
+
+// Ready reports whether the printer answered already or stayed silent long enough to be considered idle
+func (m *Monitor) Ready() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.answered || time.Since(m.opened) > monitorGracePeriod
+}
+
+// Err returns the error which stopped the monitor
+func (m *Monitor) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+func (m *Monitor) poll(ctx context.Context) {
+	ticker := time.NewTicker(monitorPollingInterval)
+	defer ticker.Stop()
+	for {
+		// M27 C reports the file name on Marlin, others just ignore the parameter
+		for _, cmd := range []string{"M27", "M27 C"} {
+			if _, err := m.writer.WriteString(cmd + "\n"); err != nil {
+				m.fail(err)
+				return
+			}
+		}
+		if err := m.writer.Flush(); err != nil {
+			m.fail(err)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *Monitor) fail(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err == nil {
+		m.err = err
+	}
+}
+
+func (m *Monitor) read() {
+	for {
+		buf, _, err := m.reader.ReadLine()
+		if err != nil {
+			m.fail(fmt.Errorf("error reading from printer: %w", err))
+			return
+		}
+		line := string(buf)
+		log.Debug("Monitor: READING: ", line)
+		m.handle(line)
+	}
+}
+
+func (m *Monitor) handle(line string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if ev, ok := parseSD(line); ok {
+		m.answered = true
+		switch ev.kind {
+		case evSDProgress:
+			m.print.Active = true
+			m.print.Paused = false
+			m.print.Progress = ev.progress
+		case evSDDone:
+			m.print = LocalPrint{}
+		}
+		return
+	}
+	if strings.Contains(line, "Not SD printing") {
+		m.answered = true
+		// Paused SD print is not "printing" for the firmware but the printer is still busy
+		if !m.print.Paused {
+			m.print = LocalPrint{}
+		}
+		return
+	}
+	if strings.HasPrefix(line, "Current file:") {
+		m.print.File = strings.TrimSpace(strings.TrimPrefix(line, "Current file:"))
+		return
+	}
+
+	action, ok := parseHostAction(line)
+	if !ok {
+		return
+	}
+	switch {
+	case action == "print_start", action == "start":
+		m.print.Active = true
+	case action == "paused", action == "pause":
+		if m.print.Active {
+			m.print.Paused = true
+		}
+	case action == "resumed", action == "resume":
+		m.print.Paused = false
+	case action == "print_end", action == "cancel", strings.HasPrefix(action, "notification Done printing"):
+		m.print = LocalPrint{}
+	}
+}
+
+// parseHostAction extracts the action from "//action:<action>" messages
+func parseHostAction(line string) (string, bool) {
+	line = strings.TrimSpace(line)
+	for _, prefix := range []string{"//action:", "// action:"} {
+		if strings.HasPrefix(line, prefix) {
+			return strings.TrimSpace(strings.TrimPrefix(line, prefix)), true
+		}
+	}
+	return "", false
+}
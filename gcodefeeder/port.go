@@ -0,0 +1,145 @@
+package gcodefeeder
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// errReleased is returned by a lease which was closed
+var errReleased = errors.New("port is released")
+
+// Port keeps the serial port of the printer open for the feeders, monitors and prompts which use it one by one.
+// Boards which reset when the port is opened, e.g. MK3, would otherwise stop their SD prints on every new user
+type Port struct {
+	device string
+	open   func() (io.ReadWriteCloser, error)
+
+	mu   sync.Mutex
+	conn *connection
+}
+
+// connection is the opened port. A single goroutine reads it, so a user which is done doesn't take the next reply
+type connection struct {
+	tty  io.ReadWriteCloser
+	data chan []byte
+	// closed is closed by Port.Close
+	closed chan struct{}
+	// dead is closed with err set once the port can't be read
+	dead chan struct{}
+	err  error
+}
+
+// NewPort opens deviceName when it is leased for the first time
+func NewPort(deviceName string) *Port {
+	return newPort(deviceName, func() (io.ReadWriteCloser, error) { return Connect(deviceName) })
+}
+
+func newPort(deviceName string, open func() (io.ReadWriteCloser, error)) *Port {
+	return &Port{device: deviceName, open: open}
+}
+
+// Lease hands the port to a single user until the lease is closed. The port is opened again if it failed
+func (p *Port) Lease() (io.ReadWriteCloser, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn != nil {
+		select {
+		case <-p.conn.dead:
+			p.conn.tty.Close()
+			p.conn = nil
+		default:
+		}
+	}
+	if p.conn == nil {
+		tty, err := p.open()
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to %s: %w", p.device, err)
+		}
+		p.conn = &connection{tty: tty, data: make(chan []byte), closed: make(chan struct{}), dead: make(chan struct{})}
+		go p.conn.read()
+	}
+	return &lease{conn: p.conn, released: make(chan struct{})}, nil
+}
+
+// Close closes the port, the open leases fail. The next Lease opens it again
+func (p *Port) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil {
+		return nil
+	}
+	close(p.conn.closed)
+	err := p.conn.tty.Close()
+	p.conn = nil
+	return err
+}
+
+func (c *connection) read() {
+	for {
+		buf := make([]byte, 1024)
+		n, err := c.tty.Read(buf)
+		if n > 0 {
+			select {
+			case c.data <- buf[:n]:
+			case <-c.closed:
+				return
+			}
+		}
+		if err != nil {
+			c.err = err
+			close(c.dead)
+			return
+		}
+	}
+}
+
+// lease is the port as a single user sees it. Close releases it without closing the port
+type lease struct {
+	conn     *connection
+	released chan struct{}
+	once     sync.Once
+	// rest is what the last Read did not fit into its buffer
+	rest []byte
+}
+
+func (l *lease) Read(b []byte) (int, error) {
+	if len(l.rest) == 0 {
+		select {
+		case <-l.released:
+			return 0, errReleased
+		default:
+		}
+		select {
+		case l.rest = <-l.conn.data:
+		case <-l.conn.dead:
+			return 0, l.conn.err
+		case <-l.released:
+			return 0, errReleased
+		case <-l.conn.closed:
+			return 0, errReleased
+		}
+	}
+	n := copy(b, l.rest)
+	l.rest = l.rest[n:]
+	return n, nil
+}
+
+func (l *lease) Write(b []byte) (int, error) {
+	select {
+	case <-l.released:
+		return 0, errReleased
+	case <-l.conn.closed:
+		return 0, errReleased
+	case <-l.conn.dead:
+		return 0, l.conn.err
+	default:
+	}
+	return l.conn.tty.Write(b)
+}
+
+func (l *lease) Close() error {
+	l.once.Do(func() { close(l.released) })
+	return nil
+}
@@ -0,0 +1,143 @@
+package gcodefeeder
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// fakeDevice is the serial port as the port sees it. The printer writes to printer
+type fakeDevice struct {
+	*io.PipeReader
+	printer *io.PipeWriter
+}
+
+func (d *fakeDevice) Write(b []byte) (int, error) { return len(b), nil }
+
+func newFakeDevice() *fakeDevice {
+	r, w := io.Pipe()
+	return &fakeDevice{PipeReader: r, printer: w}
+}
+
+// openCounter opens the devices one by one and counts the opens
+type openCounter struct {
+	devices chan *fakeDevice
+	opened  int
+}
+
+func (o *openCounter) open() (io.ReadWriteCloser, error) {
+	o.opened++
+	return <-o.devices, nil
+}
+
+func readLine(t *testing.T, r io.Reader) string {
+	t.Helper()
+	line := make(chan string, 1)
+	go func() {
+		buf, _, _ := bufio.NewReader(r).ReadLine()
+		line <- string(buf)
+	}()
+	select {
+	case l := <-line:
+		return l
+	case <-time.After(testTimeout):
+		t.Fatal("nothing was read")
+		return ""
+	}
+}
+
+func TestPortIsOpenedOnce(t *testing.T) {
+	device := newFakeDevice()
+	opener := &openCounter{devices: make(chan *fakeDevice, 1)}
+	opener.devices <- device
+	port := newPort("fake", opener.open)
+	defer port.Close()
+
+	first, err := port.Lease()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _, _ = device.printer.Write([]byte("ok\n")) }()
+	if line := readLine(t, first); line != "ok" {
+		t.Fatalf("first lease read %q", line)
+	}
+	first.Close()
+	if _, err := first.Read(make([]byte, 1)); !errors.Is(err, errReleased) {
+		t.Fatalf("released lease read: %v", err)
+	}
+
+	// What the printer says after the first lease is gone goes to the next one
+	go func() { _, _ = device.printer.Write([]byte("Not SD printing\n")) }()
+	second, err := port.Lease()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	if line := readLine(t, second); line != "Not SD printing" {
+		t.Fatalf("second lease read %q", line)
+	}
+	if opener.opened != 1 {
+		t.Fatalf("port was opened %d times, want once", opener.opened)
+	}
+}
+
+func TestReleaseUnblocksRead(t *testing.T) {
+	opener := &openCounter{devices: make(chan *fakeDevice, 1)}
+	opener.devices <- newFakeDevice()
+	port := newPort("fake", opener.open)
+	defer port.Close()
+
+	tty, err := port.Lease()
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := make(chan error, 1)
+	go func() {
+		_, err := tty.Read(make([]byte, 1))
+		read <- err
+	}()
+	tty.Close()
+	select {
+	case err := <-read:
+		if !errors.Is(err, errReleased) {
+			t.Fatalf("read returned %v", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("read is still blocked")
+	}
+}
+
+func TestPortIsOpenedAgainAfterFailure(t *testing.T) {
+	broken, fresh := newFakeDevice(), newFakeDevice()
+	opener := &openCounter{devices: make(chan *fakeDevice, 2)}
+	opener.devices <- broken
+	opener.devices <- fresh
+	port := newPort("fake", opener.open)
+	defer port.Close()
+
+	tty, err := port.Lease()
+	if err != nil {
+		t.Fatal(err)
+	}
+	failure := errors.New("unplugged")
+	broken.printer.CloseWithError(failure)
+	if _, err := tty.Read(make([]byte, 1)); !errors.Is(err, failure) {
+		t.Fatalf("read returned %v, want the failure of the port", err)
+	}
+	tty.Close()
+
+	tty, err = port.Lease()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tty.Close()
+	go func() { _, _ = fresh.printer.Write([]byte("start\n")) }()
+	if line := readLine(t, tty); line != "start" {
+		t.Fatalf("read %q from the port opened again", line)
+	}
+	if opener.opened != 2 {
+		t.Fatalf("port was opened %d times, want twice", opener.opened)
+	}
+}
@@ -0,0 +1,146 @@
+package gcodefeeder
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// handshakeTimeout is how long we wait for the printer to greet us after the port is opened
+const handshakeTimeout = 15 * time.Second
+
+// clickMargin separates a click from M0 running out of time
+const clickMargin = 1 * time.Second
+
+// Prompt asks the operator to click the knob of the printer
+type Prompt struct {
+	// Message is shown on the LCD with M117 and M0
+	Message string
+	// Interval is the length of a single "M0 S<seconds>" wait. Reminders are sent between the waits
+	Interval time.Duration
+	// Reminder returns extra commands (e.g. M300 beeps) sent after M117 before every wait.
+	// waited is the time since the prompt was shown. It may be nil
+	Reminder func(waited time.Duration) []string
+}
+
+// WaitForClick shows the prompt on the printer and blocks until the knob is clicked or ctx is done.
+// M0 is issued with a timeout, so the printer leaves it on its own at most Interval after ctx is done.
+// It returns nil on click and ctx.Err() otherwise. The caller owns the port
+func WaitForClick(ctx context.Context, port io.ReadWriter, p Prompt) error {
+	lines := make(chan string)
+	readErr := make(chan error, 1)
+	go func() {
+		reader := bufio.NewReader(port)
+		for {
+			buf, _, err := reader.ReadLine()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			log.Debug("Prompt: READING: ", string(buf))
+			select {
+			case lines <- string(buf):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	writer := bufio.NewWriter(port)
+	send := func(cmds ...string) error {
+		for _, cmd := range cmds {
+			log.Debug("Prompt: WRITING: ", cmd)
+			if _, err := writer.WriteString(cmd + "\n"); err != nil {
+				return err
+			}
+		}
+		return writer.Flush()
+	}
+	// wait blocks until a line matching done arrives
+	wait := func(ctx context.Context, done func(string) bool) error {
+		for {
+			select {
+			case line := <-lines:
+				if done(line) {
+					return nil
+				}
+			case err := <-readErr:
+				return fmt.Errorf("error reading from printer: %w", err)
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+
+	// Same handshake as Feed: MK3 says "start" after the reset, MK4 answers to M118
+	if err := send("", "M118 start"); err != nil {
+		return err
+	}
+	hsCtx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+	err := wait(hsCtx, func(line string) bool { return strings.Contains(line, "start") })
+	cancel()
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return errors.New("printer did not greet us")
+	}
+	// Let the printer finish booting and drop what it said meanwhile, the ok of M118 included.
+	// From now on every ok acknowledges the command we sent last, so a stale one is never taken for a click
+	settle := time.NewTimer(startDelay)
+	defer settle.Stop()
+	for settled := false; !settled; {
+		select {
+		case line := <-lines:
+			log.Debug("Prompt: ignoring ", line)
+		case err := <-readErr:
+			return fmt.Errorf("error reading from printer: %w", err)
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-settle.C:
+			settled = true
+		}
+	}
+	// Don't leave the prompt on the LCD. Best effort: the printer may still be in M0
+	defer func() { _ = send("M117") }()
+
+	isOK := func(line string) bool { return strings.HasPrefix(line, "ok") }
+	shown := time.Now()
+	for {
+		cmds := []string{"M117 " + p.Message}
+		if p.Reminder != nil {
+			cmds = append(cmds, p.Reminder(time.Since(shown))...)
+		}
+		for _, cmd := range cmds {
+			if err := send(cmd); err != nil {
+				return err
+			}
+			if err := wait(ctx, isOK); err != nil {
+				return err
+			}
+		}
+
+		seconds := int(p.Interval.Seconds())
+		if err := send(fmt.Sprintf("M0 S%d %s", seconds, p.Message)); err != nil {
+			return err
+		}
+		started := time.Now()
+		// The ok of M0 itself comes once it is over. Firmwares with host prompt support report the click as prompt_end
+		err := wait(ctx, func(line string) bool {
+			return isOK(line) || strings.Contains(line, "action:prompt_end")
+		})
+		if err != nil {
+			return err
+		}
+		if time.Since(started) < p.Interval-clickMargin {
+			log.Info("Prompt: knob was clicked")
+			return nil
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package gcodefeeder
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+var testPrompt = Prompt{Message: "Press the knob", Interval: time.Minute}
+
+// waitForClick runs WaitForClick in the background, its error arrives on the channel
+func waitForClick(t *testing.T, ctx context.Context, port *fakePort) <-chan error {
+	// Long enough to drop the ok of M118 before the prompt is shown
+	delay := startDelay
+	startDelay = 50 * time.Millisecond
+	t.Cleanup(func() { startDelay = delay })
+
+	done := make(chan error, 1)
+	go func() { done <- WaitForClick(ctx, port, testPrompt) }()
+	return done
+}
+
+// greet answers the handshake like MK4 does: the echo of M118 and its ok
+func greet(t *testing.T, port *fakePort) {
+	t.Helper()
+	port.expect(t, "M118 start")
+	port.say("// start")
+	port.say("ok")
+}
+
+func TestPromptIgnoresTheOKOfTheHandshake(t *testing.T) {
+	port := newFakePort()
+	done := waitForClick(t, context.Background(), port)
+	greet(t, port)
+
+	port.expect(t, "M117 Press the knob")
+	port.say("ok")
+	port.expect(t, "M0 S60 Press the knob")
+	select {
+	case err := <-done:
+		t.Fatalf("prompt returned %v before the knob was clicked", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	port.say("//action:prompt_end")
+	if err := wait(t, done); err != nil {
+		t.Fatal(err)
+	}
+	port.expect(t, "M117")
+}
+
+func TestPromptStopsWithContext(t *testing.T) {
+	port := newFakePort()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := waitForClick(t, ctx, port)
+	greet(t, port)
+
+	port.expect(t, "M117 Press the knob")
+	port.say("ok")
+	port.expect(t, "M0 S60 Press the knob")
+	cancel()
+	if err := wait(t, done); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want context.Canceled", err)
+	}
+}
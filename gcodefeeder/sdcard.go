@@ -0,0 +1,126 @@
+package gcodefeeder
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sdPollingInterval is how often M27 is sent while the printer prints from the SD card.
+// Firmwares with auto-report send the status on their own every sdAutoReportInterval
+const sdPollingInterval = 10 * time.Second
+const sdAutoReportInterval = 2
+
+var sdProgressRegexp = regexp.MustCompile(`SD printing byte ([0-9]+)/([0-9]+)`)
+
+// PrintFromSD makes Feed upload the file to the SD card of the printer as name (M28/M29)
+// and print it from there (M23/M24) instead of streaming it line by line.
+// The print then survives the host going away. It must be called before Feed.
+// Marlin binary file transfer protocol is not supported, the file is uploaded as plain text
+func (f *Feeder) PrintFromSD(name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sdName = name
+}
+
+// NewSDFollower creates a feeder which follows the print already running from the SD card of the printer,
+// e.g. one started before the host restarted. Nothing is uploaded, Feed only reports progress and passes
+// Pause, Start and Cancel on to the printer. name is the file on the card, it may be empty if unknown
+func NewSDFollower(deviceName, name string) (*Feeder, error) {
+	tty, err := Connect(deviceName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", deviceName, err)
+	}
+	f := newSDFollower(tty, name)
+	f.deviceName = deviceName
+	return f, nil
+}
+
+// NewSDFollowerWithPort creates a follower on top of an already opened transport, e.g. a lease of Port
+func NewSDFollowerWithPort(port io.ReadWriteCloser, name string) *Feeder {
+	return newSDFollower(port, name)
+}
+
+func newSDFollower(tty io.ReadWriteCloser, name string) *Feeder {
+	f := newFeeder(tty, "")
+	f.sdName = name
+	f.following = true
+	return f
+}
+
+// sdStepStarted is the step of sdUpload right after M24, the file is printing
+const sdStepStarted = 4
+
+// sdUpload produces the commands which write the file to the SD card and start printing it
+type sdUpload struct {
+	name    string
+	scanner *bufio.Scanner
+	step    int
+}
+
+func (u *sdUpload) next() (string, bool) {
+	switch u.step {
+	case 0:
+		u.step++
+		return "M28 " + u.name, true
+	case 1:
+		if cmd, ok := nextCommand(u.scanner); ok {
+			return cmd, true
+		}
+		u.step++
+		return "M29 " + u.name, true
+	case 2:
+		u.step++
+		return "M23 " + u.name, true
+	case 3:
+		u.step++
+		return "M24", true
+	case sdStepStarted:
+		u.step++
+		return fmt.Sprintf("M27 S%d", sdAutoReportInterval), true
+	}
+	return "", false
+}
+
+// started reports whether M24 was already sent
+func (u *sdUpload) started() bool {
+	return u.step >= sdStepStarted
+}
+
+// uploading reports whether the printer is still writing commands to the file
+func (u *sdUpload) uploading() bool {
+	return u.step > 0 && u.step < 2
+}
+
+// sdCommand is sent to the printer when a status is requested during the SD print
+func sdCommand(status Status) string {
+	switch status {
+	case ManuallyPaused:
+		return "M25"
+	case Printing:
+		return "M24"
+	case Finished:
+		return "M524"
+	}
+	return ""
+}
+
+// parseSD recognizes M27 reports and the end of the SD print
+func parseSD(line string) (event, bool) {
+	if m := sdProgressRegexp.FindStringSubmatch(line); m != nil {
+		done, err1 := strconv.ParseInt(m[1], 10, 64)
+		total, err2 := strconv.ParseInt(m[2], 10, 64)
+		if err1 != nil || err2 != nil || total == 0 {
+			return event{}, false
+		}
+		return event{kind: evSDProgress, progress: int(done * 100 / total)}, true
+	}
+	if strings.Contains(line, "Done printing file") {
+		return event{kind: evSDDone}, true
+	}
+	return event{}, false
+}
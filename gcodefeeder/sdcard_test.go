@@ -0,0 +1,64 @@
+package gcodefeeder
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFollowSDPrint(t *testing.T) {
+	port := newFakePort()
+	f := newSDFollower(port, "JOB00042.GCO")
+	done := feed(f)
+	port.handshake(t)
+
+	// Nothing is uploaded, the feeder only asks for the progress
+	port.expect(t, "M27 S2")
+	waitStatus(t, f, Printing)
+	port.say("ok")
+	port.say("SD printing byte 50/100")
+	deadline := time.Now().Add(testTimeout)
+	for f.Progress() != 50 {
+		if time.Now().After(deadline) {
+			t.Fatalf("progress is %d, want 50", f.Progress())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := f.Pause(); err != nil {
+		t.Fatal(err)
+	}
+	port.expect(t, "M25")
+	if err := f.Start(); err != nil {
+		t.Fatal(err)
+	}
+	port.expect(t, "M24")
+
+	port.say("Done printing file")
+	if err := wait(t, done); err != nil {
+		t.Fatal(err)
+	}
+	if f.Status() != Finished || f.Progress() != 100 {
+		t.Fatalf("status %s, progress %d, want Finished, 100", f.Status(), f.Progress())
+	}
+	// The print ran to its end, the printer cools down on its own
+	port.silent(t)
+}
+
+func TestCancelFollowedSDPrint(t *testing.T) {
+	port := newFakePort()
+	f := newSDFollower(port, "")
+	done := feed(f)
+	port.handshake(t)
+	port.expect(t, "M27 S2")
+	port.say("ok")
+	waitStatus(t, f, Printing)
+
+	if err := f.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+	port.expect(t, "M524")
+	if err := wait(t, done); err != nil {
+		t.Fatal(err)
+	}
+	port.expect(t, "M104 S0")
+}
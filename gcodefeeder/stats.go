@@ -0,0 +1,191 @@
+package gcodefeeder
+
+import (
+	"fmt"
+	"time"
+)
+
+// LatencyBuckets are upper bounds of the ack latency histogram buckets
+var LatencyBuckets = []time.Duration{
+	1 * time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	2 * time.Second,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+	60 * time.Second,
+}
+
+// Histogram counts observations in LatencyBuckets.
+// Counts has one extra element for observations above the last bucket
+type Histogram struct {
+	Counts []int
+	Count  int
+	Sum    time.Duration
+	Max    time.Duration
+}
+
+func newHistogram() Histogram {
+	return Histogram{Counts: make([]int, len(LatencyBuckets)+1)}
+}
+
+func (h *Histogram) observe(d time.Duration) {
+	i := 0
+	for i < len(LatencyBuckets) && d > LatencyBuckets[i] {
+		i++
+	}
+	h.Counts[i]++
+	h.Count++
+	h.Sum += d
+	if d > h.Max {
+		h.Max = d
+	}
+}
+
+// Add merges the observations of other into h
+func (h *Histogram) Add(other Histogram) {
+	if h.Counts == nil {
+		h.Counts = make([]int, len(LatencyBuckets)+1)
+	}
+	for i, c := range other.Counts {
+		h.Counts[i] += c
+	}
+	h.Count += other.Count
+	h.Sum += other.Sum
+	if other.Max > h.Max {
+		h.Max = other.Max
+	}
+}
+
+func (h Histogram) copy() Histogram {
+	h.Counts = append([]int(nil), h.Counts...)
+	return h
+}
+
+func (h Histogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+// Quantile returns the upper bound of the bucket containing the q-th quantile
+func (h Histogram) Quantile(q float64) time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	rank := int(q * float64(h.Count))
+	seen := 0
+	for i, c := range h.Counts {
+		seen += c
+		if seen > rank {
+			if i == len(LatencyBuckets) || LatencyBuckets[i] > h.Max {
+				return h.Max
+			}
+			return LatencyBuckets[i]
+		}
+	}
+	return h.Max
+}
+
+// Stats describes how fast the printer consumes the job
+type Stats struct {
+	// Commands acknowledged by the printer
+	Commands  int
+	BytesSent int
+	// Started is when the first command was sent
+	Started time.Time
+	// Elapsed since Started until the feeder stopped or now
+	Elapsed time.Duration
+	// AckWait is the time spent with a command waiting for "ok"
+	AckWait time.Duration
+	// Paused is the time spent in ManuallyPaused, FSensorBusy, MMUBusy and MMUAttention
+	Paused     time.Duration
+	AckLatency Histogram
+}
+
+// CommandsPerSecond is the throughput while not paused
+func (s Stats) CommandsPerSecond() float64 {
+	active := s.Elapsed - s.Paused
+	if active <= 0 {
+		return 0
+	}
+	return float64(s.Commands) / active.Seconds()
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf(
+		"commands: %d, sent: %d bytes, elapsed: %s, throughput: %.1f cmd/s, ack wait: %s, paused: %s, ack latency mean/p50/p99/max: %s/%s/%s/%s",
+		s.Commands, s.BytesSent, s.Elapsed.Round(time.Second), s.CommandsPerSecond(),
+		s.AckWait.Round(time.Millisecond), s.Paused.Round(time.Second),
+		s.AckLatency.Mean(), s.AckLatency.Quantile(0.5), s.AckLatency.Quantile(0.99), s.AckLatency.Max,
+	)
+}
+
+// stats is the mutable state behind Stats. It is guarded by Feeder.mu
+type stats struct {
+	Stats
+	stopped     time.Time
+	sentAt      time.Time
+	pausedSince time.Time
+}
+
+func isPaused(s Status) bool {
+	return s == ManuallyPaused || s == FSensorBusy || s == MMUBusy || s == MMUAttention
+}
+
+func (s *stats) sent(now time.Time, bytes int) {
+	if s.Started.IsZero() {
+		s.Started = now
+	}
+	s.BytesSent += bytes
+	s.sentAt = now
+}
+
+func (s *stats) acked(now time.Time) {
+	if s.sentAt.IsZero() {
+		return
+	}
+	latency := now.Sub(s.sentAt)
+	s.sentAt = time.Time{}
+	s.Commands++
+	s.AckWait += latency
+	s.AckLatency.observe(latency)
+}
+
+func (s *stats) transition(now time.Time, from, to Status) {
+	if isPaused(to) && !isPaused(from) {
+		s.pausedSince = now
+	} else if isPaused(from) && !isPaused(to) {
+		s.Paused += now.Sub(s.pausedSince)
+		s.pausedSince = time.Time{}
+	}
+	if to.Terminal() {
+		s.stopped = now
+	}
+}
+
+func (s *stats) snapshot(now time.Time) Stats {
+	res := s.Stats
+	res.AckLatency = s.AckLatency.copy()
+	if s.Started.IsZero() {
+		return res
+	}
+	end := now
+	if !s.stopped.IsZero() {
+		end = s.stopped
+	}
+	res.Elapsed = end.Sub(s.Started)
+	if !s.pausedSince.IsZero() {
+		res.Paused += end.Sub(s.pausedSince)
+	}
+	return res
+}
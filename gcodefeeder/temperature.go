@@ -0,0 +1,44 @@
+package gcodefeeder
+
+import (
+	"regexp"
+	"strconv"
+)
+
+// Temperatures are the last ones reported by the printer in °C
+type Temperatures struct {
+	Hotend       float64 `json:"hotend"`
+	HotendTarget float64 `json:"hotend_target"`
+	Bed          float64 `json:"bed"`
+	BedTarget    float64 `json:"bed_target"`
+}
+
+// Reports look like "ok T:210.0 /210.0 B:60.0 /60.0 T0:210.0 /210.0 @:44 B@:0" or "T:205.3 E:0 W:?" while heating
+var (
+	hotendRegexp = regexp.MustCompile(`(?:^|\s)T:(-?[0-9.]+)(?:\s*/(-?[0-9.]+))?`)
+	bedRegexp    = regexp.MustCompile(`(?:^|\s)B:(-?[0-9.]+)(?:\s*/(-?[0-9.]+))?`)
+)
+
+// parseTemperatures updates t with the temperatures in the line. ok is false if the line has none.
+// Targets are kept if the line doesn't have them
+func parseTemperatures(line string, t *Temperatures) (ok bool) {
+	if m := hotendRegexp.FindStringSubmatch(line); m != nil {
+		ok = parseTemperature(m, &t.Hotend, &t.HotendTarget)
+	}
+	if m := bedRegexp.FindStringSubmatch(line); m != nil {
+		ok = parseTemperature(m, &t.Bed, &t.BedTarget) || ok
+	}
+	return ok
+}
+
+func parseTemperature(m []string, current, target *float64) bool {
+	value, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return false
+	}
+	*current = value
+	if value, err := strconv.ParseFloat(m[2], 64); err == nil {
+		*target = value
+	}
+	return true
+}
@@ -0,0 +1,201 @@
+package gcodefeeder
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Direction of a transcript line
+type Direction string
+
+const (
+	// Sent marks lines written by the host to the printer
+	Sent = Direction(">")
+	// Received marks lines read by the host from the printer
+	Received = Direction("<")
+)
+
+// TranscriptEntry is a single line of the serial conversation
+type TranscriptEntry struct {
+	Time      time.Time
+	Direction Direction
+	Line      string
+}
+
+func (e TranscriptEntry) String() string {
+	return fmt.Sprintf("%s %s %s", e.Time.UTC().Format(time.RFC3339Nano), e.Direction, e.Line)
+}
+
+// ReadTranscript parses a transcript written by Recorder
+func ReadTranscript(r io.Reader) ([]TranscriptEntry, error) {
+	var entries []TranscriptEntry
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		parts := strings.SplitN(scanner.Text(), " ", 3)
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("transcript line %d: malformed", n)
+		}
+		t, err := time.Parse(time.RFC3339Nano, parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("transcript line %d: %w", n, err)
+		}
+		entry := TranscriptEntry{Time: t, Direction: Direction(parts[1])}
+		if entry.Direction != Sent && entry.Direction != Received {
+			return nil, fmt.Errorf("transcript line %d: unknown direction %q", n, parts[1])
+		}
+		if len(parts) == 3 {
+			entry.Line = parts[2]
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// Recorder wraps the printer transport and writes every line going through it to a timestamped transcript
+type Recorder struct {
+	rwc io.ReadWriteCloser
+
+	mu         sync.Mutex
+	transcript io.Writer
+	sent       []byte
+	received   []byte
+}
+
+func NewRecorder(rwc io.ReadWriteCloser, transcript io.Writer) *Recorder {
+	return &Recorder{rwc: rwc, transcript: transcript}
+}
+
+func (r *Recorder) Read(p []byte) (int, error) {
+	n, err := r.rwc.Read(p)
+	r.record(Received, &r.received, p[:n])
+	return n, err
+}
+
+func (r *Recorder) Write(p []byte) (int, error) {
+	// Record before writing, otherwise printer may answer before the command is in the transcript
+	r.record(Sent, &r.sent, p)
+	return r.rwc.Write(p)
+}
+
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	// Printer may not finish the last line before we close the port
+	r.flushLocked(Received, &r.received)
+	r.mu.Unlock()
+	return r.rwc.Close()
+}
+
+// record appends data to the per-direction buffer and writes every complete line to the transcript
+func (r *Recorder) record(dir Direction, buf *[]byte, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	*buf = append(*buf, data...)
+	for {
+		i := bytes.IndexByte(*buf, '\n')
+		if i < 0 {
+			return
+		}
+		r.writeLocked(dir, strings.TrimRight(string((*buf)[:i]), "\r"))
+		*buf = (*buf)[i+1:]
+	}
+}
+
+func (r *Recorder) flushLocked(dir Direction, buf *[]byte) {
+	if len(*buf) == 0 {
+		return
+	}
+	r.writeLocked(dir, strings.TrimRight(string(*buf), "\r"))
+	*buf = nil
+}
+
+func (r *Recorder) writeLocked(dir Direction, line string) {
+	entry := TranscriptEntry{Time: time.Now(), Direction: dir, Line: line}
+	if _, err := fmt.Fprintln(r.transcript, entry); err != nil {
+		log.Debug("Feeder: failed to write transcript: ", err)
+	}
+}
+
+// Replayer is a fake printer transport which answers with the printer side of a recorded transcript.
+// Every line written by the host releases the printer lines which followed the same line in the recording,
+// so the conversation is reproduced deterministically regardless of the original timing.
+type Replayer struct {
+	entries []TranscriptEntry
+	pos     int
+	partial []byte
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending bytes.Buffer
+	closed  bool
+}
+
+func NewReplayer(entries []TranscriptEntry) *Replayer {
+	r := &Replayer{entries: entries}
+	r.cond = sync.NewCond(&r.mu)
+	// Whatever printer said before the host wrote anything, e.g. "start" after the port is opened
+	r.release()
+	return r
+}
+
+// release queues printer lines until the next host line in the transcript
+func (r *Replayer) release() {
+	for ; r.pos < len(r.entries) && r.entries[r.pos].Direction == Received; r.pos++ {
+		r.pending.WriteString(r.entries[r.pos].Line + "\n")
+	}
+	r.cond.Broadcast()
+}
+
+func (r *Replayer) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for r.pending.Len() == 0 && !r.closed && r.pos < len(r.entries) {
+		r.cond.Wait()
+	}
+	// Printer has nothing more to say once the transcript is over
+	if r.pending.Len() == 0 {
+		return 0, io.EOF
+	}
+	return r.pending.Read(p)
+}
+
+func (r *Replayer) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return 0, io.ErrClosedPipe
+	}
+	r.partial = append(r.partial, p...)
+	for {
+		i := bytes.IndexByte(r.partial, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := strings.TrimRight(string(r.partial[:i]), "\r")
+		r.partial = r.partial[i+1:]
+
+		if r.pos >= len(r.entries) {
+			log.Warningf("Replay: transcript is over, host sent %q", line)
+			continue
+		}
+		if expected := r.entries[r.pos].Line; expected != line {
+			log.Warningf("Replay: diverged from transcript, expected %q, host sent %q", expected, line)
+		}
+		r.pos++
+		r.release()
+	}
+}
+
+func (r *Replayer) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	r.cond.Broadcast()
+	return nil
+}
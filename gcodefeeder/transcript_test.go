@@ -0,0 +1,112 @@
+package gcodefeeder
+
+import (
+	"bytes"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// transcript is written by the recorder and read by the test
+type transcript struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (t *transcript) Write(b []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.buf.Write(b)
+}
+
+func (t *transcript) entries(tb testing.TB) []TranscriptEntry {
+	tb.Helper()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entries, err := ReadTranscript(bytes.NewReader(t.buf.Bytes()))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return entries
+}
+
+// conversation is the transcript without the time, what the replay must reproduce
+func conversation(entries []TranscriptEntry) []string {
+	var lines []string
+	for _, e := range entries {
+		lines = append(lines, string(e.Direction)+" "+e.Line)
+	}
+	return lines
+}
+
+func inOrder(t *testing.T, entries []TranscriptEntry) {
+	t.Helper()
+	for i := 1; i < len(entries); i++ {
+		if entries[i].Time.Before(entries[i-1].Time) {
+			t.Fatalf("%q is recorded before %q which came first", entries[i], entries[i-1])
+		}
+	}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	gcode := writeGcode(t, "G28 ; home", "M73 P50", "G1 X10")
+
+	// Record the session with the fake printer
+	port := newFakePort()
+	recorded := &transcript{}
+	f := newFeeder(port, gcode)
+	f.Record(recorded)
+	done := feed(f)
+	port.handshake(t)
+	for _, cmd := range []string{"G28", "M73 P50", "G1 X10"} {
+		port.expect(t, cmd)
+		port.say("ok")
+	}
+	if err := wait(t, done); err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range []string{"M104 S0", "M140 S0", "M107"} {
+		port.expect(t, cmd)
+	}
+	original := recorded.entries(t)
+	want := []string{
+		// The empty line flushes whatever junk is in the write buffer
+		"> ", "> M118 start", "< start",
+		"> G28", "< ok", "> M73 P50", "< ok", "> G1 X10", "< ok",
+		"> M104 S0", "> M140 S0", "> M107",
+	}
+	if got := conversation(original); !reflect.DeepEqual(got, want) {
+		t.Fatalf("recorded %q, want %q", got, want)
+	}
+	inOrder(t, original)
+
+	// Replay it to a new feeder and record that too
+	replayed := &transcript{}
+	replay := newFeeder(NewReplayer(original), gcode)
+	replay.Record(replayed)
+	if err := wait(t, feed(replay)); err != nil {
+		t.Fatal(err)
+	}
+	if replay.Status() != Finished || replay.Progress() != 50 {
+		t.Fatalf("replay is %s at %d%%, want Finished at 50%%", replay.Status(), replay.Progress())
+	}
+	waitLines(t, replayed, len(original))
+	again := replayed.entries(t)
+	if got := conversation(again); !reflect.DeepEqual(got, want) {
+		t.Fatalf("replay recorded %q, want %q", got, want)
+	}
+	inOrder(t, again)
+}
+
+// waitLines waits for the lines the feeder writes after Feed returned, e.g. turning the heaters off
+func waitLines(t *testing.T, tr *transcript, n int) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for len(tr.entries(t)) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("transcript has %d lines, want %d", len(tr.entries(t)), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"time"
+
+	"github.com/leoleovich/3djuggler/gcodefeeder"
+	log "github.com/sirupsen/logrus"
+)
+
+func main() {
+	var transcriptFile, jobFile string
+	var verbose bool
+
+	flag.StringVar(&transcriptFile, "transcript", "", "Transcript recorded by 3djuggler")
+	flag.StringVar(&jobFile, "job", "", "Gcode file which was printed")
+	flag.BoolVar(&verbose, "verbose", false, "Use verbose log output")
+	flag.Parse()
+
+	log.SetOutput(os.Stdout)
+	if verbose {
+		log.SetLevel(log.DebugLevel)
+	}
+	if transcriptFile == "" || jobFile == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	file, err := os.Open(transcriptFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	entries, err := gcodefeeder.ReadTranscript(file)
+	file.Close()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	feeder, err := gcodefeeder.NewFeederWithPort(gcodefeeder.NewReplayer(entries), jobFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() { done <- feeder.Feed() }()
+
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			log.Info("Progress: ", feeder.Progress(), " Status: ", feeder.Status())
+			if err != nil {
+				log.Fatal(err)
+			}
+			return
+		case <-ticker.C:
+			log.Info("Progress: ", feeder.Progress(), " Status: ", feeder.Status())
+		}
+	}
+}
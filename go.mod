@@ -4,5 +4,5 @@ go 1.16
 
 require (
 	github.com/sirupsen/logrus v1.9.0
-	go.bug.st/serial v1.3.0
+	go.bug.st/serial v1.6.4
 )
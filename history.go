@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leoleovich/3djuggler/gcodefeeder"
+	"github.com/leoleovich/3djuggler/history"
+	"github.com/leoleovich/3djuggler/juggler"
+	log "github.com/sirupsen/logrus"
+)
+
+// Records returned by /history unless limit is given
+const defaultHistoryLimit = 1000
+
+// Reasons of the jobs which failed rather than were cancelled
+const (
+	reasonPrinterError = "printer error"
+	reasonInterrupted  = "interrupted by the restart"
+)
+
+// filamentComments are the filament lengths written by slicers, in mm unless scaled
+var filamentComments = []struct {
+	pattern *regexp.Regexp
+	scale   float64
+}{
+	// PrusaSlicer, SuperSlicer and OrcaSlicer: "; filament used [mm] = 1234.56"
+	{regexp.MustCompile(`(?m)^; filament used \[mm\] = (.+)$`), 1},
+	// Cura: ";Filament used: 1.23456m"
+	{regexp.MustCompile(`(?m)^;Filament used: (.+)$`), 1000},
+	// Simplify3D: ";   Filament length: 1234.5 mm"
+	{regexp.MustCompile(`(?m)^;\s*Filament length: (.+)$`), 1},
+}
+
+// filamentLength returns the filament length in mm planned by the slicer, summed for all extruders. 0 if unknown
+func filamentLength(gcode string) float64 {
+	for _, comment := range filamentComments {
+		m := comment.pattern.FindStringSubmatch(gcode)
+		if m == nil {
+			continue
+		}
+		total := 0.0
+		for _, part := range strings.Split(m[1], ",") {
+			part = strings.TrimSpace(part)
+			part = strings.TrimSpace(strings.TrimRight(part, "m"))
+			if length, err := strconv.ParseFloat(part, 64); err == nil {
+				total += length * comment.scale
+			}
+		}
+		return total
+	}
+	return 0
+}
+
+// track adds the status change to the record of the current job and stores the record once the job is over. Loop only
+func (daemon *Daemon) track(job juggler.Job, to juggler.JobStatus, reason string) {
+	r := daemon.trail
+	if r == nil || r.JobID != job.ID || r.Source != job.Source {
+		return
+	}
+	now := time.Now()
+	r.Actions = append(r.Actions, history.Action{Time: now, Status: to, Reason: reason})
+	switch to {
+	case juggler.StatusSending:
+		r.ButtonPressed = now
+	case juggler.StatusPrinting:
+		if r.PrintStarted.IsZero() {
+			r.PrintStarted = now
+		}
+	case juggler.StatusFinished:
+		job.Progress = 100
+		daemon.archive(job, history.Finished, reason)
+	case juggler.StatusCancelling:
+		outcome := history.Cancelled
+		if reason == reasonPrinterError || reason == reasonInterrupted {
+			outcome = history.Failed
+		}
+		daemon.archive(job, outcome, reason)
+	case juggler.StatusButtonTimeout:
+		daemon.archive(job, history.TimedOut, reason)
+	}
+}
+
+// archive stores the record of the job which is over. Loop only
+func (daemon *Daemon) archive(job juggler.Job, outcome, reason string) {
+	r := daemon.trail
+	daemon.trail = nil
+	r.Ended = time.Now()
+	r.Outcome = outcome
+	r.Reason = reason
+	r.Progress = job.Progress
+	r.FilamentUsed = r.Filament * job.Progress / 100
+	// The printer is not known after the restart
+	if !r.PrintStarted.IsZero() && reason != reasonInterrupted {
+		r.FeederStatus = endedIn(job.FeederStatus, outcome).String()
+	}
+	jobsTotal.Inc(r.Printer, outcome)
+	daemon.recent = append(daemon.recent, *r)
+	if daemon.history == nil {
+		return
+	}
+	if err := daemon.history.Add(r); err != nil {
+		daemon.log.Error("Failed to store the history of the job: ", err)
+	}
+}
+
+// endedIn is the status of the printer the print ended in, rather than the last one juggler saw.
+// Prints juggler stops, or which are stopped on the printer while paused, end Cancelled
+func endedIn(last gcodefeeder.Status, outcome string) gcodefeeder.Status {
+	switch {
+	case outcome == history.Finished:
+		return gcodefeeder.Finished
+	case last.Terminal() && last != gcodefeeder.Finished:
+		// Error, ConnectionFail or Cancelled by the printer itself
+		return last
+	}
+	return gcodefeeder.Cancelled
+}
+
+// client is who sent the request: the first address of X-Forwarded-For behind a proxy or the remote address
+func client(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// parseDay parses a date, e.g. 2021-01-02, or an RFC 3339 time. A date is the end of the day if end is set
+func parseDay(value string, end bool) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		if end {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+// HistoryHandler gives records of the jobs which are over, filtered by printer, owner, outcome and the time
+// they ended between from and to. Both take a date or an RFC 3339 time. format=csv exports them as CSV
+func (s *Server) HistoryHandler(w http.ResponseWriter, r *http.Request) {
+	log.Infof("Received history handler request")
+	// Add headers to allow AJAX
+	juggler.SetHeaders(w)
+	if s.history == nil {
+		http.Error(w, "history is disabled", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := history.Filter{
+		Printer: query.Get("printer"),
+		Owner:   query.Get("owner"),
+		Outcome: query.Get("outcome"),
+	}
+	var err error
+	if v := query.Get("from"); v != "" {
+		if filter.From, err = parseDay(v, false); err != nil {
+			http.Error(w, "from must be a date or an RFC 3339 time, e.g. 2021-01-02", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("to"); v != "" {
+		if filter.To, err = parseDay(v, true); err != nil {
+			http.Error(w, "to must be a date or an RFC 3339 time, e.g. 2021-01-02", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := defaultHistoryLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive number", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	records, err := s.history.Find(filter, limit)
+	if err != nil {
+		log.Error("Failed to read the history: ", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if query.Get("format") != "csv" {
+		s.respondJSON(w, records)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="history.csv"`)
+	if err := writeCSV(w, records); err != nil {
+		log.Error("Failed to write the history: ", err)
+	}
+}
+
+// writeCSV writes a row per record. Actions are joined into a single column
+func writeCSV(w http.ResponseWriter, records []history.Record) error {
+	out := csv.NewWriter(w)
+	_ = out.Write([]string{
+		"job_id", "printer", "owner", "file_name", "source", "color",
+		"fetched", "button_pressed", "print_started", "ended",
+		"outcome", "reason", "feeder_status", "progress", "filament_mm", "filament_used_mm", "actions",
+	})
+	for _, r := range records {
+		actions := make([]string, 0, len(r.Actions))
+		for _, a := range r.Actions {
+			actions = append(actions, fmt.Sprintf("%s %s: %s", csvTime(a.Time), a.Status, a.Reason))
+		}
+		_ = out.Write([]string{
+			strconv.Itoa(r.JobID), r.Printer, r.Owner, r.Filename, r.Source, r.Color,
+			csvTime(r.Fetched), csvTime(r.ButtonPressed), csvTime(r.PrintStarted), csvTime(r.Ended),
+			r.Outcome, r.Reason, r.FeederStatus,
+			strconv.FormatFloat(r.Progress, 'f', 1, 64),
+			strconv.FormatFloat(r.Filament, 'f', 1, 64),
+			strconv.FormatFloat(r.FilamentUsed, 'f', 1, 64),
+			strings.Join(actions, "; "),
+		})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+// csvTime leaves times which never happened empty, e.g. the print start of a job which timed out
+func csvTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
@@ -0,0 +1,246 @@
+// Package history keeps records of jobs which left the printer, one JSON line per job
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/leoleovich/3djuggler/juggler"
+)
+
+const (
+	// maxSize is the size of the file in bytes at which it is rotated
+	maxSize = 10 << 20
+	// keep is how many rotated files are kept, e.g. history.jsonl.1 to history.jsonl.5
+	keep = 5
+)
+
+// How the job ended
+const (
+	Finished  = "finished"
+	Cancelled = "cancelled"
+	// Failed jobs were stopped by the printer or interrupted by a restart
+	Failed   = "failed"
+	TimedOut = "timed out"
+)
+
+// Action is a status change of the job and what made it, e.g. /start from a host or the knob
+type Action struct {
+	Time   time.Time         `json:"time"`
+	Status juggler.JobStatus `json:"status"`
+	Reason string            `json:"reason"`
+}
+
+// Record is a job from fetching to the end
+type Record struct {
+	JobID    int    `json:"job_id"`
+	Printer  string `json:"printer"`
+	Owner    string `json:"owner"`
+	Filename string `json:"file_name"`
+	Source   string `json:"source"`
+	Color    string `json:"color"`
+
+	Fetched       time.Time `json:"fetched"`
+	ButtonPressed time.Time `json:"button_pressed"`
+	PrintStarted  time.Time `json:"print_started"`
+	Ended         time.Time `json:"ended"`
+
+	Outcome string `json:"outcome"`
+	// Reason is what ended the job, e.g. /cancel or printer error
+	Reason string `json:"reason"`
+	// FeederStatus is the status of the printer when the print ended, e.g. FSensorBusy. Empty if it is unknown
+	FeederStatus string  `json:"feeder_status"`
+	Progress     float64 `json:"progress"`
+	// Filament is the length in mm the slicer planned, 0 if unknown.
+	// FilamentUsed is the part of it printed before the job ended
+	Filament     float64  `json:"filament_mm"`
+	FilamentUsed float64  `json:"filament_used_mm"`
+	Actions      []Action `json:"actions"`
+}
+
+// Filter selects records. Empty fields match everything. Records are matched by Ended, from inclusive, to exclusive
+type Filter struct {
+	Printer string
+	Owner   string
+	Outcome string
+	From    time.Time
+	To      time.Time
+}
+
+func (f Filter) match(r *Record) bool {
+	switch {
+	case f.Printer != "" && r.Printer != f.Printer,
+		f.Owner != "" && r.Owner != f.Owner,
+		f.Outcome != "" && r.Outcome != f.Outcome,
+		!f.From.IsZero() && r.Ended.Before(f.From),
+		!f.To.IsZero() && !r.Ended.Before(f.To):
+		return false
+	}
+	return true
+}
+
+// Store appends records to a file and rotates it when it grows too big
+type Store struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// Open opens the store at path, creating it if needed
+func Open(path string) (*Store, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	s := &Store{path: path}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Store) open() error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+// Close closes the file
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// Add appends the record and syncs the file, so the record survives a power loss
+func (s *Store) Add(r *Record) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.size > 0 && s.size+int64(len(b)) > maxSize {
+		if err := s.rotate(); err != nil {
+			return fmt.Errorf("failed to rotate %s: %w", s.path, err)
+		}
+	}
+	n, err := s.file.Write(b)
+	s.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+// rotate shifts history.jsonl to history.jsonl.1, history.jsonl.1 to history.jsonl.2 and so on, dropping the oldest one
+func (s *Store) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	for i := keep - 1; i > 0; i-- {
+		if err := os.Rename(s.rotated(i), s.rotated(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(s.path, s.rotated(1)); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+func (s *Store) rotated(i int) string {
+	return fmt.Sprintf("%s.%d", s.path, i)
+}
+
+// Find returns matching records, oldest first, including the rotated files.
+// Only the last limit records are returned if there are more
+func (s *Store) Find(f Filter, limit int) ([]Record, error) {
+	segments, err := s.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, seg := range segments {
+			seg.file.Close()
+		}
+	}()
+	// Records are added meanwhile, the segments are read as they were when they were opened
+	records := []Record{}
+	for _, seg := range segments {
+		scanner := bufio.NewScanner(io.LimitReader(seg.file, seg.size))
+		// Records of long jobs with many pauses may be longer than the default limit
+		scanner.Buffer(nil, 1<<20)
+		for scanner.Scan() {
+			var r Record
+			// Lines which can't be decoded, e.g. cut by a crash, are skipped
+			if err := json.Unmarshal(scanner.Bytes(), &r); err != nil || !f.match(&r) {
+				continue
+			}
+			records = append(records, r)
+			if len(records) > limit {
+				records = records[1:]
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", seg.file.Name(), err)
+		}
+	}
+	return records, nil
+}
+
+// segment is an opened file of the store and its size when it was opened
+type segment struct {
+	file *os.File
+	size int64
+}
+
+// snapshot opens the files of the store, oldest first. The opened files survive the rotation
+func (s *Store) snapshot() ([]segment, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var segments []segment
+	for i := keep; i >= 0; i-- {
+		path := s.path
+		if i > 0 {
+			path = s.rotated(i)
+		}
+		file, err := os.Open(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		var info os.FileInfo
+		if err == nil {
+			info, err = file.Stat()
+			if err != nil {
+				file.Close()
+			}
+		}
+		if err != nil {
+			for _, seg := range segments {
+				seg.file.Close()
+			}
+			return nil, err
+		}
+		segments = append(segments, segment{file: file, size: info.Size()})
+	}
+	return segments, nil
+}
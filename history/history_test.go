@@ -0,0 +1,84 @@
+package history
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func open(t *testing.T) *Store {
+	t.Helper()
+	s, err := Open(filepath.Join(t.TempDir(), "history.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestFind(t *testing.T) {
+	s := open(t)
+	start := time.Now()
+	for i := 1; i <= 5; i++ {
+		outcome := Finished
+		if i%2 == 0 {
+			outcome = Cancelled
+		}
+		if err := s.Add(&Record{JobID: i, Owner: "bob", Outcome: outcome, Ended: start.Add(time.Duration(i) * time.Second)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, err := s.Find(Filter{Outcome: Finished, From: start.Add(2 * time.Second)}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].JobID != 3 || records[1].JobID != 5 {
+		t.Fatalf("got %+v, want jobs 3 and 5", records)
+	}
+	records, err = s.Find(Filter{}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].JobID != 4 || records[1].JobID != 5 {
+		t.Fatalf("got %+v, want the last 2 jobs", records)
+	}
+}
+
+func TestRotation(t *testing.T) {
+	s := open(t)
+	// Every record takes half a megabyte, 6 files keep about 120 of them
+	filename := strings.Repeat("x", 1<<19)
+	const total = 150
+	for i := 1; i <= total; i++ {
+		if err := s.Add(&Record{JobID: i, Filename: filename}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.size > maxSize {
+		t.Fatalf("file is %d bytes, want at most %d", s.size, maxSize)
+	}
+
+	records, err := s.Find(Filter{}, total)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The oldest records are dropped with the oldest file
+	if len(records) == 0 || len(records) == total || records[len(records)-1].JobID != total {
+		t.Fatalf("got %d records, the last is %s", len(records), last(records))
+	}
+	for i := 1; i < len(records); i++ {
+		if records[i].JobID != records[i-1].JobID+1 {
+			t.Fatalf("job %d follows job %d", records[i].JobID, records[i-1].JobID)
+		}
+	}
+}
+
+func last(records []Record) string {
+	if len(records) == 0 {
+		return "none"
+	}
+	return fmt.Sprint(records[len(records)-1].JobID)
+}
@@ -0,0 +1,511 @@
+// Package hotfolder takes jobs from G-code files dropped into a directory, e.g. a network share
+package hotfolder
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leoleovich/3djuggler/internal/atomicfile"
+	"github.com/leoleovich/3djuggler/juggler"
+	log "github.com/sirupsen/logrus"
+)
+
+// Subfolders a job goes through
+const (
+	Queued   = "queued"
+	Printing = "printing"
+	Done     = "done"
+	Failed   = "failed"
+)
+
+const (
+	defaultSettleTime   = 10
+	defaultPollInterval = 5
+)
+
+// nextIDFile in Dir keeps the next job id, so ids don't start over once done/ and failed/ are cleaned up.
+// It is hidden, so it is not taken for a job
+const nextIDFile = ".next-id"
+
+// sidecarWait is how long a G-code file reported by inotify waits for its sidecar before it is queued
+const sidecarWait = 2 * time.Second
+
+type Config struct {
+	// Dir is watched for new G-code files
+	Dir string `json:"dir"`
+	// SettleTime is how many seconds a file must stay unchanged before it is queued,
+	// unless inotify reports that it was written and closed. Default is 10
+	SettleTime int `json:"settle_time"`
+	// PollInterval is how often Dir is scanned in seconds. Default is 5
+	PollInterval int `json:"poll_interval"`
+}
+
+// Meta is read from the sidecar JSON of a G-code file, e.g. benchy.json for benchy.gcode.
+// The sidecar should be written first. A later one is picked up until the job is taken from the queue
+type Meta struct {
+	Owner string `json:"owner"`
+	Color string `json:"color"`
+}
+
+// notifier reports names of files which were written and closed or moved into the directory
+type notifier interface {
+	Names() <-chan string
+	Close() error
+}
+
+// seen is how a file in Dir looked on the previous scan
+type seen struct {
+	size    int64
+	modTime time.Time
+	since   time.Time
+	// sidecar is set while the written file waits for its sidecar
+	sidecar bool
+}
+
+// Folder is a job source backed by a directory.
+// New files in Dir are moved to queued/ and then through printing/ to done/ or failed/.
+// Files get the id of their job as a prefix, e.g. queued/12_benchy.gcode
+type Folder struct {
+	config Config
+
+	mu      sync.Mutex
+	nextID  int
+	pending map[string]seen
+
+	changes chan struct{}
+	done    chan struct{}
+}
+
+// Open creates the subfolders of config.Dir and starts watching it
+func Open(config Config) (*Folder, error) {
+	if config.Dir == "" {
+		return nil, fmt.Errorf("hot folder requires dir")
+	}
+	if config.SettleTime <= 0 {
+		config.SettleTime = defaultSettleTime
+	}
+	if config.PollInterval <= 0 {
+		config.PollInterval = defaultPollInterval
+	}
+	f := &Folder{
+		config:  config,
+		nextID:  1,
+		pending: make(map[string]seen),
+		changes: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	for _, sub := range []string{Queued, Printing, Done, Failed} {
+		dir := filepath.Join(config.Dir, sub)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		// The files count too, the saved id may be missing, e.g. after an upgrade
+		files, err := f.jobs(sub)
+		if err != nil {
+			return nil, err
+		}
+		for id := range files {
+			if id >= f.nextID {
+				f.nextID = id + 1
+			}
+		}
+	}
+	b, err := os.ReadFile(filepath.Join(config.Dir, nextIDFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		saved, err := strconv.Atoi(strings.TrimSpace(string(b)))
+		if err != nil {
+			return nil, fmt.Errorf("hot folder: %s: %w", nextIDFile, err)
+		}
+		if saved > f.nextID {
+			f.nextID = saved
+		}
+	}
+	// Files written once Open returns are reported
+	n, err := newNotifier(config.Dir)
+	if err != nil {
+		log.Warningf("Hot folder: polling %s: %v", config.Dir, err)
+		n = nil
+	}
+	go f.watch(n)
+	return f, nil
+}
+
+// Close stops watching the directory
+func (f *Folder) Close() error {
+	close(f.done)
+	return nil
+}
+
+// Changes is signalled when a new job is queued
+func (f *Folder) Changes() <-chan struct{} {
+	return f.changes
+}
+
+func (f *Folder) Name() string {
+	return juggler.SourceHotFolder
+}
+
+// Next moves the oldest queued file to printing/
+func (f *Folder) Next() (juggler.Job, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	files, err := f.jobs(Queued)
+	if err != nil {
+		return juggler.Job{}, false, err
+	}
+	var queued []os.FileInfo
+	for _, name := range files {
+		info, err := os.Stat(filepath.Join(f.config.Dir, Queued, name))
+		if err != nil {
+			continue
+		}
+		queued = append(queued, info)
+	}
+	if len(queued) == 0 {
+		return juggler.Job{}, false, nil
+	}
+	sort.Slice(queued, func(i, j int) bool {
+		return queued[i].ModTime().Before(queued[j].ModTime())
+	})
+	name := queued[0].Name()
+	id, filename, _ := parse(name)
+
+	gcode, err := os.ReadFile(filepath.Join(f.config.Dir, Queued, name))
+	if err != nil {
+		return juggler.Job{}, false, err
+	}
+	f.adoptSidecar(name, filename)
+	meta := f.meta(filepath.Join(f.config.Dir, Queued, name), filename)
+	if err := f.move(name, Queued, Printing, false); err != nil {
+		return juggler.Job{}, false, err
+	}
+	log.Infof("Hot folder: taking job %d (%s) of %s", id, filename, meta.Owner)
+	return juggler.Job{
+		ID:          id,
+		Filename:    filename,
+		FileContent: string(gcode),
+		Owner:       meta.Owner,
+		Color:       meta.Color,
+	}, true, nil
+}
+
+// Get reports the job whose file was taken out of printing/ as cancelled
+func (f *Folder) Get(id int) (juggler.Job, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	files, err := f.jobs(Printing)
+	if err != nil {
+		return juggler.Job{}, err
+	}
+	if _, ok := files[id]; !ok {
+		return juggler.Job{ID: id, Status: juggler.StatusCancelling}, nil
+	}
+	return juggler.Job{ID: id}, nil
+}
+
+// Update moves the job which was not started on time to the end of the queue
+func (f *Folder) Update(job *juggler.Job) error {
+	if job.Status != juggler.StatusButtonTimeout {
+		return nil
+	}
+	return f.finish(job.ID, Queued)
+}
+
+// Complete moves the finished job to done/ and the cancelled one to failed/
+func (f *Folder) Complete(job *juggler.Job) error {
+	if job.Status == juggler.StatusFinished {
+		return f.finish(job.ID, Done)
+	}
+	return f.finish(job.ID, Failed)
+}
+
+func (f *Folder) Heartbeat(status juggler.JobStatus) error {
+	return nil
+}
+
+// Reschedule moves everything left in printing/ back to the queue, keeping its place
+func (f *Folder) Reschedule() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	files, err := f.jobs(Printing)
+	if err != nil {
+		return err
+	}
+	for _, name := range files {
+		if err := f.move(name, Printing, Queued, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finish moves the job out of printing/. The file may be gone already, e.g. removed to cancel the job
+func (f *Folder) finish(id int, to string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	files, err := f.jobs(Printing)
+	if err != nil {
+		return err
+	}
+	name, ok := files[id]
+	if !ok {
+		return nil
+	}
+	log.Infof("Hot folder: moving job %d to %s", id, to)
+	return f.move(name, Printing, to, to == Queued)
+}
+
+// jobs returns G-code files of the subfolder by job id
+func (f *Folder) jobs(sub string) (map[int]string, error) {
+	entries, err := os.ReadDir(filepath.Join(f.config.Dir, sub))
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[int]string)
+	for _, entry := range entries {
+		if entry.IsDir() || !isGCode(entry.Name()) {
+			continue
+		}
+		if id, _, ok := parse(entry.Name()); ok {
+			files[id] = entry.Name()
+		}
+	}
+	return files, nil
+}
+
+// move renames the file and its sidecar from one subfolder to another.
+// touch puts it at the end of the queue
+func (f *Folder) move(name, from, to string, touch bool) error {
+	src := filepath.Join(f.config.Dir, from, name)
+	dst := filepath.Join(f.config.Dir, to, name)
+	if err := os.Rename(src, dst); err != nil {
+		return err
+	}
+	if err := os.Rename(src+".json", dst+".json"); err != nil && !os.IsNotExist(err) {
+		log.Warningf("Hot folder: failed to move the sidecar of %s: %v", name, err)
+	}
+	if touch {
+		now := time.Now()
+		return os.Chtimes(dst, now, now)
+	}
+	return nil
+}
+
+// adoptSidecar moves the sidecar which was written after the queued file was picked up
+func (f *Folder) adoptSidecar(name, filename string) {
+	dst := filepath.Join(f.config.Dir, Queued, name) + ".json"
+	if _, err := os.Stat(dst); err == nil {
+		return
+	}
+	if err := os.Rename(filepath.Join(f.config.Dir, sidecar(filename)), dst); err != nil && !os.IsNotExist(err) {
+		log.Warningf("Hot folder: failed to queue the sidecar of %s: %v", filename, err)
+	}
+}
+
+// meta reads the sidecar of the file or falls back to the owner__color__name.gcode convention
+func (f *Folder) meta(path, filename string) Meta {
+	var meta Meta
+	b, err := os.ReadFile(path + ".json")
+	if err == nil {
+		if err := json.Unmarshal(b, &meta); err == nil {
+			return meta
+		}
+		log.Warningf("Hot folder: ignoring invalid sidecar of %s: %v", filename, err)
+	}
+	parts := strings.SplitN(filename, "__", 3)
+	switch len(parts) {
+	case 3:
+		meta.Owner, meta.Color = parts[0], parts[1]
+	case 2:
+		meta.Owner = parts[0]
+	}
+	return meta
+}
+
+// watch queues new files of Dir until Close. n is nil if inotify is not available
+func (f *Folder) watch(n notifier) {
+	var names <-chan string
+	if n != nil {
+		defer n.Close()
+		names = n.Names()
+	}
+	ticker := time.NewTicker(time.Duration(f.config.PollInterval) * time.Second)
+	defer ticker.Stop()
+
+	f.scan()
+	for {
+		select {
+		case <-f.done:
+			return
+		case name, ok := <-names:
+			if !ok {
+				log.Warningf("Hot folder: inotify stopped, polling %s", f.config.Dir)
+				names = nil
+				continue
+			}
+			f.notified(name)
+		case <-ticker.C:
+			f.scan()
+		}
+	}
+}
+
+// notified queues the G-code file which was written. A file without a sidecar gets sidecarWait to receive it,
+// the sidecar written meanwhile queues it right away
+func (f *Folder) notified(name string) {
+	if strings.HasSuffix(name, ".json") {
+		for _, ext := range []string{".gcode", ".gco", ".g"} {
+			if gcode := strings.TrimSuffix(name, ".json") + ext; f.waiting(gcode) {
+				f.queue(gcode)
+			}
+		}
+		return
+	}
+	if !isGCode(name) {
+		return
+	}
+	if _, err := os.Stat(filepath.Join(f.config.Dir, sidecar(name))); err == nil {
+		f.queue(name)
+		return
+	}
+	f.mu.Lock()
+	f.pending[name] = seen{since: time.Now(), sidecar: true}
+	f.mu.Unlock()
+	time.AfterFunc(sidecarWait, func() {
+		select {
+		case <-f.done:
+		default:
+			f.queue(name)
+		}
+	})
+}
+
+// waiting reports whether the G-code file waits for its sidecar
+func (f *Folder) waiting(name string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.pending[name].sidecar
+}
+
+// scan queues files which did not change for SettleTime
+func (f *Folder) scan() {
+	entries, err := os.ReadDir(f.config.Dir)
+	if err != nil {
+		log.Error("Hot folder: ", err)
+		return
+	}
+	present := make(map[string]bool)
+	var settled []string
+	now := time.Now()
+	f.mu.Lock()
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !isGCode(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		name := entry.Name()
+		present[name] = true
+		prev, ok := f.pending[name]
+		if prev.sidecar {
+			// Queued once its sidecar arrives or sidecarWait is over
+			continue
+		}
+		if !ok || prev.size != info.Size() || !prev.modTime.Equal(info.ModTime()) {
+			f.pending[name] = seen{size: info.Size(), modTime: info.ModTime(), since: now}
+			continue
+		}
+		if now.Sub(prev.since) >= time.Duration(f.config.SettleTime)*time.Second {
+			settled = append(settled, name)
+		}
+	}
+	for name := range f.pending {
+		if !present[name] {
+			delete(f.pending, name)
+		}
+	}
+	f.mu.Unlock()
+
+	for _, name := range settled {
+		f.queue(name)
+	}
+}
+
+// queue moves the new file of Dir with its sidecar to queued/ under a new job id
+func (f *Folder) queue(name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	src := filepath.Join(f.config.Dir, name)
+	if _, err := os.Stat(src); err != nil {
+		// Picked up already
+		return
+	}
+	delete(f.pending, name)
+	id := f.nextID
+	f.nextID++
+	// Saved before the id is used, so a crash doesn't give it out twice
+	if err := atomicfile.Write(filepath.Join(f.config.Dir, nextIDFile), []byte(strconv.Itoa(f.nextID))); err != nil {
+		log.Warning("Hot folder: ids may start over after a restart: ", err)
+	}
+	queued := fmt.Sprintf("%d_%s", id, name)
+	dst := filepath.Join(f.config.Dir, Queued, queued)
+	if err := os.Rename(src, dst); err != nil {
+		log.Errorf("Hot folder: failed to queue %s: %v", name, err)
+		return
+	}
+	if err := os.Rename(filepath.Join(f.config.Dir, sidecar(name)), dst+".json"); err != nil && !os.IsNotExist(err) {
+		log.Warningf("Hot folder: failed to queue the sidecar of %s: %v", name, err)
+	}
+	now := time.Now()
+	if err := os.Chtimes(dst, now, now); err != nil {
+		log.Warning("Hot folder: ", err)
+	}
+	log.Infof("Hot folder: queued %s as job %d", name, id)
+
+	select {
+	case f.changes <- struct{}{}:
+	default:
+	}
+}
+
+// parse splits the name of a queued file into the job id and the original name
+func parse(name string) (id int, filename string, ok bool) {
+	parts := strings.SplitN(name, "_", 2)
+	if len(parts) != 2 {
+		return 0, "", false
+	}
+	id, err := strconv.Atoi(parts[0])
+	if err != nil || id <= 0 {
+		return 0, "", false
+	}
+	return id, parts[1], true
+}
+
+// sidecar returns the name of the sidecar of the G-code file, e.g. benchy.json for benchy.gcode
+func sidecar(name string) string {
+	return strings.TrimSuffix(name, filepath.Ext(name)) + ".json"
+}
+
+// isGCode skips hidden and partial files, e.g. .benchy.gcode.part of rsync
+func isGCode(name string) bool {
+	if strings.HasPrefix(name, ".") {
+		return false
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".gcode", ".gco", ".g":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,137 @@
+package hotfolder
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/leoleovich/3djuggler/juggler"
+)
+
+const testTimeout = 5 * time.Second
+
+// open watches a new directory. Scans are rare, so files are queued by the watcher or the test
+func open(t *testing.T) *Folder {
+	t.Helper()
+	return openDir(t, t.TempDir())
+}
+
+func openDir(t *testing.T, dir string) *Folder {
+	t.Helper()
+	f, err := Open(Config{Dir: dir, SettleTime: 3600, PollInterval: 3600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func write(t *testing.T, f *Folder, name, content string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(f.config.Dir, name), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func queued(t *testing.T, f *Folder) {
+	t.Helper()
+	select {
+	case <-f.Changes():
+	case <-time.After(testTimeout):
+		t.Fatal("nothing was queued")
+	}
+}
+
+func TestSidecarWrittenBeforeTheFile(t *testing.T) {
+	f := open(t)
+	write(t, f, "benchy.json", `{"owner": "alice", "color": "red"}`)
+	write(t, f, "benchy.gcode", "G28\n")
+	queued(t, f)
+
+	job, ok, err := f.Next()
+	if err != nil || !ok {
+		t.Fatalf("Next: %v, %v", ok, err)
+	}
+	if job.Owner != "alice" || job.Color != "red" || job.Filename != "benchy.gcode" {
+		t.Fatalf("got %+v", job)
+	}
+}
+
+func TestSidecarWrittenAfterTheFile(t *testing.T) {
+	f := open(t)
+	write(t, f, "benchy.gcode", "G28\n")
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	write(t, f, "benchy.json", `{"owner": "alice"}`)
+	queued(t, f)
+	if waited := time.Since(start); waited >= sidecarWait {
+		t.Fatalf("file was queued after %s, not with its sidecar", waited)
+	}
+
+	job, _, err := f.Next()
+	if err != nil || job.Owner != "alice" {
+		t.Fatalf("got %+v, %v, want the owner of the sidecar", job, err)
+	}
+}
+
+func TestSidecarWrittenAfterTheFileWasQueued(t *testing.T) {
+	f := open(t)
+	write(t, f, "bob__benchy.gcode", "G28\n")
+	queued(t, f)
+	write(t, f, "bob__benchy.json", `{"owner": "alice"}`)
+
+	job, _, err := f.Next()
+	if err != nil || job.Owner != "alice" {
+		t.Fatalf("got %+v, %v, want the owner of the sidecar", job, err)
+	}
+	if _, err := os.Stat(filepath.Join(f.config.Dir, "bob__benchy.json")); !os.IsNotExist(err) {
+		t.Fatalf("sidecar is left in the hot folder: %v", err)
+	}
+}
+
+func TestFileWithoutSidecar(t *testing.T) {
+	f := open(t)
+	write(t, f, "bob__red__benchy.gcode", "G28\n")
+	queued(t, f)
+
+	job, _, err := f.Next()
+	if err != nil || job.Owner != "bob" || job.Color != "red" {
+		t.Fatalf("got %+v, %v, want the owner and color of the name", job, err)
+	}
+}
+
+func TestIdsDontStartOverAfterCleanup(t *testing.T) {
+	dir := t.TempDir()
+	// Not closed by the cleanup, juggler is stopped before the second Open
+	f, err := Open(Config{Dir: dir, SettleTime: 3600, PollInterval: 3600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(t, f, "benchy.gcode", "G28\n")
+	queued(t, f)
+	first, _, err := f.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.Status = juggler.StatusFinished
+	if err := f.Complete(&first); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// done/ is cleaned up while juggler is stopped
+	if err := os.RemoveAll(filepath.Join(dir, Done)); err != nil {
+		t.Fatal(err)
+	}
+	f = openDir(t, dir)
+	write(t, f, "cube.gcode", "G28\n")
+	queued(t, f)
+	second, _, err := f.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.ID <= first.ID {
+		t.Fatalf("job after the cleanup got id %d, the first one had %d", second.ID, first.ID)
+	}
+}
@@ -0,0 +1,72 @@
+//go:build linux
+// +build linux
+
+package hotfolder
+
+import (
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// inotify watches the directory for files which were written and closed or moved into it
+type inotify struct {
+	file  *os.File
+	names chan string
+	done  chan struct{}
+}
+
+func newNotifier(dir string) (notifier, error) {
+	// Non-blocking fd goes to the runtime poller, so Close interrupts Read
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	if _, err := syscall.InotifyAddWatch(fd, dir, syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO); err != nil {
+		_ = syscall.Close(fd)
+		return nil, os.NewSyscallError("inotify_add_watch", err)
+	}
+	n := &inotify{
+		file:  os.NewFile(uintptr(fd), "inotify"),
+		names: make(chan string),
+		done:  make(chan struct{}),
+	}
+	go n.read()
+	return n, nil
+}
+
+func (n *inotify) Names() <-chan string {
+	return n.names
+}
+
+func (n *inotify) Close() error {
+	close(n.done)
+	return n.file.Close()
+}
+
+func (n *inotify) read() {
+	defer close(n.names)
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		size, err := n.file.Read(buf)
+		if err != nil {
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= size; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			start := offset + syscall.SizeofInotifyEvent
+			offset = start + int(event.Len)
+			// Overflowed events are picked up by the next scan
+			if event.Mask&syscall.IN_Q_OVERFLOW != 0 || event.Len == 0 {
+				continue
+			}
+			name := strings.TrimRight(string(buf[start:offset]), "\x00")
+			select {
+			case n.names <- name:
+			case <-n.done:
+				return
+			}
+		}
+	}
+}
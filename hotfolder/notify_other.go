@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package hotfolder
+
+import "errors"
+
+func newNotifier(dir string) (notifier, error) {
+	return nil, errors.New("inotify is only available on Linux")
+}
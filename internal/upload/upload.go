@@ -0,0 +1,90 @@
+// Package upload streams job files to the network printers. Files are not buffered in memory
+// and a slow but steady upload is not cut off, only an upload which stopped moving is
+package upload
+
+import (
+	"context"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// IdleTimeout is how long an upload may not move before it fails
+const IdleTimeout = 60 * time.Second
+
+// NewClient returns the client for uploads. It has no timeout for the whole request,
+// connecting is limited by the default transport and the rest by Watch
+func NewClient() *http.Client {
+	return &http.Client{}
+}
+
+// Field is a form field sent before the file
+type Field struct {
+	Name, Value string
+}
+
+// Multipart streams a multipart form with the fields and content as the file field "file" named name.
+// The returned content type belongs to the body. The body must be closed, the request does it
+func Multipart(name string, content io.Reader, fields ...Field) (io.ReadCloser, string) {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(write(mw, name, content, fields))
+	}()
+	return pr, mw.FormDataContentType()
+}
+
+func write(mw *multipart.Writer, name string, content io.Reader, fields []Field) error {
+	for _, f := range fields {
+		if err := mw.WriteField(f.Name, f.Value); err != nil {
+			return err
+		}
+	}
+	fw, err := mw.CreateFormFile("file", name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fw, content); err != nil {
+		return err
+	}
+	return mw.Close()
+}
+
+// Watch cancels the returned context once body was not read for timeout, or once the response
+// did not come timeout after the body was sent. stop must be called when the response is read
+func Watch(ctx context.Context, body io.ReadCloser, timeout time.Duration) (context.Context, io.ReadCloser, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	w := &watched{ReadCloser: body, timeout: timeout, timer: time.AfterFunc(timeout, cancel)}
+	stop := func() {
+		w.mu.Lock()
+		w.stopped = true
+		w.timer.Stop()
+		w.mu.Unlock()
+		cancel()
+	}
+	return ctx, w, stop
+}
+
+// watched pushes the deadline of the upload away on every read
+type watched struct {
+	io.ReadCloser
+	timeout time.Duration
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	stopped bool
+}
+
+func (w *watched) Read(b []byte) (int, error) {
+	n, err := w.ReadCloser.Read(b)
+	if n > 0 {
+		w.mu.Lock()
+		if !w.stopped {
+			w.timer.Reset(w.timeout)
+		}
+		w.mu.Unlock()
+	}
+	return n, err
+}
@@ -0,0 +1,121 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMultipart(t *testing.T) {
+	body, contentType := Multipart("cube.gcode", strings.NewReader("G28\n"), Field{Name: "root", Value: "gcodes"})
+	defer body.Close()
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr := multipart.NewReader(body, params["boundary"])
+
+	want := []struct{ name, file, content string }{
+		{"root", "", "gcodes"},
+		{"file", "cube.gcode", "G28\n"},
+	}
+	for _, w := range want {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if part.FormName() != w.name || part.FileName() != w.file || string(content) != w.content {
+			t.Fatalf("part %q %q %q, want %q %q %q", part.FormName(), part.FileName(), content, w.name, w.file, w.content)
+		}
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Fatalf("more parts than expected: %v", err)
+	}
+}
+
+// trickle is an upload which sends a byte every interval
+type trickle struct {
+	interval time.Duration
+	left     int
+}
+
+func (r *trickle) Read(b []byte) (int, error) {
+	if r.left == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(r.interval)
+	r.left--
+	b[0] = 'G'
+	return 1, nil
+}
+
+func post(t *testing.T, url string, body io.ReadCloser, timeout time.Duration) error {
+	t.Helper()
+	ctx, body, stop := Watch(context.Background(), body, timeout)
+	defer stop()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := NewClient().Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func TestSlowUploadIsNotCutOff(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+	}))
+	defer server.Close()
+
+	// The upload takes far longer than the timeout, but it keeps moving
+	body := io.NopCloser(&trickle{interval: 20 * time.Millisecond, left: 20})
+	if err := post(t, server.URL, body, 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// zeros is an endless file
+type zeros struct{}
+
+func (zeros) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+func TestStalledUploadFails(t *testing.T) {
+	// The printer stops reading, the upload stalls once the buffers of the connection are full
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	done := make(chan error, 1)
+	go func() { done <- post(t, server.URL, io.NopCloser(zeros{}), 100*time.Millisecond) }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("stalled upload returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stalled upload is still running")
+	}
+}
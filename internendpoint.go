@@ -9,31 +9,41 @@ import (
 	"github.com/leoleovich/3djuggler/juggler"
 	"net/http"
 	"net/url"
+	"strconv"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 )
 
+var errNothingToPrint = errors.New("Nothing to print")
+
 const maxHTTPRetries = 3
 const requestTimeout = 60 * time.Second
 const retryInterval = 5 * time.Second
 
-func requestWithRetry(request *http.Request) (resp *http.Response, err error) {
+// requestWithRetry sends the request, retrying on network errors. action labels the metrics of the request
+func requestWithRetry(action string, request *http.Request) (resp *http.Response, err error) {
 	client := &http.Client{Timeout: requestTimeout}
 	for i := 0; i < maxHTTPRetries; i++ {
+		started := time.Now()
 		resp, err = client.Do(request)
+		internDuration.Observe(time.Since(started).Seconds(), action)
 		if err == nil {
+			internRequests.Inc(action, strconv.Itoa(resp.StatusCode))
 			return resp, nil
 		}
+		internRequests.Inc(action, "error")
 		time.Sleep(retryInterval)
 	}
+	internErrors.Inc(action)
 	return nil, err
 }
 
 func (ie *InternEndpoint) reportJobStatusChange(job *juggler.Job) error {
 	// Don't report default daemon status
 	// TODO: think about separation of daemon and job statuses
-	if job.Status == juggler.StatusWaitingJob {
+	// Local prints are not intern jobs, they are reported with the heartbeat
+	if job.Status == juggler.StatusWaitingJob || job.Status == juggler.StatusLocalPrint {
 		return nil
 	}
 
@@ -42,10 +52,17 @@ func (ie *InternEndpoint) reportJobStatusChange(job *juggler.Job) error {
 	if job.Status == juggler.StatusPrinting && job.FeederStatus == gcodefeeder.Printing {
 		sofar := job.Progress
 		statusWithProgress = fmt.Sprintf("Printing... (%0.1f%%)", sofar)
+	} else if job.Status == juggler.StatusPrinting && job.FeederStatus == gcodefeeder.Uploading {
+		statusWithProgress = "Printing... (uploading to SD card)"
 	} else if job.Status == juggler.StatusPaused {
 		switch job.FeederStatus {
 		case gcodefeeder.MMUBusy:
 			statusWithProgress = "Printing paused: MMU paused printing"
+		case gcodefeeder.MMUAttention:
+			statusWithProgress = "Printing paused: MMU needs attention"
+			if job.MMU != nil && job.MMU.Message != "" {
+				statusWithProgress = fmt.Sprintf("%s (slot %d): %s", statusWithProgress, job.MMU.Slot, job.MMU.Message)
+			}
 		case gcodefeeder.FSensorBusy:
 			statusWithProgress = "Printing paused: Filament sensor paused printing"
 		case gcodefeeder.ManuallyPaused:
@@ -68,7 +85,7 @@ func (ie *InternEndpoint) reportJobStatusChange(job *juggler.Job) error {
 	if err != nil {
 		return err
 	}
-	resp, err := requestWithRetry(req)
+	resp, err := requestWithRetry("update", req)
 	if err != nil {
 		return err
 	}
@@ -89,7 +106,7 @@ func (ie *InternEndpoint) reschedule() error {
 	if err != nil {
 		return err
 	}
-	resp, err := requestWithRetry(req)
+	resp, err := requestWithRetry("reschedule", req)
 	if err != nil {
 		return err
 	}
@@ -110,7 +127,7 @@ func (ie *InternEndpoint) deleteJob(job *juggler.Job) error {
 	if err != nil {
 		return err
 	}
-	resp, err := requestWithRetry(req)
+	resp, err := requestWithRetry("delete", req)
 	if err != nil {
 		return err
 	}
@@ -137,7 +154,7 @@ func (ie *InternEndpoint) getJob(id int) error {
 	if err != nil {
 		return err
 	}
-	resp, err := requestWithRetry(req)
+	resp, err := requestWithRetry("get", req)
 	if err != nil {
 		return err
 	}
@@ -162,28 +179,79 @@ func (ie *InternEndpoint) getJob(id int) error {
 	ie.job = result.Content
 
 	if ie.job.ID == 0 {
-		return errors.New("Nothing to print")
+		return errNothingToPrint
 	}
 
 	return nil
 }
 
-func (ie *InternEndpoint) reportStat() error {
+func (ie *InternEndpoint) reportStat(status juggler.JobStatus, stats *Stats) error {
 	data := url.Values{}
 	data.Set("app", ie.APIApp)
 	data.Add("token", ie.APIKey)
 	data.Add("action", "heartbeat")
 	data.Add("printer_name", ie.PrinterName)
 	data.Add("office_name", ie.OfficeName)
+	data.Add("status", string(status))
+	if stats != nil {
+		b, err := json.Marshal(stats)
+		if err != nil {
+			return err
+		}
+		data.Add("stats", string(b))
+	}
 
 	req, err := http.NewRequest(http.MethodPost, ie.APIURI+"/printer/", bytes.NewBufferString(data.Encode()))
 	if err != nil {
 		return err
 	}
-	resp, err := requestWithRetry(req)
+	resp, err := requestWithRetry("heartbeat", req)
 	if err != nil {
 		return err
 	}
 	resp.Body.Close()
 	return nil
 }
+
+func (ie *InternEndpoint) Name() string {
+	return juggler.SourceIntern
+}
+
+func (ie *InternEndpoint) Next() (juggler.Job, bool, error) {
+	err := ie.nextJob()
+	if errors.Is(err, errNothingToPrint) {
+		return juggler.Job{}, false, nil
+	}
+	if err != nil {
+		return juggler.Job{}, false, err
+	}
+	return *ie.job, true, nil
+}
+
+func (ie *InternEndpoint) Get(id int) (juggler.Job, error) {
+	if err := ie.getJob(id); err != nil {
+		return juggler.Job{}, err
+	}
+	return *ie.job, nil
+}
+
+func (ie *InternEndpoint) Update(job *juggler.Job) error {
+	return ie.reportJobStatusChange(job)
+}
+
+func (ie *InternEndpoint) Complete(job *juggler.Job) error {
+	return ie.deleteJob(job)
+}
+
+func (ie *InternEndpoint) Heartbeat(status juggler.JobStatus) error {
+	return ie.reportStat(status, nil)
+}
+
+// HeartbeatStats sends the statistics of the printer as JSON in the stats field of the heartbeat
+func (ie *InternEndpoint) HeartbeatStats(status juggler.JobStatus, stats *Stats) error {
+	return ie.reportStat(status, stats)
+}
+
+func (ie *InternEndpoint) Reschedule() error {
+	return ie.reschedule()
+}
@@ -1,6 +1,7 @@
 package juggler
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/leoleovich/3djuggler/gcodefeeder"
@@ -17,8 +18,51 @@ const (
 	StatusFinished      = JobStatus("Finished")
 	StatusButtonTimeout = JobStatus("Button timeout")
 	StatusPaused        = JobStatus("Paused")
+	StatusLocalPrint    = JobStatus("Busy (local print)")
+	// StatusEmergencyStopped is latched until /estop/reset is called
+	StatusEmergencyStopped = JobStatus("Emergency stopped")
 )
 
+// Statuses are all statuses of the job
+var Statuses = []JobStatus{
+	StatusWaitingJob, StatusWaitingButton, StatusSending, StatusPrinting, StatusPaused,
+	StatusCancelling, StatusFinished, StatusButtonTimeout, StatusLocalPrint, StatusEmergencyStopped,
+}
+
+// transitions lists every status change the daemon is allowed to make
+var transitions = map[JobStatus][]JobStatus{
+	StatusWaitingJob:       {StatusWaitingButton, StatusLocalPrint, StatusEmergencyStopped},
+	StatusButtonTimeout:    {StatusWaitingJob, StatusWaitingButton, StatusLocalPrint, StatusEmergencyStopped},
+	StatusWaitingButton:    {StatusSending, StatusButtonTimeout, StatusCancelling, StatusEmergencyStopped},
+	StatusSending:          {StatusPrinting, StatusCancelling, StatusEmergencyStopped},
+	StatusPrinting:         {StatusPaused, StatusFinished, StatusCancelling, StatusEmergencyStopped},
+	StatusPaused:           {StatusPrinting, StatusCancelling, StatusEmergencyStopped},
+	StatusCancelling:       {StatusWaitingJob, StatusEmergencyStopped},
+	StatusFinished:         {StatusWaitingJob, StatusEmergencyStopped},
+	StatusLocalPrint:       {StatusWaitingJob, StatusEmergencyStopped},
+	StatusEmergencyStopped: {StatusWaitingJob, StatusCancelling},
+}
+
+// CanTransition reports whether the daemon may change status from s to next
+func (s JobStatus) CanTransition(next JobStatus) bool {
+	for _, allowed := range transitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// TransitionError is returned when a status change is not allowed by the transition table
+type TransitionError struct {
+	From JobStatus
+	To   JobStatus
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("illegal status change from '%s' to '%s'", e.From, e.To)
+}
+
 type Job struct {
 	ID           int                `json:"id"`
 	Filename     string             `json:"file_name"`
@@ -31,4 +75,17 @@ type Job struct {
 	Scheduled    time.Time          `json:"scheduled"`
 	FeederStatus gcodefeeder.Status `json:"-"`
 	PrinterName  string             `json:"printer_name"`
+	// MMU is set while the job is in the printer
+	MMU *gcodefeeder.MMUState `json:"mmu,omitempty"`
+	// Source is the name of the job system the job comes from, e.g. SourceIntern
+	Source string `json:"source,omitempty"`
 }
+
+// Names of the job systems built into juggler
+const (
+	SourceIntern = "intern"
+	// SourceLocal is the local queue of juggler
+	SourceLocal = "local"
+	// SourceHotFolder is a directory watched for G-code files
+	SourceHotFolder = "hotfolder"
+)
@@ -0,0 +1,55 @@
+package juggler
+
+import (
+	"testing"
+)
+
+func TestCanTransition(t *testing.T) {
+	tests := []struct {
+		from, to JobStatus
+		want     bool
+	}{
+		{StatusWaitingJob, StatusWaitingButton, true},
+		{StatusWaitingJob, StatusLocalPrint, true},
+		{StatusWaitingJob, StatusPrinting, false},
+		{StatusWaitingJob, StatusSending, false},
+		{StatusWaitingButton, StatusSending, true},
+		{StatusWaitingButton, StatusButtonTimeout, true},
+		{StatusWaitingButton, StatusPrinting, false},
+		{StatusSending, StatusPrinting, true},
+		{StatusSending, StatusPaused, false},
+		{StatusPrinting, StatusPaused, true},
+		{StatusPrinting, StatusFinished, true},
+		{StatusPrinting, StatusCancelling, true},
+		{StatusPrinting, StatusWaitingButton, false},
+		{StatusPaused, StatusPrinting, true},
+		{StatusPaused, StatusCancelling, true},
+		// A paused print can't finish on its own
+		{StatusPaused, StatusFinished, false},
+		{StatusCancelling, StatusWaitingJob, true},
+		{StatusCancelling, StatusPrinting, false},
+		{StatusFinished, StatusWaitingJob, true},
+		{StatusFinished, StatusCancelling, false},
+		{StatusButtonTimeout, StatusWaitingButton, true},
+		{StatusButtonTimeout, StatusSending, false},
+		{StatusLocalPrint, StatusWaitingJob, true},
+		{StatusLocalPrint, StatusWaitingButton, false},
+		// Only /estop/reset leaves the emergency stop
+		{StatusEmergencyStopped, StatusWaitingJob, true},
+		{StatusEmergencyStopped, StatusCancelling, true},
+		{StatusEmergencyStopped, StatusPrinting, false},
+	}
+	for _, tt := range tests {
+		if got := tt.from.CanTransition(tt.to); got != tt.want {
+			t.Errorf("%s -> %s: got %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestEmergencyStopFromEverywhere(t *testing.T) {
+	for _, s := range Statuses {
+		if s != StatusEmergencyStopped && !s.CanTransition(StatusEmergencyStopped) {
+			t.Errorf("%s can't be emergency stopped", s)
+		}
+	}
+}
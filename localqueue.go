@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/leoleovich/3djuggler/juggler"
+	"github.com/leoleovich/3djuggler/queue"
+)
+
+// Policies to merge intern jobs with the local queue
+const (
+	// Local jobs are printed when intern has nothing or is down
+	policyInternFirst = "intern-first"
+	// Intern is asked only when the local queue is empty
+	policyLocalFirst = "local-first"
+	// Intern and local jobs take turns
+	policyAlternate = "alternate"
+)
+
+// maxUploadMemory is how much of an uploaded file is kept in memory, the rest goes to a temporary file
+const maxUploadMemory = 32 << 20
+
+// errBodyTooLarge is the text of the error of http.MaxBytesReader, it has no type of its own
+const errBodyTooLarge = "http: request body too large"
+
+// localSource is the JobSource of the local queue
+type localSource struct {
+	queue *queue.Queue
+}
+
+func (s *localSource) Name() string {
+	return juggler.SourceLocal
+}
+
+// Next takes the first job off the queue
+func (s *localSource) Next() (juggler.Job, bool, error) {
+	job, gcode, ok, err := s.queue.Pop()
+	if err != nil || !ok {
+		return juggler.Job{}, false, err
+	}
+	return juggler.Job{
+		ID:          job.ID,
+		Filename:    job.Filename,
+		FileContent: string(gcode),
+		Owner:       job.Owner,
+		Color:       job.Color,
+	}, true, nil
+}
+
+// Get returns the job as it is. Local jobs are cancelled on the daemon only
+func (s *localSource) Get(id int) (juggler.Job, error) {
+	return juggler.Job{ID: id}, nil
+}
+
+// Update puts the job which was not started on time back to the queue with the G-code the queue kept
+func (s *localSource) Update(job *juggler.Job) error {
+	if job.Status != juggler.StatusButtonTimeout {
+		return nil
+	}
+	return s.queue.Return(queue.Job{
+		ID:       job.ID,
+		Filename: job.Filename,
+		Owner:    job.Owner,
+		Color:    job.Color,
+	})
+}
+
+// Complete deletes the G-code the queue kept for the job
+func (s *localSource) Complete(job *juggler.Job) error {
+	return s.queue.Done(job.ID)
+}
+
+func (s *localSource) Heartbeat(status juggler.JobStatus) error {
+	return nil
+}
+
+func (s *localSource) Reschedule() error {
+	return nil
+}
+
+// wake makes the idle daemon pick up a new job right away
+func (daemon *Daemon) wake() {
+	_ = daemon.do("wake", func() error {
+		daemon.fetchIfIdle()
+		return nil
+	})
+}
+
+// QueueHandler lists the local queue on GET and adds a job to it on POST.
+// The G-code is the "file" part of a multipart form, "owner", "color" and "priority" are optional fields
+func (daemon *Daemon) QueueHandler(w http.ResponseWriter, r *http.Request) {
+	daemon.log.Infof("Received queue handler request")
+	// Add headers to allow AJAX
+	juggler.SetHeaders(w)
+	if daemon.queue == nil {
+		http.Error(w, "Local queue is disabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		daemon.respondJSON(w, daemon.queue.List())
+	case http.MethodPost:
+		limit := daemon.settings().maxUpload()
+		tooLarge := fmt.Sprintf("Upload is larger than %d MB", limit>>20)
+		if r.ContentLength > limit {
+			http.Error(w, tooLarge, http.StatusRequestEntityTooLarge)
+			return
+		}
+		// Bodies without Content-Length are cut at the limit
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		if err := r.ParseMultipartForm(maxUploadMemory); err != nil {
+			if strings.Contains(err.Error(), errBodyTooLarge) {
+				http.Error(w, tooLarge, http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		file, header, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		priority := 0
+		if p := r.FormValue("priority"); p != "" {
+			if priority, err = strconv.Atoi(p); err != nil {
+				http.Error(w, "priority must be a number", http.StatusBadRequest)
+				return
+			}
+		}
+		job, err := daemon.queue.Add(queue.Job{
+			Filename: header.Filename,
+			Owner:    r.FormValue("owner"),
+			Color:    r.FormValue("color"),
+			Priority: priority,
+		}, file)
+		if err != nil {
+			daemon.log.Error("Failed to queue a job: ", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		daemon.log.Infof("Queued job %d (%s) of %s", job.ID, job.Filename, job.Owner)
+		daemon.wake()
+		daemon.respondJSON(w, job)
+	default:
+		http.Error(w, "Use GET or POST", http.StatusMethodNotAllowed)
+	}
+}
+
+// QueueMoveHandler puts the job "id" at "position" of the local queue
+func (daemon *Daemon) QueueMoveHandler(w http.ResponseWriter, r *http.Request) {
+	daemon.log.Infof("Received queue move handler request")
+	daemon.queueChange(w, r, "position", daemon.queue.Move)
+}
+
+// QueuePriorityHandler sets "priority" of the job "id" of the local queue
+func (daemon *Daemon) QueuePriorityHandler(w http.ResponseWriter, r *http.Request) {
+	daemon.log.Infof("Received queue priority handler request")
+	daemon.queueChange(w, r, "priority", daemon.queue.SetPriority)
+}
+
+// QueueRemoveHandler removes the job "id" from the local queue
+func (daemon *Daemon) QueueRemoveHandler(w http.ResponseWriter, r *http.Request) {
+	daemon.log.Infof("Received queue remove handler request")
+	daemon.queueChange(w, r, "", func(id, _ int) error { return daemon.queue.Remove(id) })
+}
+
+// queueChange parses "id" and the integer param (unless it is empty) and applies change to the queue
+func (daemon *Daemon) queueChange(w http.ResponseWriter, r *http.Request, param string, change func(id, value int) error) {
+	// Add headers to allow AJAX
+	juggler.SetHeaders(w)
+	if daemon.queue == nil {
+		http.Error(w, "Local queue is disabled", http.StatusServiceUnavailable)
+		return
+	}
+	id, err := strconv.Atoi(r.FormValue("id"))
+	if err != nil {
+		http.Error(w, "id must be a number", http.StatusBadRequest)
+		return
+	}
+	value := 0
+	if param != "" {
+		if value, err = strconv.Atoi(r.FormValue(param)); err != nil {
+			http.Error(w, fmt.Sprintf("%s must be a number", param), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := change(id, value); err != nil {
+		code := http.StatusInternalServerError
+		if errors.Is(err, queue.ErrNotFound) {
+			code = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+	daemon.respondJSON(w, daemon.queue.List())
+}
+
+func (daemon *Daemon) respondJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		daemon.log.Errorf("Failed to encode response: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprint(w, string(b))
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/leoleovich/3djuggler/juggler"
+	"github.com/leoleovich/3djuggler/queue"
+)
+
+// upload posts the G-code to the local queue. Content-Length is dropped if chunked is set
+func upload(t *testing.T, daemon *Daemon, gcode string, chunked bool) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", "cube.gcode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte(gcode))
+	form.WriteField("owner", "alice")
+	form.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/queue", &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	if chunked {
+		r.ContentLength = -1
+	}
+	w := httptest.NewRecorder()
+	daemon.QueueHandler(w, r)
+	return w
+}
+
+func TestQueueUploadLimit(t *testing.T) {
+	daemon := testDaemon(t, newFakePrinter(), &fakeSource{}, PrinterConfig{MaxUpload: 1})
+	var err error
+	if daemon.queue, err = queue.Open(filepath.Join(t.TempDir(), "queue")); err != nil {
+		t.Fatal(err)
+	}
+	daemon.Start()
+	settle(t, daemon)
+
+	if w := upload(t, daemon, "G28\n", false); w.Code != http.StatusOK {
+		t.Fatalf("small upload returned %d: %s", w.Code, w.Body)
+	}
+	large := strings.Repeat("G1 X1 Y1\n", 200000)
+	for _, chunked := range []bool{false, true} {
+		if w := upload(t, daemon, large, chunked); w.Code != http.StatusRequestEntityTooLarge {
+			t.Fatalf("large upload (chunked %v) returned %d, want %d", chunked, w.Code, http.StatusRequestEntityTooLarge)
+		}
+	}
+	if jobs := daemon.queue.List(); len(jobs) != 1 {
+		t.Fatalf("queue has %d jobs, want 1", len(jobs))
+	}
+}
+
+func TestLocalJobIsGivenBackWithItsGcode(t *testing.T) {
+	q, err := queue.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Add(queue.Job{Filename: "cube.gcode"}, strings.NewReader("G28\n")); err != nil {
+		t.Fatal(err)
+	}
+	src := &localSource{queue: q}
+	job, ok, err := src.Next()
+	if err != nil || !ok {
+		t.Fatalf("Next returned %v, %v", ok, err)
+	}
+
+	// After a restart without the jobfile the daemon gives back the job without its content
+	job.FileContent = ""
+	job.Status = juggler.StatusButtonTimeout
+	if err := src.Update(&job); err != nil {
+		t.Fatal(err)
+	}
+	again, ok, err := src.Next()
+	if err != nil || !ok || again.ID != job.ID || again.FileContent != "G28\n" {
+		t.Fatalf("Next returned %+v, %v, %v, want job %d with its G-code", again, ok, err, job.ID)
+	}
+
+	if err := src.Complete(&again); err != nil {
+		t.Fatal(err)
+	}
+	// The job is over, there is nothing to give back
+	if err := src.Update(&job); err == nil {
+		t.Fatal("finished job was given back")
+	}
+}
@@ -1,52 +1,234 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
 	"fmt"
+	"github.com/leoleovich/3djuggler/audit"
+	"github.com/leoleovich/3djuggler/history"
+	"github.com/leoleovich/3djuggler/hotfolder"
 	"github.com/leoleovich/3djuggler/juggler"
+	"github.com/leoleovich/3djuggler/moonraker"
+	"github.com/leoleovich/3djuggler/octoprint"
+	"github.com/leoleovich/3djuggler/prusalink"
+	"github.com/leoleovich/3djuggler/queue"
+	"github.com/leoleovich/3djuggler/webhook"
 	log "github.com/sirupsen/logrus"
-	"io"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"syscall"
 	"time"
 )
 
 var (
 	jobfile                  = "/tmp/job"
 	waitingForButtonInterval = 10 * time.Minute
+	defaultMaxUpload         = 100
 	pollingInterval          = 5 * time.Second
 	defaultListen            = "[::1]:8888"
 	defaultSerial            = "/dev/ttyACM0"
+	defaultStateFile         = "/var/lib/3djuggler/state.json"
+	defaultQueueDir          = "/var/lib/3djuggler/queue"
+	defaultHistoryFile       = "/var/lib/3djuggler/history.jsonl"
+	defaultWebhookDir        = "/var/lib/3djuggler/webhooks"
 	// Set during compilation to export version via /version http handler
 	gitCommit = ""
 )
 
+// InternEndpoint is the JobSource of intern jobs
 type InternEndpoint struct {
 	APIApp      string `json:"api_app"`
 	APIKey      string `json:"api_key"`
+	APIKeyFile  string `json:"api_key_file"`
 	APIURI      string `json:"api_uri"`
 	PrinterName string `json:"printerName"`
 	OfficeName  string `json:"officeName"`
 	job         *juggler.Job
 }
 
+// PrinterConfig is everything specific to a single printer
+type PrinterConfig struct {
+	// Name is used in /printers/{name}/... Intern printerName or "default" if empty
+	Name   string
+	Serial string
+	// Directory for per-job serial transcripts. Disabled if empty
+	TranscriptDir string
+	// Upload jobs to the SD card of the serial printer and print from there,
+	// so prints survive restarts of the host
+	SDPrint bool
+	// Watch the serial printer for prints started from its own SD card or USB drive
+	// and don't fetch jobs until they finish
+	Monitor bool
+	// Seconds between the temperature reports the serial printer is asked for (M155). Not asked if 0,
+	// temperatures are still followed if the firmware reports them on its own
+	TemperatureReport int
+	// Wait for a click on the knob of the serial printer instead of /start
+	KnobStart bool
+	// Seconds a job waits for the button before it is given back. 600 if 0
+	ButtonTimeout int
+	// Show the waiting job on the LCD of the serial printer and beep. Disabled if nil
+	Attention *Attention
+	// Where the current job is kept across restarts. /var/lib/3djuggler/state.json if empty
+	// (/var/lib/3djuggler/<name>.json with multiple printers)
+	StateFile string
+	// Printer backend: "serial" (default), "moonraker", "prusalink" or "octoprint"
+	Backend   string
+	Moonraker *moonraker.Config
+	PrusaLink *prusalink.Config
+	OctoPrint *octoprint.Config
+	// Directory of the local job queue. /var/lib/3djuggler/queue if empty
+	// (/var/lib/3djuggler/queue-<name> with multiple printers)
+	QueueDir string
+	// Megabytes a file uploaded to the local queue may have. 100 if 0
+	MaxUpload int
+	// How local jobs are merged with intern ones: "intern-first" (default), "local-first" or "alternate"
+	QueuePolicy string
+	// Directory watched for G-code files, they are treated as local jobs. Disabled if nil
+	HotFolder *hotfolder.Config
+	// What happens to the active print on SIGTERM or SIGINT: "cancel" (default), "pause" or "refuse"
+	ShutdownPolicy string
+	// Intern identity of the printer. Defaults are printerName and officeName of InternEnpoint
+	PrinterName string
+	OfficeName  string
+
+	// jobfile is where the job is stored for the printer
+	jobfile string
+}
+
 type Config struct {
 	Listen string
-	Serial string
+	// Single printer, used if Printers is empty
+	PrinterConfig
+	Printers []*PrinterConfig
 	// preserve the typo for backward compatibility
 	InternEndpoint *InternEndpoint `json:"InternEnpoint"`
+	// X-Api-Key of /config/reload. The endpoint is disabled if empty
+	AdminToken     string
+	AdminTokenFile string
+	// Where records of the jobs which are over are kept, shared by all printers. /var/lib/3djuggler/history.jsonl if empty
+	HistoryFile string
+	// Webhooks are told about status changes of the jobs of all printers
+	Webhooks []webhook.Config
+	// Where events are kept until the webhooks accept them. /var/lib/3djuggler/webhooks if empty
+	WebhookDir string
+}
+
+var validName = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// printers returns configs of all printers with defaults applied
+func (c *Config) printers() ([]*PrinterConfig, error) {
+	if len(c.Printers) == 0 {
+		single := c.PrinterConfig
+		if single.Serial == "" {
+			single.Serial = defaultSerial
+		}
+		if single.StateFile == "" {
+			single.StateFile = defaultStateFile
+		}
+		if single.QueueDir == "" {
+			single.QueueDir = defaultQueueDir
+		}
+		single.jobfile = jobfile
+		c.identity(&single)
+		single.defaults()
+		return []*PrinterConfig{&single}, nil
+	}
+
+	names := make(map[string]bool)
+	for _, p := range c.Printers {
+		c.identity(p)
+		if !validName.MatchString(p.Name) {
+			return nil, fmt.Errorf("invalid printer name %q", p.Name)
+		}
+		if names[p.Name] {
+			return nil, fmt.Errorf("duplicate printer name %q", p.Name)
+		}
+		names[p.Name] = true
+		if p.StateFile == "" {
+			p.StateFile = filepath.Join(filepath.Dir(defaultStateFile), p.Name+".json")
+		}
+		if p.QueueDir == "" {
+			p.QueueDir = defaultQueueDir + "-" + p.Name
+		}
+		p.jobfile = jobfile + "-" + p.Name
+		p.defaults()
+	}
+	return c.Printers, nil
+}
+
+func (p *PrinterConfig) buttonTimeout() time.Duration {
+	if p.ButtonTimeout <= 0 {
+		return waitingForButtonInterval
+	}
+	return time.Duration(p.ButtonTimeout) * time.Second
+}
+
+// maxUpload is the limit of the upload to the local queue in bytes
+func (p *PrinterConfig) maxUpload() int64 {
+	megabytes := p.MaxUpload
+	if megabytes <= 0 {
+		megabytes = defaultMaxUpload
+	}
+	return int64(megabytes) << 20
+}
+
+func (p *PrinterConfig) defaults() {
+	if p.Backend == "" {
+		p.Backend = backendSerial
+	}
+	if p.QueuePolicy == "" {
+		p.QueuePolicy = policyInternFirst
+	}
+	if p.ShutdownPolicy == "" {
+		p.ShutdownPolicy = shutdownCancel
+	}
+}
+
+// identity fills in the intern identity and the name of the printer
+func (c *Config) identity(p *PrinterConfig) {
+	if c.InternEndpoint != nil {
+		if p.PrinterName == "" {
+			p.PrinterName = c.InternEndpoint.PrinterName
+		}
+		if p.OfficeName == "" {
+			p.OfficeName = c.InternEndpoint.OfficeName
+		}
+	}
+	if p.Name == "" {
+		p.Name = p.PrinterName
+	}
+	if p.PrinterName == "" {
+		p.PrinterName = p.Name
+	}
+	if p.Name == "" {
+		p.Name = "default"
+	}
 }
 
 func main() {
 	var err error
-	var configFile, logFile string
-	var verbose bool
+	var configFile, logFile, auditFile string
+	var verbose, checkConfig bool
 
 	flag.StringVar(&configFile, "config", "3djuggler.json", "Main config")
 	flag.StringVar(&logFile, "log", "/var/log/3djuggler.log", "Where to log")
+	flag.StringVar(&auditFile, "audit", "/var/log/3djuggler-audit.jsonl", "Where to record status changes of jobs, disabled if empty")
 	flag.BoolVar(&verbose, "verbose", false, "Use verbose log output")
+	flag.BoolVar(&checkConfig, "check-config", false, "Validate the config and exit")
 	flag.Parse()
 
+	if checkConfig {
+		_, printers, err := loadConfig(configFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s is valid, %d printer(s)\n", configFile, len(printers))
+		return
+	}
+	log.AddHook(redactor)
+
 	if verbose {
 		log.SetLevel(log.DebugLevel)
 	} else {
@@ -62,44 +244,114 @@ func main() {
 	}
 	defer file.Close()
 
-	daemon := &Daemon{
-		config: &Config{},
-		job:    &juggler.Job{Status: juggler.StatusWaitingJob},
+	config, printers, err := loadConfig(configFile)
+	if err != nil {
+		log.Fatal(err)
 	}
+	redactor.add(config.secrets(printers))
 
-	jsonFile, err := os.Open(configFile)
-	if err != nil {
-		log.Fatalf("Can't open main config: %v", err)
+	server := &Server{listen: config.Listen, configFile: configFile, config: config}
+	if auditFile != "" {
+		server.audit, err = audit.Open(auditFile)
+		if err != nil {
+			log.Error("Audit log is disabled: ", err)
+		}
 	}
-	byteValue, err := io.ReadAll(jsonFile)
+	server.history, err = history.Open(config.HistoryFile)
 	if err != nil {
-		panic(fmt.Sprintf("Can't open main config: %v", err))
+		log.Error("History is disabled: ", err)
 	}
-	err = json.Unmarshal(byteValue, &daemon.config)
-	if err != nil {
-		panic(fmt.Sprintf("Can't decode main config: %v", err))
+	server.webhooks = openWebhooks(config.Webhooks, config.WebhookDir, nil)
+	for _, pc := range printers {
+		daemon := &Daemon{
+			config:   pc,
+			jobfile:  pc.jobfile,
+			job:      &juggler.Job{Status: juggler.StatusWaitingJob},
+			log:      log.WithField("printer", pc.Name),
+			audit:    server.audit,
+			history:  server.history,
+			webhooks: server.webhooks,
+		}
+		daemon.queue, err = queue.Open(pc.QueueDir)
+		if err != nil {
+			daemon.log.Error("Local queue is disabled: ", err)
+		}
+		daemon.sources, err = sources(config, pc, daemon.queue)
+		if err != nil {
+			log.Fatalf("Printer %s: %v", pc.Name, err)
+		}
+		if len(daemon.sources) == 0 {
+			log.Fatalf("Printer %s has no job source", pc.Name)
+		}
+		daemon.printer, err = newPrinter(pc)
+		if err != nil {
+			log.Fatalf("Printer %s: %v", pc.Name, err)
+		}
+		server.daemons = append(server.daemons, daemon)
 	}
-	jsonFile.Close()
-	fmt.Printf("config: %+v\n", daemon.config.InternEndpoint)
 
-	if daemon.config.Listen == "" {
-		daemon.config.Listen = defaultListen
+	server.Start()
+	wait(server)
+}
+
+// wait blocks until the server was stopped by SIGTERM or SIGINT and reloads the config on SIGHUP.
+// While a printer refuses to exit, the stop is retried until its print is over or the signal comes again
+func wait(server *Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	sig := <-signals
+	for ; sig == syscall.SIGHUP; sig = <-signals {
+		server.reloadAndLog()
 	}
-	if daemon.config.Serial == "" {
-		daemon.config.Serial = defaultSerial
+	log.Infof("Received %s, shutting down", sig)
+
+	retry := time.NewTicker(pollingInterval)
+	defer retry.Stop()
+	force := false
+	for !server.Stop(force) {
+		log.Warning("Waiting for the print to finish, send the signal again to cancel it")
+		select {
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				server.reloadAndLog()
+				continue
+			}
+			log.Warningf("Received %s again, cancelling the print", sig)
+			force = true
+		case <-retry.C:
+		}
 	}
+	log.Info("Bye")
+}
 
-	daemon.jobfile = jobfile
+// sources returns the job sources of the printer. fetchOrder orders them by the queue policy
+func sources(config *Config, pc *PrinterConfig, q *queue.Queue) ([]JobSource, error) {
+	var sources []JobSource
+	if config.InternEndpoint != nil {
+		sources = append(sources, newIntern(config.InternEndpoint, pc))
+	}
+	if q != nil {
+		sources = append(sources, &localSource{queue: q})
+	}
+	if pc.HotFolder != nil {
+		folder, err := hotfolder.Open(*pc.HotFolder)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, folder)
+	}
+	return sources, nil
+}
 
-	daemon.ie = &InternEndpoint{
-		APIApp: daemon.config.InternEndpoint.APIApp,
-		APIKey: daemon.config.InternEndpoint.APIKey,
-		APIURI: daemon.config.InternEndpoint.APIURI,
+// newIntern returns the intern client of the printer
+func newIntern(ie *InternEndpoint, pc *PrinterConfig) *InternEndpoint {
+	return &InternEndpoint{
+		APIApp: ie.APIApp,
+		APIKey: ie.APIKey,
+		APIURI: ie.APIURI,
 
-		PrinterName: daemon.config.InternEndpoint.PrinterName,
-		OfficeName:  daemon.config.InternEndpoint.OfficeName,
+		PrinterName: pc.PrinterName,
+		OfficeName:  pc.OfficeName,
 		job:         &juggler.Job{},
 	}
-
-	daemon.Start()
 }
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+
+	"github.com/leoleovich/3djuggler/gcodefeeder"
+	"github.com/leoleovich/3djuggler/juggler"
+	"github.com/leoleovich/3djuggler/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// internBuckets are upper bounds of the intern request duration histogram in seconds
+var internBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// Counters since the start of juggler
+var (
+	// internRequests counts every attempt of requestWithRetry by the HTTP code or "error" if there was no response
+	internRequests = metrics.NewCounterVec("action", "code")
+	internDuration = metrics.NewHistogramVec(internBuckets, "action")
+	// internErrors counts requests which failed after all retries
+	internErrors   = metrics.NewCounterVec("action")
+	buttonTimeouts = metrics.NewCounterVec("printer")
+	jobsTotal      = metrics.NewCounterVec("printer", "outcome")
+)
+
+// MetricsHandler gives metrics of juggler and its printers in the Prometheus text format
+func (s *Server) MetricsHandler(w http.ResponseWriter, _ *http.Request) {
+	log.Debugf("Received metrics handler request")
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	out := metrics.NewWriter(w)
+	out.Family("juggler_build_info", metrics.Gauge, "Commit and Go version juggler was built with")
+	out.Sample("juggler_build_info", 1, "commit", gitCommit, "go_version", runtime.Version())
+
+	out.Family("juggler_job_status", metrics.Gauge, "Status of the job, 1 for the current one")
+	for _, daemon := range s.daemons {
+		current := daemon.Job().Status
+		for _, status := range juggler.Statuses {
+			value := 0.0
+			if status == current {
+				value = 1
+			}
+			out.Sample("juggler_job_status", value, "printer", daemon.settings().Name, "status", string(status))
+		}
+	}
+
+	out.Family("juggler_job_progress_percent", metrics.Gauge, "Progress of the current print")
+	for _, daemon := range s.daemons {
+		out.Sample("juggler_job_progress_percent", daemon.Job().Progress, "printer", daemon.settings().Name)
+	}
+
+	out.Family("juggler_temperature_celsius", metrics.Gauge, "Temperature of the heater, reported while juggler follows a print")
+	for _, daemon := range s.daemons {
+		if t, ok := daemon.temperatures(); ok {
+			name := daemon.settings().Name
+			out.Sample("juggler_temperature_celsius", t.Hotend, "printer", name, "heater", "hotend")
+			out.Sample("juggler_temperature_celsius", t.Bed, "printer", name, "heater", "bed")
+		}
+	}
+	out.Family("juggler_temperature_target_celsius", metrics.Gauge, "Target temperature of the heater, reported while juggler follows a print")
+	for _, daemon := range s.daemons {
+		if t, ok := daemon.temperatures(); ok {
+			name := daemon.settings().Name
+			out.Sample("juggler_temperature_target_celsius", t.HotendTarget, "printer", name, "heater", "hotend")
+			out.Sample("juggler_temperature_target_celsius", t.BedTarget, "printer", name, "heater", "bed")
+		}
+	}
+
+	out.Family("juggler_feeder_ack_latency_seconds", metrics.Histogram, "Time from sending a command to the printer until its ok")
+	bounds := make([]float64, len(gcodefeeder.LatencyBuckets))
+	for i, bucket := range gcodefeeder.LatencyBuckets {
+		bounds[i] = bucket.Seconds()
+	}
+	for _, daemon := range s.daemons {
+		p, ok := daemon.printer.(latencyPrinter)
+		if !ok {
+			continue
+		}
+		h := p.AckLatency()
+		counts := make([]uint64, len(bounds)+1)
+		for i, c := range h.Counts {
+			counts[i] = uint64(c)
+		}
+		out.Histogram("juggler_feeder_ack_latency_seconds", bounds, counts, h.Sum.Seconds(), "printer", daemon.settings().Name)
+	}
+
+	out.Family("juggler_intern_requests_total", metrics.Counter, "Requests to intern including retries by the HTTP code, error if there was no response")
+	internRequests.Write(out, "juggler_intern_requests_total")
+	out.Family("juggler_intern_request_duration_seconds", metrics.Histogram, "Duration of requests to intern including retries")
+	internDuration.Write(out, "juggler_intern_request_duration_seconds")
+	out.Family("juggler_intern_request_errors_total", metrics.Counter, "Requests to intern which failed after all retries")
+	internErrors.Write(out, "juggler_intern_request_errors_total")
+
+	out.Family("juggler_button_timeouts_total", metrics.Counter, "Jobs nobody started on time")
+	buttonTimeouts.Write(out, "juggler_button_timeouts_total")
+	out.Family("juggler_jobs_total", metrics.Counter, "Jobs which are over by the outcome")
+	jobsTotal.Write(out, "juggler_jobs_total")
+
+	if err := out.Flush(); err != nil {
+		log.Error("Failed to write metrics: ", err)
+	}
+}
+
+// temperatures of the printer if it reports them
+func (daemon *Daemon) temperatures() (gcodefeeder.Temperatures, bool) {
+	p, ok := daemon.printer.(temperaturePrinter)
+	if !ok {
+		return gcodefeeder.Temperatures{}, false
+	}
+	return p.Temperatures()
+}
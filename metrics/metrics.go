@@ -0,0 +1,197 @@
+// Package metrics writes the Prometheus text exposition format. Only what juggler needs is implemented:
+// counters and histograms with label values, gauges are written directly
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Types of metric families
+const (
+	Counter   = "counter"
+	Gauge     = "gauge"
+	Histogram = "histogram"
+)
+
+// Writer writes metric families. Samples of a family must follow its Family call
+type Writer struct {
+	w *bufio.Writer
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// Family writes the HELP and TYPE lines of the metric
+func (w *Writer) Family(name, typ, help string) {
+	help = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+	fmt.Fprintf(w.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// Sample writes a value. labels are pairs of names and values
+func (w *Writer) Sample(name string, value float64, labels ...string) {
+	w.w.WriteString(name)
+	writeLabels(w.w, labels)
+	w.w.WriteByte(' ')
+	w.w.WriteString(formatFloat(value))
+	w.w.WriteByte('\n')
+}
+
+// Histogram writes the _bucket, _sum and _count samples. bounds are the upper bounds of the buckets,
+// counts has one extra element for the observations above the last bound. Counts are not cumulative
+func (w *Writer) Histogram(name string, bounds []float64, counts []uint64, sum float64, labels ...string) {
+	var total uint64
+	for i, bound := range bounds {
+		total += counts[i]
+		w.Sample(name+"_bucket", float64(total), append(labels[:len(labels):len(labels)], "le", formatFloat(bound))...)
+	}
+	total += counts[len(bounds)]
+	w.Sample(name+"_bucket", float64(total), append(labels[:len(labels):len(labels)], "le", "+Inf")...)
+	w.Sample(name+"_sum", sum, labels...)
+	w.Sample(name+"_count", float64(total), labels...)
+}
+
+// Flush writes the buffered metrics
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeLabels(w *bufio.Writer, labels []string) {
+	if len(labels) == 0 {
+		return
+	}
+	w.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			w.WriteByte(',')
+		}
+		fmt.Fprintf(w, `%s="%s"`, labels[i], labelEscaper.Replace(labels[i+1]))
+	}
+	w.WriteByte('}')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// vec keeps a value per combination of label values. It is safe for concurrent use
+type vec struct {
+	labels []string
+
+	mu     sync.Mutex
+	values map[string][]string
+}
+
+// key joins the label values with a byte which can't be in UTF-8 text
+func (v *vec) key(values []string) string {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %d label values for %d labels", len(values), len(v.labels)))
+	}
+	key := strings.Join(values, "\xff")
+	if _, ok := v.values[key]; !ok {
+		v.values[key] = append([]string(nil), values...)
+	}
+	return key
+}
+
+// sorted returns the keys in order, so the output is stable
+func (v *vec) sorted() []string {
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// pairs returns the label names and values of the key
+func (v *vec) pairs(key string) []string {
+	pairs := make([]string, 0, 2*len(v.labels))
+	for i, value := range v.values[key] {
+		pairs = append(pairs, v.labels[i], value)
+	}
+	return pairs
+}
+
+// CounterVec counts events by label values
+type CounterVec struct {
+	vec
+	counts map[string]float64
+}
+
+func NewCounterVec(labels ...string) *CounterVec {
+	return &CounterVec{vec: vec{labels: labels, values: make(map[string][]string)}, counts: make(map[string]float64)}
+}
+
+// Inc adds one to the counter of the label values
+func (c *CounterVec) Inc(values ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.counts[c.key(values)]++
+}
+
+// Write writes the samples of the counters. The family is written by the caller
+func (c *CounterVec) Write(w *Writer, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range c.sorted() {
+		w.Sample(name, c.counts[key], c.pairs(key)...)
+	}
+}
+
+// HistogramVec counts observations in fixed buckets by label values
+type HistogramVec struct {
+	vec
+	bounds []float64
+	counts map[string][]uint64
+	sums   map[string]float64
+}
+
+// NewHistogramVec makes histograms with bounds as the upper bounds of their buckets
+func NewHistogramVec(bounds []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{
+		vec:    vec{labels: labels, values: make(map[string][]string)},
+		bounds: bounds,
+		counts: make(map[string][]uint64),
+		sums:   make(map[string]float64),
+	}
+}
+
+// Observe adds value to the histogram of the label values
+func (h *HistogramVec) Observe(value float64, values ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := h.key(values)
+	counts, ok := h.counts[key]
+	if !ok {
+		counts = make([]uint64, len(h.bounds)+1)
+		h.counts[key] = counts
+	}
+	i := sort.SearchFloat64s(h.bounds, value)
+	counts[i]++
+	h.sums[key] += value
+}
+
+// Write writes the samples of the histograms. The family is written by the caller
+func (h *HistogramVec) Write(w *Writer, name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, key := range h.sorted() {
+		w.Histogram(name, h.bounds, h.counts[key], h.sums[key], h.pairs(key)...)
+	}
+}
@@ -0,0 +1,93 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func write(t *testing.T, fn func(w *Writer)) string {
+	t.Helper()
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	fn(w)
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestEscaping(t *testing.T) {
+	got := write(t, func(w *Writer) {
+		w.Family("juggler_up", Gauge, "Help with \\ and\nnewline")
+		w.Sample("juggler_up", 1, "printer", `mk3 "office\1"`+"\n", "source", "intern")
+	})
+	want := `# HELP juggler_up Help with \\ and\nnewline
+# TYPE juggler_up gauge
+juggler_up{printer="mk3 \"office\\1\"\n",source="intern"} 1
+`
+	if got != want {
+		t.Fatalf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestCounterVec(t *testing.T) {
+	c := NewCounterVec("printer", "outcome")
+	c.Inc("mk3", "finished")
+	c.Inc("mk3", "cancelled")
+	c.Inc("mk3", "finished")
+	got := write(t, func(w *Writer) {
+		w.Family("juggler_jobs_total", Counter, "Jobs by outcome")
+		c.Write(w, "juggler_jobs_total")
+	})
+	want := `# HELP juggler_jobs_total Jobs by outcome
+# TYPE juggler_jobs_total counter
+juggler_jobs_total{printer="mk3",outcome="cancelled"} 1
+juggler_jobs_total{printer="mk3",outcome="finished"} 2
+`
+	if got != want {
+		t.Fatalf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	h := NewHistogramVec([]float64{1, 5}, "printer")
+	// Values equal to a bound belong to its bucket, le is "less or equal"
+	for _, v := range []float64{0.5, 1, 3, 5, 10} {
+		h.Observe(v, "mk3")
+	}
+	h.Observe(2, "mk4")
+	got := write(t, func(w *Writer) {
+		w.Family("juggler_wait_seconds", Histogram, "Wait")
+		h.Write(w, "juggler_wait_seconds")
+	})
+	want := `# HELP juggler_wait_seconds Wait
+# TYPE juggler_wait_seconds histogram
+juggler_wait_seconds_bucket{printer="mk3",le="1"} 2
+juggler_wait_seconds_bucket{printer="mk3",le="5"} 4
+juggler_wait_seconds_bucket{printer="mk3",le="+Inf"} 5
+juggler_wait_seconds_sum{printer="mk3"} 19.5
+juggler_wait_seconds_count{printer="mk3"} 5
+juggler_wait_seconds_bucket{printer="mk4",le="1"} 0
+juggler_wait_seconds_bucket{printer="mk4",le="5"} 1
+juggler_wait_seconds_bucket{printer="mk4",le="+Inf"} 1
+juggler_wait_seconds_sum{printer="mk4"} 2
+juggler_wait_seconds_count{printer="mk4"} 1
+`
+	if got != want {
+		t.Fatalf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestHistogramWithoutLabels(t *testing.T) {
+	got := write(t, func(w *Writer) {
+		w.Histogram("juggler_ack_seconds", []float64{0.1}, []uint64{3, 1}, 1.25)
+	})
+	want := `juggler_ack_seconds_bucket{le="0.1"} 3
+juggler_ack_seconds_bucket{le="+Inf"} 4
+juggler_ack_seconds_sum 1.25
+juggler_ack_seconds_count 4
+`
+	if got != want {
+		t.Fatalf("got\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,183 @@
+// Package moonraker drives Klipper printers through the Moonraker API
+package moonraker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/leoleovich/3djuggler/internal/upload"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const requestTimeout = 60 * time.Second
+
+type Config struct {
+	// URL of Moonraker, e.g. http://voron.local:7125
+	URL    string `json:"url"`
+	APIKey string `json:"api_key"`
+	// APIKeyFile is read into APIKey by juggler, so the key is not kept in its config
+	APIKeyFile string `json:"api_key_file"`
+}
+
+// PrintStats mirrors the print_stats and virtual_sdcard Klipper objects and the temperatures of extruder and heater_bed.
+// Fields are pointers because websocket notifications only contain changed fields
+type PrintStats struct {
+	State    *string  `json:"state"`
+	Message  *string  `json:"message"`
+	Filename *string  `json:"filename"`
+	Progress *float64 `json:"progress"`
+
+	Extruder  heater `json:"-"`
+	HeaterBed heater `json:"-"`
+}
+
+// heater mirrors the extruder and heater_bed Klipper objects
+type heater struct {
+	Temperature *float64 `json:"temperature"`
+	Target      *float64 `json:"target"`
+}
+
+// objects is the status part of objects.query responses and notify_status_update notifications
+type objects struct {
+	PrintStats    *PrintStats `json:"print_stats"`
+	VirtualSDCard *struct {
+		Progress *float64 `json:"progress"`
+	} `json:"virtual_sdcard"`
+	Extruder  *heater `json:"extruder"`
+	HeaterBed *heater `json:"heater_bed"`
+}
+
+func (o objects) merge() PrintStats {
+	var s PrintStats
+	if o.PrintStats != nil {
+		s = *o.PrintStats
+	}
+	if o.VirtualSDCard != nil {
+		s.Progress = o.VirtualSDCard.Progress
+	}
+	if o.Extruder != nil {
+		s.Extruder = *o.Extruder
+	}
+	if o.HeaterBed != nil {
+		s.HeaterBed = *o.HeaterBed
+	}
+	return s
+}
+
+type Client struct {
+	config Config
+	http   *http.Client
+	// upload has no timeout for the whole request, large files take long on slow links
+	upload *http.Client
+}
+
+func NewClient(config Config) *Client {
+	return &Client{
+		config: config,
+		http:   &http.Client{Timeout: requestTimeout},
+		upload: upload.NewClient(),
+	}
+}
+
+func (c *Client) do(req *http.Request, result interface{}) error {
+	return c.send(c.http, req, result)
+}
+
+func (c *Client) send(client *http.Client, req *http.Request, result interface{}) error {
+	if c.config.APIKey != "" {
+		req.Header.Set("X-Api-Key", c.config.APIKey)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("moonraker %s %s: %d %s", req.Method, req.URL.Path, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func (c *Client) post(ctx context.Context, path string, query url.Values) error {
+	u := c.config.URL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, nil)
+	if err != nil {
+		return err
+	}
+	return c.do(req, nil)
+}
+
+// Upload streams the gcode into the gcodes root under name. It fails once the upload stalls
+func (c *Client) Upload(ctx context.Context, name string, content io.Reader) error {
+	body, contentType := upload.Multipart(name, content, upload.Field{Name: "root", Value: "gcodes"})
+	ctx, body, stop := upload.Watch(ctx, body, upload.IdleTimeout)
+	defer stop()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.config.URL+"/server/files/upload", body)
+	if err != nil {
+		body.Close()
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	return c.send(c.upload, req, nil)
+}
+
+// Start prints a previously uploaded file
+func (c *Client) Start(ctx context.Context, name string) error {
+	return c.post(ctx, "/printer/print/start", url.Values{"filename": {name}})
+}
+
+func (c *Client) Pause(ctx context.Context) error {
+	return c.post(ctx, "/printer/print/pause", nil)
+}
+
+func (c *Client) Resume(ctx context.Context) error {
+	return c.post(ctx, "/printer/print/resume", nil)
+}
+
+func (c *Client) Cancel(ctx context.Context) error {
+	return c.post(ctx, "/printer/print/cancel", nil)
+}
+
+// EmergencyStop shuts Klipper down immediately, it needs FIRMWARE_RESTART afterwards
+func (c *Client) EmergencyStop(ctx context.Context) error {
+	return c.post(ctx, "/printer/emergency_stop", nil)
+}
+
+// Query returns the current print_stats, virtual_sdcard, extruder and heater_bed objects
+func (c *Client) Query(ctx context.Context) (PrintStats, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.config.URL+"/printer/objects/query?print_stats&virtual_sdcard&extruder=temperature,target&heater_bed=temperature,target", nil)
+	if err != nil {
+		return PrintStats{}, err
+	}
+	var result struct {
+		Result struct {
+			Status objects `json:"status"`
+		} `json:"result"`
+	}
+	if err := c.do(req, &result); err != nil {
+		return PrintStats{}, err
+	}
+	return result.Result.Status.merge(), nil
+}
+
+// websocketURL converts the http(s) API address into the websocket one
+func (c *Client) websocketURL() string {
+	u := c.config.URL
+	if strings.HasPrefix(u, "https://") {
+		u = "wss://" + strings.TrimPrefix(u, "https://")
+	} else {
+		u = "ws://" + strings.TrimPrefix(u, "http://")
+	}
+	return strings.TrimSuffix(u, "/") + "/websocket"
+}
@@ -0,0 +1,333 @@
+package moonraker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/leoleovich/3djuggler/gcodefeeder"
+	"github.com/leoleovich/3djuggler/internal/websocket"
+	"github.com/leoleovich/3djuggler/juggler"
+	log "github.com/sirupsen/logrus"
+)
+
+// pollingInterval is used when the websocket is not available
+const pollingInterval = 2 * time.Second
+
+// Printer runs jobs on a Klipper printer and follows them through Moonraker notifications
+type Printer struct {
+	client *Client
+
+	mu       sync.Mutex
+	status   gcodefeeder.Status
+	progress float64
+	message  string
+	temps    gcodefeeder.Temperatures
+	stop     context.CancelFunc
+}
+
+func NewPrinter(config Config) *Printer {
+	return &Printer{
+		client: NewClient(config),
+		status: gcodefeeder.Ready,
+	}
+}
+
+// Print uploads the job and starts it
+func (p *Printer) Print(job *juggler.Job, jobfile string) error {
+	file, err := os.Open(jobfile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	name := fmt.Sprintf("3djuggler-%d-%s", job.ID, filepath.Base(job.Filename))
+	if err := p.client.Upload(context.Background(), name, file); err != nil {
+		return fmt.Errorf("failed to upload %s: %w", name, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	if err := p.client.Start(ctx, name); err != nil {
+		return fmt.Errorf("failed to start %s: %w", name, err)
+	}
+
+	watchCtx, stop := context.WithCancel(context.Background())
+	p.mu.Lock()
+	if p.stop != nil {
+		p.stop()
+	}
+	p.stop = stop
+	p.status = gcodefeeder.Printing
+	p.progress = 0
+	p.message = ""
+	p.mu.Unlock()
+
+	go p.watch(watchCtx)
+	return nil
+}
+
+// Attach follows the print which is already running on the printer, e.g. after a restart of the daemon.
+// It returns false if nothing is printing
+func (p *Printer) Attach() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	s, err := p.client.Query(ctx)
+	if err != nil {
+		return false, err
+	}
+	if s.State == nil {
+		return false, nil
+	}
+	if status := StatusFromState(*s.State); status == gcodefeeder.Ready || status.Terminal() {
+		return false, nil
+	}
+
+	watchCtx, stop := context.WithCancel(context.Background())
+	p.mu.Lock()
+	if p.stop != nil {
+		p.stop()
+	}
+	p.stop = stop
+	p.message = ""
+	p.mu.Unlock()
+	p.update(s)
+
+	go p.watch(watchCtx)
+	return true, nil
+}
+
+func (p *Printer) Pause() error {
+	return p.client.Pause(context.Background())
+}
+
+func (p *Printer) Resume() error {
+	return p.client.Resume(context.Background())
+}
+
+func (p *Printer) Cancel() error {
+	p.mu.Lock()
+	active := p.stop != nil && !p.status.Terminal()
+	p.mu.Unlock()
+	if !active {
+		return nil
+	}
+	return p.client.Cancel(context.Background())
+}
+
+func (p *Printer) EmergencyStop() error {
+	return p.client.EmergencyStop(context.Background())
+}
+
+func (p *Printer) Status() gcodefeeder.Status {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status
+}
+
+func (p *Printer) Progress() float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.progress
+}
+
+// Message is the last print_stats message, usually set by Klipper on errors
+func (p *Printer) Message() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.message
+}
+
+// Temperatures are the last ones Klipper reported. ok is false unless a print is followed
+func (p *Printer) Temperatures() (gcodefeeder.Temperatures, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.temps, p.stop != nil && !p.status.Terminal()
+}
+
+func setTemperature(h heater, current, target *float64) {
+	if h.Temperature != nil {
+		*current = *h.Temperature
+	}
+	if h.Target != nil {
+		*target = *h.Target
+	}
+}
+
+// StatusFromState maps the print_stats state onto feeder statuses
+func StatusFromState(state string) gcodefeeder.Status {
+	switch state {
+	case "standby":
+		return gcodefeeder.Ready
+	case "printing":
+		return gcodefeeder.Printing
+	case "paused":
+		return gcodefeeder.ManuallyPaused
+	case "complete":
+		return gcodefeeder.Finished
+	case "cancelled":
+		return gcodefeeder.Cancelled
+	default:
+		return gcodefeeder.Error
+	}
+}
+
+// update applies a (partial) status update. It returns false once the print is over
+func (p *Printer) update(s PrintStats) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if s.State != nil {
+		status := StatusFromState(*s.State)
+		// Klipper reports "standby" for a moment after the print was started
+		if status != gcodefeeder.Ready && status != p.status {
+			log.Debugf("Moonraker: status %s -> %s", p.status, status)
+			p.status = status
+		}
+	}
+	if s.Progress != nil {
+		p.progress = *s.Progress * 100
+	}
+	if s.Message != nil && *s.Message != "" {
+		p.message = *s.Message
+	}
+	setTemperature(s.Extruder, &p.temps.Hotend, &p.temps.HotendTarget)
+	setTemperature(s.HeaterBed, &p.temps.Bed, &p.temps.BedTarget)
+	return !p.status.Terminal()
+}
+
+// watch follows the print until it is over, preferring websocket notifications over polling
+func (p *Printer) watch(ctx context.Context) {
+	for ctx.Err() == nil {
+		err := p.subscribe(ctx)
+		if err == nil {
+			return
+		}
+		log.Warning("Moonraker: websocket failed, polling instead: ", err)
+		if p.poll(ctx) {
+			return
+		}
+	}
+}
+
+// poll queries the status until the print is over or the websocket might work again
+func (p *Printer) poll(ctx context.Context) bool {
+	ticker := time.NewTicker(pollingInterval)
+	defer ticker.Stop()
+	for i := 0; i < 30; i++ {
+		select {
+		case <-ctx.Done():
+			return true
+		case <-ticker.C:
+		}
+		s, err := p.client.Query(ctx)
+		if err != nil {
+			log.Error("Moonraker: ", err)
+			continue
+		}
+		if !p.update(s) {
+			return true
+		}
+	}
+	return false
+}
+
+type rpcRequest struct {
+	JSONRPC string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params,omitempty"`
+	ID      int         `json:"id"`
+}
+
+type rpcMessage struct {
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+	Result *struct {
+		Status objects `json:"status"`
+	} `json:"result"`
+	Error *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// subscribe listens to notify_status_update until the print is over. It returns nil once it is
+func (p *Printer) subscribe(ctx context.Context) error {
+	header := http.Header{}
+	if p.client.config.APIKey != "" {
+		header.Set("X-Api-Key", p.client.config.APIKey)
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, requestTimeout)
+	conn, err := websocket.Dial(dialCtx, p.client.websocketURL(), header)
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	req, err := json.Marshal(rpcRequest{
+		JSONRPC: "2.0",
+		Method:  "printer.objects.subscribe",
+		Params: map[string]interface{}{
+			"objects": map[string]interface{}{
+				"print_stats":    nil,
+				"virtual_sdcard": nil,
+				"extruder":       []string{"temperature", "target"},
+				"heater_bed":     []string{"temperature", "target"},
+			},
+		},
+		ID: 1,
+	})
+	if err != nil {
+		return err
+	}
+	if err := conn.WriteMessage(req); err != nil {
+		return err
+	}
+
+	for {
+		data, err := conn.ReadMessage()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		var msg rpcMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			log.Debug("Moonraker: ignoring malformed message: ", err)
+			continue
+		}
+		var status objects
+		switch {
+		case msg.Error != nil:
+			return fmt.Errorf("subscribe failed: %s", msg.Error.Message)
+		case msg.Result != nil:
+			// Response to the subscription contains the full status
+			status = msg.Result.Status
+		case msg.Method == "notify_status_update" && len(msg.Params) > 0:
+			if err := json.Unmarshal(msg.Params[0], &status); err != nil {
+				log.Debug("Moonraker: ignoring malformed notification: ", err)
+				continue
+			}
+		case msg.Method == "notify_klippy_shutdown":
+			p.update(PrintStats{State: stringPtr("error"), Message: stringPtr("Klipper shutdown")})
+			return nil
+		default:
+			continue
+		}
+		if !p.update(status.merge()) {
+			return nil
+		}
+	}
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
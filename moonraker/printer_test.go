@@ -0,0 +1,22 @@
+package moonraker
+
+import (
+	"testing"
+
+	"github.com/leoleovich/3djuggler/gcodefeeder"
+)
+
+func TestStatusFromState(t *testing.T) {
+	for state, want := range map[string]gcodefeeder.Status{
+		"standby":   gcodefeeder.Ready,
+		"printing":  gcodefeeder.Printing,
+		"paused":    gcodefeeder.ManuallyPaused,
+		"complete":  gcodefeeder.Finished,
+		"cancelled": gcodefeeder.Cancelled,
+		"error":     gcodefeeder.Error,
+	} {
+		if got := StatusFromState(state); got != want {
+			t.Errorf("%s: got %s, want %s", state, got, want)
+		}
+	}
+}
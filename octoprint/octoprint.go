@@ -0,0 +1,327 @@
+// Package octoprint drives printers attached to OctoPrint through its REST API
+package octoprint
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leoleovich/3djuggler/gcodefeeder"
+	"github.com/leoleovich/3djuggler/internal/upload"
+	"github.com/leoleovich/3djuggler/juggler"
+	log "github.com/sirupsen/logrus"
+)
+
+const requestTimeout = 60 * time.Second
+const pollingInterval = 2 * time.Second
+
+// startTimeout is how long the print may take to show up after the upload
+const startTimeout = 2 * time.Minute
+
+type Config struct {
+	// URL of OctoPrint, e.g. http://octopi.local
+	URL    string `json:"url"`
+	APIKey string `json:"api_key"`
+	// APIKeyFile is read into APIKey by juggler, so the key is not kept in its config
+	APIKeyFile string `json:"api_key_file"`
+}
+
+// Job is the subset of /api/job we care about
+type Job struct {
+	State    string `json:"state"`
+	Progress struct {
+		Completion *float64 `json:"completion"`
+	} `json:"progress"`
+	Error string `json:"error"`
+}
+
+type Client struct {
+	config Config
+	http   *http.Client
+	// upload has no timeout for the whole request, large files take long on slow links
+	upload *http.Client
+}
+
+func NewClient(config Config) *Client {
+	return &Client{config: config, http: &http.Client{Timeout: requestTimeout}, upload: upload.NewClient()}
+}
+
+func (c *Client) do(req *http.Request, result interface{}) error {
+	return c.send(c.http, req, result)
+}
+
+func (c *Client) send(client *http.Client, req *http.Request, result interface{}) error {
+	req.Header.Set("X-Api-Key", c.config.APIKey)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("octoprint %s %s: %d %s", req.Method, req.URL.Path, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	if result == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// UploadAndPrint streams the file into the local storage of OctoPrint and starts printing it.
+// It fails once the upload stalls
+func (c *Client) UploadAndPrint(ctx context.Context, name string, content io.Reader) error {
+	body, contentType := upload.Multipart(name, content, upload.Field{Name: "select", Value: "true"}, upload.Field{Name: "print", Value: "true"})
+	ctx, body, stop := upload.Watch(ctx, body, upload.IdleTimeout)
+	defer stop()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.config.URL+"/api/files/local", body)
+	if err != nil {
+		body.Close()
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	return c.send(c.upload, req, nil)
+}
+
+func (c *Client) Job(ctx context.Context) (Job, error) {
+	var job Job
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.config.URL+"/api/job", nil)
+	if err != nil {
+		return job, err
+	}
+	err = c.do(req, &job)
+	return job, err
+}
+
+// command issues a job command, e.g. {"command": "cancel"}
+func (c *Client) command(ctx context.Context, cmd map[string]string) error {
+	b, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.config.URL+"/api/job", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return c.do(req, nil)
+}
+
+// EmergencyStop sends M112 to the printer
+func (c *Client) EmergencyStop(ctx context.Context) error {
+	b, err := json.Marshal(map[string][]string{"commands": {"M112"}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.config.URL+"/api/printer/command", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return c.do(req, nil)
+}
+
+func (c *Client) Pause(ctx context.Context) error {
+	return c.command(ctx, map[string]string{"command": "pause", "action": "pause"})
+}
+
+func (c *Client) Resume(ctx context.Context) error {
+	return c.command(ctx, map[string]string{"command": "pause", "action": "resume"})
+}
+
+func (c *Client) Cancel(ctx context.Context) error {
+	return c.command(ctx, map[string]string{"command": "cancel"})
+}
+
+// StatusFromState maps the OctoPrint job state onto feeder statuses.
+// OctoPrint goes back to "Operational" after the print, so it maps to Finished. update tells cancelled prints apart
+func StatusFromState(state string) gcodefeeder.Status {
+	switch {
+	case strings.HasPrefix(state, "Printing"), state == "Starting", state == "Finishing", state == "Cancelling", state == "Resuming":
+		return gcodefeeder.Printing
+	case state == "Paused", state == "Pausing":
+		return gcodefeeder.ManuallyPaused
+	case state == "Operational":
+		return gcodefeeder.Finished
+	case strings.HasPrefix(state, "Offline"), strings.HasPrefix(state, "Error"):
+		return gcodefeeder.Error
+	default:
+		return gcodefeeder.Connecting
+	}
+}
+
+// Printer runs jobs through OctoPrint and polls their status
+type Printer struct {
+	client *Client
+
+	mu       sync.Mutex
+	status   gcodefeeder.Status
+	progress float64
+	// started is set once the printer reported our print, until then it may still report the previous one.
+	// sent is when the print was sent, it fails if it doesn't start within startTimeout
+	started bool
+	sent    time.Time
+	// cancelling is set once OctoPrint reported "Cancelling" for our print
+	cancelling bool
+	stop       context.CancelFunc
+}
+
+func NewPrinter(config Config) *Printer {
+	return &Printer{client: NewClient(config), status: gcodefeeder.Ready}
+}
+
+func (p *Printer) Print(job *juggler.Job, jobfile string) error {
+	file, err := os.Open(jobfile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	name := fmt.Sprintf("3djuggler-%d-%s", job.ID, filepath.Base(job.Filename))
+	if err := p.client.UploadAndPrint(context.Background(), name, file); err != nil {
+		return fmt.Errorf("failed to upload %s: %w", name, err)
+	}
+
+	watchCtx, stop := context.WithCancel(context.Background())
+	p.mu.Lock()
+	if p.stop != nil {
+		p.stop()
+	}
+	p.stop = stop
+	p.status = gcodefeeder.Printing
+	p.progress = 0
+	p.started = false
+	p.sent = time.Now()
+	p.cancelling = false
+	p.mu.Unlock()
+
+	go p.watch(watchCtx)
+	return nil
+}
+
+// Attach follows the print which is already running on the printer, e.g. after a restart of the daemon.
+// It returns false if nothing is printing
+func (p *Printer) Attach() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	job, err := p.client.Job(ctx)
+	if err != nil {
+		return false, err
+	}
+	if status := StatusFromState(job.State); status == gcodefeeder.Connecting || status.Terminal() {
+		return false, nil
+	}
+
+	watchCtx, stop := context.WithCancel(context.Background())
+	p.mu.Lock()
+	if p.stop != nil {
+		p.stop()
+	}
+	p.stop = stop
+	p.started = true
+	p.cancelling = false
+	p.mu.Unlock()
+	p.update(job)
+
+	go p.watch(watchCtx)
+	return true, nil
+}
+
+func (p *Printer) Pause() error {
+	return p.client.Pause(context.Background())
+}
+
+func (p *Printer) Resume() error {
+	return p.client.Resume(context.Background())
+}
+
+func (p *Printer) Cancel() error {
+	// Don't stop a print which is not ours
+	if status := p.Status(); status == gcodefeeder.Ready || status.Terminal() {
+		return nil
+	}
+	return p.client.Cancel(context.Background())
+}
+
+func (p *Printer) EmergencyStop() error {
+	return p.client.EmergencyStop(context.Background())
+}
+
+func (p *Printer) Status() gcodefeeder.Status {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status
+}
+
+func (p *Printer) Progress() float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.progress
+}
+
+// update applies the polled job. It returns false once the print is over
+func (p *Printer) update(job Job) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status := StatusFromState(job.State)
+	// OctoPrint is "Operational" for a moment after the upload, before the print starts
+	if !p.started {
+		if status == gcodefeeder.Connecting || status == gcodefeeder.Finished {
+			if time.Since(p.sent) < startTimeout {
+				return true
+			}
+			// The print never showed up, OctoPrint refused it or it was cancelled at once
+			if status == gcodefeeder.Connecting {
+				status = gcodefeeder.Error
+			} else {
+				status = gcodefeeder.Cancelled
+			}
+			log.Warningf("OctoPrint: print did not start in %s, printer is %s", startTimeout, job.State)
+			p.status = status
+			return false
+		}
+		p.started = true
+	}
+	if job.Progress.Completion != nil {
+		p.progress = *job.Progress.Completion
+	}
+	if job.State == "Cancelling" {
+		p.cancelling = true
+	}
+	// Operational doesn't tell a completed print from a cancelled one, the completion and Cancelling do
+	if status == gcodefeeder.Finished && (p.cancelling || job.Progress.Completion == nil || *job.Progress.Completion < 100) {
+		status = gcodefeeder.Cancelled
+	}
+	if status != gcodefeeder.Connecting && status != p.status {
+		log.Debugf("OctoPrint: status %s -> %s", p.status, status)
+		p.status = status
+	}
+	return !p.status.Terminal()
+}
+
+func (p *Printer) watch(ctx context.Context) {
+	ticker := time.NewTicker(pollingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		job, err := p.client.Job(ctx)
+		if err != nil {
+			log.Error("OctoPrint: ", err)
+			continue
+		}
+		if !p.update(job) {
+			return
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package octoprint
+
+import (
+	"testing"
+	"time"
+
+	"github.com/leoleovich/3djuggler/gcodefeeder"
+)
+
+func job(state string, completion float64) Job {
+	j := Job{State: state}
+	j.Progress.Completion = &completion
+	return j
+}
+
+func TestUpdateTellsCancelledFromFinished(t *testing.T) {
+	tests := []struct {
+		name string
+		jobs []Job
+		// sent is how long ago the print was sent
+		sent time.Duration
+		want gcodefeeder.Status
+	}{
+		{"completed", []Job{job("Printing", 50), job("Printing", 100), job("Operational", 100)}, 0, gcodefeeder.Finished},
+		{"cancelled in the UI", []Job{job("Printing", 50), job("Operational", 50)}, 0, gcodefeeder.Cancelled},
+		{"cancelled at the end", []Job{job("Printing", 99), job("Cancelling", 100), job("Operational", 100)}, 0, gcodefeeder.Cancelled},
+		{"previous print", []Job{job("Operational", 100)}, 0, gcodefeeder.Printing},
+		{"never started", []Job{job("Operational", 100)}, startTimeout, gcodefeeder.Cancelled},
+		{"never connected", []Job{job("Detecting serial connection", 0)}, startTimeout, gcodefeeder.Error},
+	}
+	for _, tt := range tests {
+		p := NewPrinter(Config{})
+		p.status = gcodefeeder.Printing
+		p.sent = time.Now().Add(-tt.sent)
+		for _, j := range tt.jobs {
+			p.update(j)
+		}
+		if got := p.Status(); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/leoleovich/3djuggler/gcodefeeder"
+	"github.com/leoleovich/3djuggler/juggler"
+	"github.com/leoleovich/3djuggler/moonraker"
+	"github.com/leoleovich/3djuggler/octoprint"
+	"github.com/leoleovich/3djuggler/prusalink"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	backendSerial    = "serial"
+	backendMoonraker = "moonraker"
+	backendPrusaLink = "prusalink"
+	backendOctoPrint = "octoprint"
+)
+
+// closeTimeout is how long Close waits for the feeder to turn off the heaters
+const closeTimeout = 10 * time.Second
+
+// Printer runs jobs on a physical printer.
+// Whatever the backend is, its state is reported as gcodefeeder.Status
+type Printer interface {
+	// Print starts the job in the background
+	Print(job *juggler.Job, jobfile string) error
+	Pause() error
+	Resume() error
+	// Cancel stops the current print. It does nothing if nothing is printing
+	Cancel() error
+	// EmergencyStop halts the printer immediately (M112) whatever it is doing
+	EmergencyStop() error
+	Status() gcodefeeder.Status
+	// Progress in percent
+	Progress() float64
+}
+
+// localPrinter is implemented by backends which can see prints started on the printer itself
+type localPrinter interface {
+	// LocalPrint returns the local print. ok is false while the backend does not know yet
+	LocalPrint() (lp gcodefeeder.LocalPrint, ok bool)
+}
+
+// buttonPrinter is implemented by backends which can prompt on the LCD of the printer
+type buttonPrinter interface {
+	// WaitForButton shows the prompt on the printer and blocks until the knob is clicked (nil) or ctx is done
+	WaitForButton(ctx context.Context, prompt gcodefeeder.Prompt) error
+}
+
+// notifyingPrinter is implemented by backends which signal status changes, so the daemon doesn't wait for the next poll
+type notifyingPrinter interface {
+	Changes() <-chan struct{}
+}
+
+// attachablePrinter is implemented by backends whose prints survive restarts of the daemon
+type attachablePrinter interface {
+	// Attach follows the print which is already running on the printer. It returns false if nothing is printing
+	Attach() (bool, error)
+}
+
+// parkingPrinter is implemented by backends which don't park the head on Pause themselves
+type parkingPrinter interface {
+	// Park stops the paused print, moves the head away from it and turns off the heaters
+	Park() error
+}
+
+// mmuPrinter is implemented by backends which know about the MMU
+type mmuPrinter interface {
+	MMU() gcodefeeder.MMUState
+}
+
+// temperaturePrinter is implemented by backends which know the temperatures of the printer
+type temperaturePrinter interface {
+	// Temperatures returns false if they are not known, e.g. while the printer is idle
+	Temperatures() (gcodefeeder.Temperatures, bool)
+}
+
+// latencyPrinter is implemented by backends which stream G-code themselves
+type latencyPrinter interface {
+	// AckLatency is how long the printer took to acknowledge commands, summed over all jobs
+	AckLatency() gcodefeeder.Histogram
+}
+
+func newPrinter(config *PrinterConfig) (Printer, error) {
+	switch config.Backend {
+	case "", backendSerial:
+		return &serialPrinter{
+			port:          gcodefeeder.NewPort(config.Serial),
+			transcriptDir: config.TranscriptDir,
+			sdPrint:       config.SDPrint,
+			monitor:       config.Monitor,
+			tempInterval:  config.TemperatureReport,
+			changes:       make(chan struct{}, 1),
+		}, nil
+	case backendMoonraker:
+		if config.Moonraker == nil || config.Moonraker.URL == "" {
+			return nil, errors.New("moonraker backend requires Moonraker.url")
+		}
+		return moonraker.NewPrinter(*config.Moonraker), nil
+	case backendPrusaLink:
+		if config.PrusaLink == nil || config.PrusaLink.URL == "" {
+			return nil, errors.New("prusalink backend requires PrusaLink.url")
+		}
+		return prusalink.NewPrinter(*config.PrusaLink), nil
+	case backendOctoPrint:
+		if config.OctoPrint == nil || config.OctoPrint.URL == "" {
+			return nil, errors.New("octoprint backend requires OctoPrint.url")
+		}
+		return octoprint.NewPrinter(*config.OctoPrint), nil
+	}
+	return nil, fmt.Errorf("unknown printer backend %q", config.Backend)
+}
+
+// serialPrinter streams jobs over a local tty with gcodefeeder
+type serialPrinter struct {
+	// port stays open between jobs, opening it resets boards like MK3
+	port          *gcodefeeder.Port
+	transcriptDir string
+	// upload jobs to the SD card and print from there
+	sdPrint bool
+	// watch the printer for local prints while we don't print
+	monitor bool
+	// seconds between temperature reports the printer is asked for, 0 if it is not asked
+	tempInterval int
+	// changes is signalled by feeders on every status change
+	changes chan struct{}
+
+	mu     sync.Mutex
+	feeder *gcodefeeder.Feeder
+	// watcher holds the port while the printer is idle
+	watcher *gcodefeeder.Monitor
+	// ackLatency sums the latencies of the feeders up to finished
+	ackLatency gcodefeeder.Histogram
+	finished   *gcodefeeder.Feeder
+}
+
+func (p *serialPrinter) Print(job *juggler.Job, jobfile string) error {
+	// Port can be opened only once
+	p.mu.Lock()
+	p.stopWatcherLocked()
+	p.mu.Unlock()
+
+	tty, err := p.port.Lease()
+	if err != nil {
+		return err
+	}
+	feeder, err := gcodefeeder.NewFeederWithPort(tty, jobfile)
+	if err != nil {
+		tty.Close()
+		return fmt.Errorf("failed to create Feeder: %w", err)
+	}
+	// Replace whatever was left on the LCD while the job waited for the button
+	feeder.SetMessage(fmt.Sprintf("Printing %s", job.Filename))
+	feeder.ReportTemperatures(p.tempInterval)
+	feeder.Notify(p.changes)
+	if p.sdPrint {
+		// Marlin SD cards want 8.3 names
+		feeder.PrintFromSD(fmt.Sprintf("JOB%05d.GCO", job.ID%100000))
+	}
+	transcript, err := p.openTranscript(job.ID)
+	if err != nil {
+		log.Error("Failed to create transcript: ", err)
+	} else if transcript != nil {
+		feeder.Record(transcript)
+	}
+	p.start(feeder, fmt.Sprintf("Job %d", job.ID), transcript)
+	return nil
+}
+
+// Attach follows the SD print which survived the restart of the daemon. Streamed prints stop with the daemon
+func (p *serialPrinter) Attach() (bool, error) {
+	if !p.sdPrint {
+		return false, nil
+	}
+	p.mu.Lock()
+	p.stopWatcherLocked()
+	p.mu.Unlock()
+
+	// Ask M27 and M27 C whether the card is still printing. The follower gets the port the monitor used,
+	// it is not opened again
+	tty, err := p.port.Lease()
+	if err != nil {
+		return false, err
+	}
+	monitor := gcodefeeder.NewMonitorWithPort(tty)
+	for !monitor.Ready() && monitor.Err() == nil {
+		time.Sleep(100 * time.Millisecond)
+	}
+	lp, err := monitor.LocalPrint(), monitor.Err()
+	monitor.Close()
+	if err != nil {
+		return false, err
+	}
+	if !lp.Active {
+		return false, nil
+	}
+	log.Infof("SD card is printing %q at %d%%", lp.File, lp.Progress)
+
+	tty, err = p.port.Lease()
+	if err != nil {
+		return false, err
+	}
+	feeder := gcodefeeder.NewSDFollowerWithPort(tty, lp.File)
+	feeder.ReportTemperatures(p.tempInterval)
+	feeder.Notify(p.changes)
+	p.start(feeder, "Attached print", nil)
+	return true, nil
+}
+
+// start feeds in the background and keeps the stats once the feeder is done
+func (p *serialPrinter) start(feeder *gcodefeeder.Feeder, name string, transcript *os.File) {
+	p.mu.Lock()
+	p.feeder = feeder
+	p.mu.Unlock()
+
+	go func() {
+		if err := feeder.Feed(); err != nil {
+			log.Error(err)
+		}
+		stats := feeder.Stats()
+		log.Infof("%s feeder stats: %s", name, stats)
+		p.mu.Lock()
+		p.ackLatency.Add(stats.AckLatency)
+		p.finished = feeder
+		p.mu.Unlock()
+		if transcript != nil {
+			transcript.Close()
+		}
+	}()
+}
+
+// openTranscript creates a per-job transcript file if transcriptDir is configured
+func (p *serialPrinter) openTranscript(id int) (*os.File, error) {
+	if p.transcriptDir == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(p.transcriptDir, 0755); err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("job-%d-%s.log", id, time.Now().Format("20060102-150405"))
+	return os.Create(filepath.Join(p.transcriptDir, name))
+}
+
+func (p *serialPrinter) current() *gcodefeeder.Feeder {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.feeder
+}
+
+func (p *serialPrinter) Changes() <-chan struct{} {
+	return p.changes
+}
+
+func (p *serialPrinter) Pause() error {
+	feeder := p.current()
+	if feeder == nil {
+		return errors.New("nothing is printing")
+	}
+	return feeder.Pause()
+}
+
+func (p *serialPrinter) Resume() error {
+	feeder := p.current()
+	if feeder == nil {
+		return errors.New("nothing is printing")
+	}
+	return feeder.Start()
+}
+
+func (p *serialPrinter) Cancel() error {
+	feeder := p.current()
+	if feeder == nil || feeder.Status().Terminal() {
+		return nil
+	}
+	return feeder.Cancel()
+}
+
+// Park stops the print for good: the stream can't be resumed once the daemon exits
+func (p *serialPrinter) Park() error {
+	feeder := p.current()
+	if feeder == nil || feeder.Status().Terminal() {
+		return nil
+	}
+	return feeder.Park()
+}
+
+// Close waits for the stopped feeder to cool the printer down and releases the port
+func (p *serialPrinter) Close() error {
+	p.mu.Lock()
+	p.stopWatcherLocked()
+	feeder := p.feeder
+	p.mu.Unlock()
+	if feeder == nil || !feeder.Status().Terminal() {
+		// The print goes on without us, e.g. from the SD card or paused for the exit
+		return p.port.Close()
+	}
+	select {
+	case <-feeder.Done():
+	case <-time.After(closeTimeout):
+		return errors.New("feeder did not stop in time")
+	}
+	return p.port.Close()
+}
+
+func (p *serialPrinter) EmergencyStop() error {
+	p.mu.Lock()
+	feeder, watcher := p.feeder, p.watcher
+	p.mu.Unlock()
+	if feeder != nil && !feeder.Status().Terminal() {
+		return feeder.EmergencyStop()
+	}
+	if watcher != nil {
+		return watcher.EmergencyStop()
+	}
+	// Nobody holds the port, the printer may still be heating after a print
+	tty, err := p.port.Lease()
+	if err != nil {
+		return err
+	}
+	monitor := gcodefeeder.NewMonitorWithPort(tty)
+	defer monitor.Close()
+	return monitor.EmergencyStop()
+}
+
+func (p *serialPrinter) Status() gcodefeeder.Status {
+	feeder := p.current()
+	if feeder == nil {
+		return gcodefeeder.Ready
+	}
+	return feeder.Status()
+}
+
+func (p *serialPrinter) Progress() float64 {
+	feeder := p.current()
+	if feeder == nil {
+		return 0
+	}
+	return float64(feeder.Progress())
+}
+
+func (p *serialPrinter) MMU() gcodefeeder.MMUState {
+	feeder := p.current()
+	if feeder == nil {
+		return gcodefeeder.MMUState{Slot: -1}
+	}
+	return feeder.MMU()
+}
+
+func (p *serialPrinter) Temperatures() (gcodefeeder.Temperatures, bool) {
+	feeder := p.current()
+	// Heaters are turned off once the print is over
+	if feeder == nil || feeder.Status().Terminal() {
+		return gcodefeeder.Temperatures{}, false
+	}
+	return feeder.Temperatures()
+}
+
+func (p *serialPrinter) AckLatency() gcodefeeder.Histogram {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var h gcodefeeder.Histogram
+	h.Add(p.ackLatency)
+	if p.feeder != nil && p.feeder != p.finished {
+		h.Add(p.feeder.Stats().AckLatency)
+	}
+	return h
+}
+
+func (p *serialPrinter) stopWatcherLocked() {
+	if p.watcher == nil {
+		return
+	}
+	if err := p.watcher.Close(); err != nil {
+		log.Debug("Failed to close monitor: ", err)
+	}
+	p.watcher = nil
+}
+
+// LocalPrint attaches to the port without streaming anything and reports prints started on the printer
+func (p *serialPrinter) LocalPrint() (gcodefeeder.LocalPrint, bool) {
+	if !p.monitor {
+		return gcodefeeder.LocalPrint{}, true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.feeder != nil && !p.feeder.Status().Terminal() {
+		// We are printing ourselves
+		return gcodefeeder.LocalPrint{}, true
+	}
+	if p.watcher != nil && p.watcher.Err() != nil {
+		log.Warning("Monitor stopped: ", p.watcher.Err())
+		p.stopWatcherLocked()
+	}
+	if p.watcher == nil {
+		tty, err := p.port.Lease()
+		if err != nil {
+			log.Error("Failed to start monitor: ", err)
+			return gcodefeeder.LocalPrint{}, false
+		}
+		p.watcher = gcodefeeder.NewMonitorWithPort(tty)
+	}
+	if !p.watcher.Ready() {
+		return gcodefeeder.LocalPrint{}, false
+	}
+	return p.watcher.LocalPrint(), true
+}
+
+func (p *serialPrinter) WaitForButton(ctx context.Context, prompt gcodefeeder.Prompt) error {
+	p.mu.Lock()
+	p.stopWatcherLocked()
+	p.mu.Unlock()
+
+	// Every wait uses the same port, the printer is not reset between the reminders
+	tty, err := p.port.Lease()
+	if err != nil {
+		return err
+	}
+	defer tty.Close()
+
+	return gcodefeeder.WaitForClick(ctx, tty, prompt)
+}
@@ -0,0 +1,363 @@
+// Package prusalink drives Prusa MK4/XL/MINI printers through the PrusaLink v1 API
+package prusalink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leoleovich/3djuggler/gcodefeeder"
+	"github.com/leoleovich/3djuggler/internal/upload"
+	"github.com/leoleovich/3djuggler/juggler"
+	log "github.com/sirupsen/logrus"
+)
+
+const requestTimeout = 60 * time.Second
+
+// startTimeout is how long the print may take to show up after the upload
+const startTimeout = 2 * time.Minute
+const pollingInterval = 2 * time.Second
+
+type Config struct {
+	// URL of the printer, e.g. http://mk4.local
+	URL    string `json:"url"`
+	APIKey string `json:"api_key"`
+	// APIKeyFile is read into APIKey by juggler, so the key is not kept in its config
+	APIKeyFile string `json:"api_key_file"`
+	// Storage to upload jobs to. Default is "usb"
+	Storage string `json:"storage"`
+}
+
+// Status is the subset of /api/v1/status we care about
+type Status struct {
+	Job *struct {
+		ID       int     `json:"id"`
+		Progress float64 `json:"progress"`
+	} `json:"job"`
+	Printer struct {
+		State        string  `json:"state"`
+		TempNozzle   float64 `json:"temp_nozzle"`
+		TargetNozzle float64 `json:"target_nozzle"`
+		TempBed      float64 `json:"temp_bed"`
+		TargetBed    float64 `json:"target_bed"`
+	} `json:"printer"`
+}
+
+type Client struct {
+	config Config
+	http   *http.Client
+	// upload has no timeout for the whole request, large files take long on slow links
+	upload *http.Client
+}
+
+func NewClient(config Config) *Client {
+	if config.Storage == "" {
+		config.Storage = "usb"
+	}
+	return &Client{config: config, http: &http.Client{Timeout: requestTimeout}, upload: upload.NewClient()}
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body io.Reader, header http.Header, result interface{}) error {
+	return c.send(ctx, c.http, method, path, body, header, result)
+}
+
+func (c *Client) send(ctx context.Context, client *http.Client, method, path string, body io.Reader, header http.Header, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, c.config.URL+path, body)
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("X-Api-Key", c.config.APIKey)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("prusalink %s %s: %d %s", method, path, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	if result == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// UploadAndPrint streams the file to the printer and starts printing it. It fails once the upload stalls
+func (c *Client) UploadAndPrint(ctx context.Context, name string, content io.Reader) error {
+	ctx, body, stop := upload.Watch(ctx, io.NopCloser(content), upload.IdleTimeout)
+	defer stop()
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+	header.Set("Print-After-Upload", "?1")
+	header.Set("Overwrite", "?1")
+	path := fmt.Sprintf("/api/v1/files/%s/%s", c.config.Storage, url.PathEscape(name))
+	return c.send(ctx, c.upload, http.MethodPut, path, body, header, nil)
+}
+
+func (c *Client) Status(ctx context.Context) (Status, error) {
+	var s Status
+	err := c.do(ctx, http.MethodGet, "/api/v1/status", nil, nil, &s)
+	return s, err
+}
+
+func (c *Client) Pause(ctx context.Context, id int) error {
+	return c.do(ctx, http.MethodPut, fmt.Sprintf("/api/v1/job/%d/pause", id), nil, nil, nil)
+}
+
+func (c *Client) Resume(ctx context.Context, id int) error {
+	return c.do(ctx, http.MethodPut, fmt.Sprintf("/api/v1/job/%d/resume", id), nil, nil, nil)
+}
+
+func (c *Client) Stop(ctx context.Context, id int) error {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("/api/v1/job/%d", id), nil, nil, nil)
+}
+
+// StatusFromState maps the PrusaLink printer state onto feeder statuses
+func StatusFromState(state string) gcodefeeder.Status {
+	switch state {
+	case "IDLE", "READY":
+		return gcodefeeder.Ready
+	case "PRINTING", "BUSY":
+		return gcodefeeder.Printing
+	case "PAUSED":
+		return gcodefeeder.ManuallyPaused
+	case "ATTENTION":
+		// Printer waits for the operator, e.g. filament runout or MMU problem
+		return gcodefeeder.FSensorBusy
+	case "FINISHED":
+		return gcodefeeder.Finished
+	case "STOPPED":
+		// Stopped on the screen of the printer or in PrusaLink
+		return gcodefeeder.Cancelled
+	default:
+		return gcodefeeder.Error
+	}
+}
+
+// Printer runs jobs through PrusaLink and polls their status
+type Printer struct {
+	client *Client
+
+	mu       sync.Mutex
+	jobID    int
+	status   gcodefeeder.Status
+	progress float64
+	temps    gcodefeeder.Temperatures
+	// started is set once the printer reported our print, until then it may still report the previous one.
+	// sent is when the print was sent, it fails if it doesn't start within startTimeout
+	started bool
+	sent    time.Time
+	stop    context.CancelFunc
+}
+
+func NewPrinter(config Config) *Printer {
+	return &Printer{client: NewClient(config), status: gcodefeeder.Ready}
+}
+
+func (p *Printer) Print(job *juggler.Job, jobfile string) error {
+	file, err := os.Open(jobfile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// PrusaLink only prints files with a known extension and short names
+	name := fmt.Sprintf("3dj%d_%s", job.ID, filepath.Base(job.Filename))
+	if ext := filepath.Ext(name); ext != ".gcode" && ext != ".bgcode" {
+		name += ".gcode"
+	}
+	if err := p.client.UploadAndPrint(context.Background(), name, file); err != nil {
+		return fmt.Errorf("failed to upload %s: %w", name, err)
+	}
+
+	watchCtx, stop := context.WithCancel(context.Background())
+	p.mu.Lock()
+	if p.stop != nil {
+		p.stop()
+	}
+	p.stop = stop
+	p.jobID = 0
+	p.status = gcodefeeder.Printing
+	p.progress = 0
+	p.started = false
+	p.sent = time.Now()
+	p.mu.Unlock()
+
+	go p.watch(watchCtx)
+	return nil
+}
+
+// Attach follows the print which is already running on the printer, e.g. after a restart of the daemon.
+// It returns false if nothing is printing
+func (p *Printer) Attach() (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	s, err := p.client.Status(ctx)
+	if err != nil {
+		return false, err
+	}
+	if status := StatusFromState(s.Printer.State); status == gcodefeeder.Ready || status.Terminal() {
+		return false, nil
+	}
+
+	watchCtx, stop := context.WithCancel(context.Background())
+	p.mu.Lock()
+	if p.stop != nil {
+		p.stop()
+	}
+	p.stop = stop
+	p.jobID = 0
+	p.started = true
+	p.mu.Unlock()
+	p.update(s)
+
+	go p.watch(watchCtx)
+	return true, nil
+}
+
+// job returns the PrusaLink id of the current print, asking the printer if it was not polled yet
+func (p *Printer) job() (int, error) {
+	p.mu.Lock()
+	id := p.jobID
+	p.mu.Unlock()
+	if id != 0 {
+		return id, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	s, err := p.client.Status(ctx)
+	if err != nil {
+		return 0, err
+	}
+	p.update(s)
+	if s.Job == nil {
+		return 0, fmt.Errorf("printer has no job")
+	}
+	return s.Job.ID, nil
+}
+
+func (p *Printer) Pause() error {
+	id, err := p.job()
+	if err != nil {
+		return err
+	}
+	return p.client.Pause(context.Background(), id)
+}
+
+func (p *Printer) Resume() error {
+	id, err := p.job()
+	if err != nil {
+		return err
+	}
+	return p.client.Resume(context.Background(), id)
+}
+
+func (p *Printer) Cancel() error {
+	// Don't stop a print which is not ours
+	if status := p.Status(); status == gcodefeeder.Ready || status.Terminal() {
+		return nil
+	}
+	id, err := p.job()
+	if err != nil {
+		return err
+	}
+	return p.client.Stop(context.Background(), id)
+}
+
+// EmergencyStop stops the current job. PrusaLink has no way to send M112,
+// so this is as fast as the printer reacts to a regular stop
+func (p *Printer) EmergencyStop() error {
+	id, err := p.job()
+	if err != nil {
+		return err
+	}
+	return p.client.Stop(context.Background(), id)
+}
+
+func (p *Printer) Status() gcodefeeder.Status {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.status
+}
+
+func (p *Printer) Progress() float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.progress
+}
+
+// Temperatures are the last polled ones. ok is false unless a print is followed
+func (p *Printer) Temperatures() (gcodefeeder.Temperatures, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.temps, p.stop != nil && !p.status.Terminal()
+}
+
+// update applies the polled status. It returns false once the print is over
+func (p *Printer) update(s Status) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.temps = gcodefeeder.Temperatures{
+		Hotend:       s.Printer.TempNozzle,
+		HotendTarget: s.Printer.TargetNozzle,
+		Bed:          s.Printer.TempBed,
+		BedTarget:    s.Printer.TargetBed,
+	}
+	status := StatusFromState(s.Printer.State)
+	// Printer is idle or still reports the previous job for a moment after the upload
+	if !p.started {
+		if status == gcodefeeder.Ready || status.Terminal() {
+			if time.Since(p.sent) < startTimeout {
+				return true
+			}
+			// The print never showed up, the printer refused it or it was stopped at once
+			if status != gcodefeeder.Error {
+				status = gcodefeeder.Cancelled
+			}
+			log.Warningf("PrusaLink: print did not start in %s, printer is %s", startTimeout, s.Printer.State)
+			p.status = status
+			return false
+		}
+		p.started = true
+	}
+	if s.Job != nil {
+		p.jobID = s.Job.ID
+		p.progress = s.Job.Progress
+	}
+	if status != gcodefeeder.Ready && status != p.status {
+		log.Debugf("PrusaLink: status %s -> %s", p.status, status)
+		p.status = status
+	}
+	return !p.status.Terminal()
+}
+
+func (p *Printer) watch(ctx context.Context) {
+	ticker := time.NewTicker(pollingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s, err := p.client.Status(ctx)
+		if err != nil {
+			log.Error("PrusaLink: ", err)
+			continue
+		}
+		if !p.update(s) {
+			return
+		}
+	}
+}
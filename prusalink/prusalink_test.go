@@ -0,0 +1,50 @@
+package prusalink
+
+import (
+	"testing"
+	"time"
+
+	"github.com/leoleovich/3djuggler/gcodefeeder"
+)
+
+func TestStatusFromState(t *testing.T) {
+	for state, want := range map[string]gcodefeeder.Status{
+		"IDLE":      gcodefeeder.Ready,
+		"PRINTING":  gcodefeeder.Printing,
+		"PAUSED":    gcodefeeder.ManuallyPaused,
+		"ATTENTION": gcodefeeder.FSensorBusy,
+		"FINISHED":  gcodefeeder.Finished,
+		"STOPPED":   gcodefeeder.Cancelled,
+		"ERROR":     gcodefeeder.Error,
+	} {
+		if got := StatusFromState(state); got != want {
+			t.Errorf("%s: got %s, want %s", state, got, want)
+		}
+	}
+}
+
+func TestUpdateWaitsForThePrintToStart(t *testing.T) {
+	tests := []struct {
+		name  string
+		state string
+		// sent is how long ago the print was sent
+		sent time.Duration
+		want gcodefeeder.Status
+	}{
+		{"previous print", "FINISHED", 0, gcodefeeder.Printing},
+		{"started", "PRINTING", startTimeout, gcodefeeder.Printing},
+		{"never started", "IDLE", startTimeout, gcodefeeder.Cancelled},
+		{"failed to start", "ERROR", startTimeout, gcodefeeder.Error},
+	}
+	for _, tt := range tests {
+		p := NewPrinter(Config{})
+		p.status = gcodefeeder.Printing
+		p.sent = time.Now().Add(-tt.sent)
+		var s Status
+		s.Printer.State = tt.state
+		p.update(s)
+		if got := p.Status(); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
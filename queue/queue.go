@@ -0,0 +1,266 @@
+// Package queue keeps jobs submitted to juggler directly, without intern
+package queue
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/leoleovich/3djuggler/internal/atomicfile"
+)
+
+// ErrNotFound is returned for ids which are not in the queue
+var ErrNotFound = errors.New("job is not in the queue")
+
+// uploadPattern names the G-code which is being added
+const uploadPattern = "upload-*"
+
+// Job is a queued job. Its G-code is stored next to the index of the queue, and kept after Pop until Done
+type Job struct {
+	ID        int       `json:"id"`
+	Filename  string    `json:"file_name"`
+	Owner     string    `json:"owner"`
+	Color     string    `json:"color"`
+	Priority  int       `json:"priority"`
+	Submitted time.Time `json:"submitted"`
+}
+
+// Queue is a persisted list of jobs in the order they will be printed.
+// Jobs with higher priority go first, Move overrides the order explicitly
+type Queue struct {
+	dir string
+
+	mu     sync.Mutex
+	jobs   []*Job
+	nextID int
+}
+
+type index struct {
+	NextID int
+	Jobs   []*Job
+}
+
+// Open loads the queue kept in dir, creating it if needed
+func Open(dir string) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	q := &Queue{dir: dir, nextID: 1}
+	// Uploads which were cut by a crash
+	uploads, _ := filepath.Glob(filepath.Join(dir, uploadPattern))
+	for _, upload := range uploads {
+		os.Remove(upload)
+	}
+	b, err := os.ReadFile(q.indexPath())
+	if os.IsNotExist(err) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var idx index
+	if err := json.Unmarshal(b, &idx); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", q.indexPath(), err)
+	}
+	q.jobs = idx.Jobs
+	if idx.NextID > q.nextID {
+		q.nextID = idx.NextID
+	}
+	return q, nil
+}
+
+func (q *Queue) indexPath() string {
+	return filepath.Join(q.dir, "queue.json")
+}
+
+func (q *Queue) gcodePath(id int) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%d.gcode", id))
+}
+
+// Add stores the G-code and queues the job after all jobs with the same or higher priority.
+// The job gets a new id unless it has one already
+func (q *Queue) Add(job Job, gcode io.Reader) (Job, error) {
+	// Uploads may be slow, the queue is locked only once the G-code is stored
+	file, err := os.CreateTemp(q.dir, uploadPattern)
+	if err != nil {
+		return Job{}, err
+	}
+	defer os.Remove(file.Name())
+	if _, err := io.Copy(file, gcode); err != nil {
+		file.Close()
+		return Job{}, err
+	}
+	if err := file.Close(); err != nil {
+		return Job{}, err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if job.ID == 0 {
+		job.ID = q.nextID
+		q.nextID++
+	}
+	if job.Submitted.IsZero() {
+		job.Submitted = time.Now()
+	}
+	if err := os.Rename(file.Name(), q.gcodePath(job.ID)); err != nil {
+		return Job{}, err
+	}
+	q.insertLocked(&job)
+	if err := q.saveLocked(); err != nil {
+		return Job{}, err
+	}
+	return job, nil
+}
+
+// List returns the jobs in the order they will be printed
+func (q *Queue) List() []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	jobs := make([]Job, 0, len(q.jobs))
+	for _, job := range q.jobs {
+		jobs = append(jobs, *job)
+	}
+	return jobs
+}
+
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.jobs)
+}
+
+// Move puts the job at position (0 is the next one to print) regardless of priorities
+func (q *Queue) Move(id, position int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, err := q.removeLocked(id)
+	if err != nil {
+		return err
+	}
+	if position < 0 {
+		position = 0
+	}
+	if position > len(q.jobs) {
+		position = len(q.jobs)
+	}
+	q.jobs = append(q.jobs[:position], append([]*Job{job}, q.jobs[position:]...)...)
+	return q.saveLocked()
+}
+
+// SetPriority changes the priority of the job and queues it again according to it
+func (q *Queue) SetPriority(id, priority int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, err := q.removeLocked(id)
+	if err != nil {
+		return err
+	}
+	job.Priority = priority
+	q.insertLocked(job)
+	return q.saveLocked()
+}
+
+// Remove deletes the job and its G-code
+func (q *Queue) Remove(id int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, err := q.removeLocked(id); err != nil {
+		return err
+	}
+	if err := q.saveLocked(); err != nil {
+		return err
+	}
+	return os.Remove(q.gcodePath(id))
+}
+
+// Pop takes the next job out of the queue and returns it with its G-code. ok is false if the queue is empty.
+// The G-code is kept until Done, so the job can be given back with Return
+func (q *Queue) Pop() (job Job, gcode []byte, ok bool, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.jobs) == 0 {
+		return Job{}, nil, false, nil
+	}
+	next := q.jobs[0]
+	gcode, err = os.ReadFile(q.gcodePath(next.ID))
+	if err != nil {
+		return Job{}, nil, false, err
+	}
+	q.jobs = q.jobs[1:]
+	if err := q.saveLocked(); err != nil {
+		return Job{}, nil, false, err
+	}
+	return *next, gcode, true, nil
+}
+
+// Return queues the job taken by Pop again with its kept G-code, according to its priority.
+// It fails if the G-code is gone, e.g. after Done
+func (q *Queue) Return(job Job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, queued := range q.jobs {
+		if queued.ID == job.ID {
+			return nil
+		}
+	}
+	if _, err := os.Stat(q.gcodePath(job.ID)); err != nil {
+		return fmt.Errorf("can't return job %d: %w", job.ID, err)
+	}
+	if job.Submitted.IsZero() {
+		job.Submitted = time.Now()
+	}
+	q.insertLocked(&job)
+	return q.saveLocked()
+}
+
+// Done deletes the G-code of the job taken by Pop
+func (q *Queue) Done(id int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, queued := range q.jobs {
+		if queued.ID == id {
+			// It was given back, the G-code belongs to the queue again
+			return nil
+		}
+	}
+	if err := os.Remove(q.gcodePath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (q *Queue) insertLocked(job *Job) {
+	position := len(q.jobs)
+	for i, queued := range q.jobs {
+		if queued.Priority < job.Priority {
+			position = i
+			break
+		}
+	}
+	q.jobs = append(q.jobs[:position], append([]*Job{job}, q.jobs[position:]...)...)
+}
+
+func (q *Queue) removeLocked(id int) (*Job, error) {
+	for i, job := range q.jobs {
+		if job.ID == id {
+			q.jobs = append(q.jobs[:i], q.jobs[i+1:]...)
+			return job, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// saveLocked replaces the index atomically, so a crash never leaves a partial one
+func (q *Queue) saveLocked() error {
+	b, err := json.MarshalIndent(index{NextID: q.nextID, Jobs: q.jobs}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.Write(q.indexPath(), b)
+}
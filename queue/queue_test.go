@@ -0,0 +1,156 @@
+package queue
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func open(t *testing.T, dir string) *Queue {
+	t.Helper()
+	q, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+func add(t *testing.T, q *Queue, name string, priority int) Job {
+	t.Helper()
+	job, err := q.Add(Job{Filename: name, Priority: priority}, strings.NewReader("; "+name+"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+// order returns the file names of the queued jobs
+func order(q *Queue) []string {
+	var names []string
+	for _, job := range q.List() {
+		names = append(names, job.Filename)
+	}
+	return names
+}
+
+func expect(t *testing.T, q *Queue, want ...string) {
+	t.Helper()
+	if got := order(q); !reflect.DeepEqual(got, want) {
+		t.Fatalf("queue is %q, want %q", got, want)
+	}
+}
+
+func TestOrder(t *testing.T) {
+	dir := t.TempDir()
+	q := open(t, dir)
+	add(t, q, "a", 0)
+	add(t, q, "b", 0)
+	urgent := add(t, q, "urgent", 5)
+	add(t, q, "c", 1)
+	// Higher priority first, the same priority in the order of submission
+	expect(t, q, "urgent", "c", "a", "b")
+
+	if err := q.SetPriority(urgent.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, q, "c", "a", "b", "urgent")
+
+	// The order and the ids survive a restart
+	q = open(t, dir)
+	expect(t, q, "c", "a", "b", "urgent")
+	if job := add(t, q, "d", 0); job.ID != urgent.ID+2 {
+		t.Fatalf("new job got id %d after a restart, want %d", job.ID, urgent.ID+2)
+	}
+}
+
+func TestMove(t *testing.T) {
+	q := open(t, t.TempDir())
+	a := add(t, q, "a", 0)
+	add(t, q, "b", 0)
+	c := add(t, q, "c", 5)
+
+	// Move overrides the priorities
+	if err := q.Move(a.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, q, "a", "c", "b")
+	// Positions out of range are clamped
+	if err := q.Move(c.ID, 10); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, q, "a", "b", "c")
+	if err := q.Move(c.ID, -1); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, q, "c", "a", "b")
+	if err := q.Move(42, 0); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("moving an unknown job returned %v", err)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	dir := t.TempDir()
+	q := open(t, dir)
+	a := add(t, q, "a", 0)
+	add(t, q, "b", 0)
+
+	if err := q.Remove(a.ID); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, q, "b")
+	if _, err := os.Stat(q.gcodePath(a.ID)); !os.IsNotExist(err) {
+		t.Fatalf("G-code of the removed job: %v", err)
+	}
+	if err := q.Remove(a.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("removing the job again returned %v", err)
+	}
+	// Nothing but the index and the G-code of b is left, e.g. no uploads
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) != 2 {
+		t.Fatalf("queue directory has %q", files)
+	}
+}
+
+func TestReturn(t *testing.T) {
+	dir := t.TempDir()
+	q := open(t, dir)
+	a := add(t, q, "a", 0)
+	add(t, q, "b", 0)
+
+	job, gcode, ok, err := q.Pop()
+	if err != nil || !ok || job.ID != a.ID || string(gcode) != "; a\n" {
+		t.Fatalf("Pop returned %+v %q %v %v", job, gcode, ok, err)
+	}
+	expect(t, q, "b")
+
+	// The job is given back after a restart, only its id is known
+	q = open(t, dir)
+	if err := q.Return(Job{ID: a.ID, Filename: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Return(Job{ID: a.ID, Filename: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, q, "b", "a")
+	// Done of a job which is queued again keeps its G-code
+	if err := q.Done(a.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	q.Pop()
+	job, gcode, _, err = q.Pop()
+	if err != nil || job.ID != a.ID || string(gcode) != "; a\n" {
+		t.Fatalf("returned job popped as %+v %q %v", job, gcode, err)
+	}
+	if err := q.Done(a.ID); err != nil {
+		t.Fatal(err)
+	}
+	// The job is over, it can't be given back anymore
+	if err := q.Return(Job{ID: a.ID}); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("returning a done job returned %v", err)
+	}
+	expect(t, q)
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/leoleovich/3djuggler/juggler"
+	"github.com/leoleovich/3djuggler/webhook"
+	log "github.com/sirupsen/logrus"
+)
+
+// liveFields of PrinterConfig are applied by Reload. Changes of other fields need a restart
+var liveFields = map[string]bool{
+	"PrinterName":    true,
+	"OfficeName":     true,
+	"KnobStart":      true,
+	"ButtonTimeout":  true,
+	"Attention":      true,
+	"QueuePolicy":    true,
+	"MaxUpload":      true,
+	"ShutdownPolicy": true,
+}
+
+// ReloadResult lists the changed settings. The ones in Restart keep their old values until juggler is restarted
+type ReloadResult struct {
+	Applied []string `json:"applied"`
+	Restart []string `json:"restart"`
+}
+
+// configView is the effective config as /config shows it
+type configView struct {
+	Listen         string
+	Printers       []*PrinterConfig
+	InternEndpoint *InternEndpoint `json:"InternEnpoint"`
+	AdminToken     string
+	HistoryFile    string
+	Webhooks       []webhook.Config
+	WebhookDir     string
+}
+
+// Reload re-reads the config file and applies the changes which are safe while juggler runs
+func (s *Server) Reload() (*ReloadResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	config, printers, err := loadConfig(s.configFile)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ReloadResult{Applied: []string{}, Restart: []string{}}
+	if config.Listen != s.config.Listen {
+		result.Restart = append(result.Restart, "Listen")
+	}
+	if config.HistoryFile != s.config.HistoryFile {
+		result.Restart = append(result.Restart, "HistoryFile")
+	}
+	webhooksChanged := !reflect.DeepEqual(config.Webhooks, s.config.Webhooks)
+	if webhooksChanged {
+		result.Applied = append(result.Applied, "Webhooks")
+	}
+	if config.WebhookDir != s.config.WebhookDir {
+		// Events left in the old outboxes are not delivered
+		webhooksChanged = true
+		result.Applied = append(result.Applied, "WebhookDir")
+	}
+	if webhooksChanged {
+		s.webhooks = openWebhooks(config.Webhooks, config.WebhookDir, s.webhooks)
+		for _, daemon := range s.daemons {
+			daemon.setWebhooks(s.webhooks)
+		}
+	}
+	intern := s.config.InternEndpoint
+	switch {
+	case (config.InternEndpoint == nil) != (intern == nil):
+		result.Restart = append(result.Restart, "InternEnpoint")
+	case intern != nil && !reflect.DeepEqual(*config.InternEndpoint, *intern):
+		result.Applied = append(result.Applied, "InternEnpoint")
+		intern = config.InternEndpoint
+	}
+	if config.AdminToken != s.config.AdminToken {
+		result.Applied = append(result.Applied, "AdminToken")
+	}
+
+	byName := make(map[string]*PrinterConfig)
+	for _, pc := range printers {
+		byName[pc.Name] = pc
+	}
+	for _, daemon := range s.daemons {
+		current := daemon.settings()
+		pc, ok := byName[current.Name]
+		if !ok {
+			result.Restart = append(result.Restart, fmt.Sprintf("Printers: %s is removed", current.Name))
+			continue
+		}
+		delete(byName, current.Name)
+
+		next := *current
+		live := reflect.ValueOf(&next).Elem()
+		changed := reflect.ValueOf(pc).Elem()
+		for i := 0; i < live.NumField(); i++ {
+			field := live.Type().Field(i)
+			if field.PkgPath != "" || reflect.DeepEqual(live.Field(i).Interface(), changed.Field(i).Interface()) {
+				continue
+			}
+			name := current.Name + "." + field.Name
+			if !liveFields[field.Name] {
+				result.Restart = append(result.Restart, name)
+				continue
+			}
+			live.Field(i).Set(changed.Field(i))
+			result.Applied = append(result.Applied, name)
+		}
+		var source JobSource
+		if intern != nil {
+			source = newIntern(intern, &next)
+		}
+		daemon.reload(&next, source)
+	}
+	for name := range byName {
+		result.Restart = append(result.Restart, fmt.Sprintf("Printers: %s is added", name))
+	}
+
+	s.config.InternEndpoint = intern
+	s.config.AdminToken = config.AdminToken
+	s.config.Webhooks = config.Webhooks
+	s.config.WebhookDir = config.WebhookDir
+	redactor.add(config.secrets(printers))
+	return result, nil
+}
+
+// reload replaces the config of the daemon and its intern client, if it has one
+func (daemon *Daemon) reload(config *PrinterConfig, intern JobSource) {
+	_ = daemon.do("reload", func() error {
+		daemon.mu.Lock()
+		daemon.config = config
+		daemon.mu.Unlock()
+		for i, src := range daemon.sources {
+			if intern != nil && src.Name() == juggler.SourceIntern {
+				daemon.sources[i] = intern
+			}
+		}
+		return nil
+	})
+}
+
+// setWebhooks replaces the webhooks the daemon notifies
+func (daemon *Daemon) setWebhooks(hooks []*webhook.Hook) {
+	_ = daemon.do("webhooks", func() error {
+		daemon.webhooks = hooks
+		return nil
+	})
+}
+
+// reloadAndLog runs Reload for SIGHUP
+func (s *Server) reloadAndLog() {
+	result, err := s.Reload()
+	if err != nil {
+		log.Error("Config is not reloaded: ", err)
+		return
+	}
+	log.Infof("Config is reloaded. Applied: %v, needs a restart: %v", result.Applied, result.Restart)
+}
+
+// authorized checks X-Api-Key of the request against AdminToken
+func (s *Server) authorized(r *http.Request) bool {
+	s.mu.Lock()
+	token := s.config.AdminToken
+	s.mu.Unlock()
+	if token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Api-Key")), []byte(token)) == 1
+}
+
+// ConfigReloadHandler reloads the config on POST with X-Api-Key set to AdminToken
+func (s *Server) ConfigReloadHandler(w http.ResponseWriter, r *http.Request) {
+	log.Infof("Received config reload handler request")
+	// Add headers to allow AJAX
+	juggler.SetHeaders(w)
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	if !s.authorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	result, err := s.Reload()
+	if err != nil {
+		log.Error("Config is not reloaded: ", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Infof("Config is reloaded. Applied: %v, needs a restart: %v", result.Applied, result.Restart)
+	s.respondJSON(w, result)
+}
+
+// ConfigHandler gives the effective config with secrets redacted
+func (s *Server) ConfigHandler(w http.ResponseWriter, _ *http.Request) {
+	log.Infof("Received config handler request")
+	// Add headers to allow AJAX
+	juggler.SetHeaders(w)
+
+	s.mu.Lock()
+	view := configView{
+		Listen:         s.config.Listen,
+		InternEndpoint: s.config.InternEndpoint,
+		AdminToken:     s.config.AdminToken,
+		HistoryFile:    s.config.HistoryFile,
+		Webhooks:       s.config.Webhooks,
+		WebhookDir:     s.config.WebhookDir,
+	}
+	s.mu.Unlock()
+	for _, daemon := range s.daemons {
+		view.Printers = append(view.Printers, daemon.settings())
+	}
+	redacted, err := redact(view)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.respondJSON(w, redacted)
+}
+
+func (s *Server) respondJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Errorf("Failed to encode response: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprint(w, string(b))
+}
+
+// redact replaces values of keys which look like secrets, e.g. api_key or AdminToken
+func redact(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var tree interface{}
+	if err := json.Unmarshal(b, &tree); err != nil {
+		return nil, err
+	}
+	redactTree(tree)
+	return tree, nil
+}
+
+func redactTree(tree interface{}) {
+	switch t := tree.(type) {
+	case map[string]interface{}:
+		for k, v := range t {
+			if s, ok := v.(string); ok && s != "" && secret(k) {
+				t[k] = redacted
+				continue
+			}
+			redactTree(v)
+		}
+	case []interface{}:
+		for _, v := range t {
+			redactTree(v)
+		}
+	}
+}
+
+// secret tells keys of secrets from the ones of secret files, e.g. api_key from api_key_file
+func secret(key string) bool {
+	key = strings.ToLower(key)
+	if strings.HasSuffix(key, "file") {
+		return false
+	}
+	for _, word := range []string{"key", "token", "secret", "password"} {
+		if strings.Contains(key, word) {
+			return true
+		}
+	}
+	return false
+}
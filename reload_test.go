@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/leoleovich/3djuggler/juggler"
+)
+
+// writeConfig writes a config of a single printer with the webhooks posting to base/{name}
+func writeConfig(t *testing.T, path, webhookDir, base string, webhooks ...string) {
+	t.Helper()
+	var hooks []map[string]string
+	for _, name := range webhooks {
+		hooks = append(hooks, map[string]string{"name": name, "url": base + "/" + name})
+	}
+	b, err := json.Marshal(map[string]interface{}{
+		"HistoryFile": filepath.Join(filepath.Dir(path), "history.jsonl"),
+		"WebhookDir":  webhookDir,
+		"Webhooks":    hooks,
+		"Printers":    []map[string]string{{"Name": "test", "Serial": "/dev/null"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadWebhooks(t *testing.T) {
+	var mu sync.Mutex
+	posted := make(map[string]int)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		posted[r.URL.Path]++
+		mu.Unlock()
+	}))
+	defer receiver.Close()
+	postedTo := func(path string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return posted[path]
+	}
+
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.json")
+	webhookDir := filepath.Join(dir, "webhooks")
+	writeConfig(t, configFile, webhookDir, receiver.URL, "kept", "removed")
+	config, _, err := loadConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{configFile: configFile, config: config}
+	s.webhooks = openWebhooks(config.Webhooks, config.WebhookDir, nil)
+	t.Cleanup(func() {
+		for _, hook := range s.webhooks {
+			hook.Close()
+		}
+	})
+	kept := s.webhooks[0]
+
+	daemon := testDaemon(t, newFakePrinter(), &fakeSource{}, PrinterConfig{})
+	daemon.webhooks = s.webhooks
+	daemon.Start()
+	settle(t, daemon)
+	s.daemons = []*Daemon{daemon}
+
+	writeConfig(t, configFile, webhookDir, receiver.URL, "kept", "added")
+	result, err := s.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !contains(result.Applied, "Webhooks") || contains(result.Restart, "Webhooks") {
+		t.Fatalf("applied %v, restart %v, want the webhooks applied", result.Applied, result.Restart)
+	}
+	if len(s.webhooks) != 2 || s.webhooks[0] != kept || s.webhooks[1].Config().Name != "added" {
+		t.Fatalf("webhooks are not replaced: %v", s.webhooks)
+	}
+
+	_ = daemon.do("notify", func() error {
+		daemon.notify(juggler.StatusWaitingJob, juggler.StatusWaitingButton, "test")
+		return nil
+	})
+	deadline := time.Now().Add(testTimeout)
+	for postedTo("/kept") == 0 || postedTo("/added") == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("kept got %d events, added %d", postedTo("/kept"), postedTo("/added"))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if n := postedTo("/removed"); n != 0 {
+		t.Fatalf("removed webhook got %d events", n)
+	}
+	// The daemon doesn't queue events for the removed webhook anymore
+	if events, _ := filepath.Glob(filepath.Join(webhookDir, "removed", "*.json")); len(events) != 0 {
+		t.Fatalf("removed webhook has %d events queued", len(events))
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/leoleovich/3djuggler/audit"
+	"github.com/leoleovich/3djuggler/history"
+	"github.com/leoleovich/3djuggler/juggler"
+	"github.com/leoleovich/3djuggler/webhook"
+	log "github.com/sirupsen/logrus"
+)
+
+// Server serves the HTTP API of all printers. Every printer is a Daemon with its own state machine
+type Server struct {
+	listen     string
+	configFile string
+	daemons    []*Daemon
+	http       *http.Server
+	// audit and history are shared by the daemons. Disabled if nil
+	audit   *audit.Log
+	history *history.Store
+	// mu guards config, the effective config of everything but the printers, and webhooks
+	mu     sync.Mutex
+	config *Config
+	// webhooks are shared by the daemons
+	webhooks []*webhook.Hook
+}
+
+// Start runs the daemons and serves their API in the background
+func (s *Server) Start() {
+	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	http.HandleFunc("/version", VersionHandler)
+	http.HandleFunc("/printers", s.OverviewHandler)
+	http.HandleFunc("/printers/", s.PrinterHandler)
+	http.HandleFunc("/config", s.ConfigHandler)
+	http.HandleFunc("/config/reload", s.ConfigReloadHandler)
+	http.HandleFunc("/events", s.EventsHandler)
+	http.HandleFunc("/history", s.HistoryHandler)
+	http.HandleFunc("/metrics", s.MetricsHandler)
+	// The first printer is also served without /printers/{name}, as before multiple printers were supported
+	for path, handler := range s.daemons[0].handlers() {
+		http.HandleFunc("/"+path, handler)
+	}
+
+	for _, daemon := range s.daemons {
+		daemon.Start()
+	}
+	s.http = &http.Server{Addr: s.listen}
+	go func() {
+		log.Debug("Started http server on ", s.listen)
+		if err := s.http.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+}
+
+// Stop stops the daemons, the HTTP server and then waits for the daemons to flush.
+// It returns false and keeps serving if a daemon refuses to exit, force overrides that
+func (s *Server) Stop(force bool) bool {
+	refused := false
+	for _, daemon := range s.daemons {
+		if err := daemon.Stop(force); err != nil {
+			daemon.log.Warning("Can't stop: ", err)
+			refused = true
+		}
+	}
+	if refused {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := s.http.Shutdown(ctx); err != nil {
+		log.Error("Failed to shut the http server down: ", err)
+	}
+	for _, daemon := range s.daemons {
+		daemon.close()
+	}
+	if s.audit != nil {
+		_ = s.audit.Close()
+	}
+	if s.history != nil {
+		_ = s.history.Close()
+	}
+	s.mu.Lock()
+	for _, hook := range s.webhooks {
+		hook.Close()
+	}
+	s.mu.Unlock()
+	return true
+}
+
+// OverviewHandler gives /info of all printers
+func (s *Server) OverviewHandler(w http.ResponseWriter, _ *http.Request) {
+	log.Infof("Received overview handler request")
+	// Add headers to allow AJAX
+	juggler.SetHeaders(w)
+
+	jobs := make([]*juggler.Job, 0, len(s.daemons))
+	for _, daemon := range s.daemons {
+		jobs = append(jobs, daemon.info())
+	}
+	b, err := json.Marshal(jobs)
+	if err != nil {
+		log.Errorf("Failed to respond on /printers request: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprint(w, string(b))
+}
+
+// PrinterHandler routes /printers/{name}/{action} to the daemon of the printer
+func (s *Server) PrinterHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/printers/"), "/", 2)
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	for _, daemon := range s.daemons {
+		if daemon.settings().Name != parts[0] {
+			continue
+		}
+		handler, ok := daemon.handlers()[parts[1]]
+		if !ok {
+			break
+		}
+		handler(w, r)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// VersionHandler gives the commit juggler was built from
+func VersionHandler(w http.ResponseWriter, _ *http.Request) {
+	log.Infof("Received version handler request")
+	// Add headers to allow AJAX
+	juggler.SetHeaders(w)
+	fmt.Fprint(w, gitCommit)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"time"
+
+	"github.com/leoleovich/3djuggler/juggler"
+)
+
+// What happens to the active print when juggler is asked to exit
+const (
+	// The print is cancelled and the printer cooled down
+	shutdownCancel = "cancel"
+	// The print is paused. Serial printers are parked and cooled down, as nobody can resume the stream
+	shutdownPause = "pause"
+	// Juggler keeps running until the print is over. A second signal cancels the print
+	shutdownRefuse = "refuse"
+)
+
+// shutdownTimeout limits every step of the shutdown, e.g. the last reports to the job sources
+const shutdownTimeout = 30 * time.Second
+
+// errRefused is returned by Stop while the daemon refuses to exit
+var errRefused = errors.New("printing, refusing to exit")
+
+// Stop makes the daemon take no more jobs, gives back the job waiting for the button
+// and applies the shutdown policy to the active print. force overrides the refuse policy
+func (daemon *Daemon) Stop(force bool) error {
+	return daemon.do("stop", func() error {
+		daemon.stopping = true
+		switch daemon.job.Status {
+		case juggler.StatusWaitingButton:
+			daemon.log.Infof("Giving job %d back before exit", daemon.job.ID)
+			return daemon.setStatus(juggler.StatusButtonTimeout, "exit")
+		case juggler.StatusSending, juggler.StatusPrinting, juggler.StatusPaused:
+			return daemon.interrupt(force)
+		}
+		return nil
+	})
+}
+
+// interrupt applies the shutdown policy to the active print. Loop only
+func (daemon *Daemon) interrupt(force bool) error {
+	policy := daemon.config.ShutdownPolicy
+	if policy == shutdownRefuse {
+		if !force {
+			return errRefused
+		}
+		policy = shutdownCancel
+	}
+	daemon.log.Warningf("Job %d is interrupted by the exit (%s)", daemon.job.ID, policy)
+	if policy == shutdownCancel || daemon.job.Status == juggler.StatusSending {
+		return daemon.setStatus(juggler.StatusCancelling, "exit")
+	}
+	if daemon.job.Status != juggler.StatusPaused {
+		if err := daemon.printer.Pause(); err != nil {
+			daemon.log.Error("Failed to pause the printer, cancelling: ", err)
+			return daemon.setStatus(juggler.StatusCancelling, "exit, pause failed")
+		}
+	}
+	// The printer is not followed anymore, so the stopped print is not taken for a finished one
+	daemon.interrupted = true
+	if p, ok := daemon.printer.(parkingPrinter); ok {
+		if err := p.Park(); err != nil {
+			daemon.log.Error("Failed to park the printer: ", err)
+		}
+	}
+	if daemon.job.Status == juggler.StatusPaused {
+		// setStatus ignores the same status, still the source has to know the job stays paused for the exit
+		daemon.record(juggler.StatusPaused, juggler.StatusPaused, "exit")
+		daemon.track(daemon.Job(), juggler.StatusPaused, "exit")
+		daemon.save()
+		daemon.report()
+		return nil
+	}
+	return daemon.setStatus(juggler.StatusPaused, "exit")
+}
+
+// close waits for the last calls to the job sources and releases the printer and the sources
+func (daemon *Daemon) close() {
+	if !daemon.flush(shutdownTimeout) {
+		daemon.log.Warning("Job sources did not answer in time")
+	}
+	_ = daemon.do("save", func() error {
+		daemon.save()
+		return nil
+	})
+	if c, ok := daemon.printer.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			daemon.log.Error("Failed to close the printer: ", err)
+		}
+	}
+	for _, src := range daemon.sources {
+		if c, ok := src.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				daemon.log.Errorf("Failed to close %s: %v", src.Name(), err)
+			}
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/leoleovich/3djuggler/juggler"
+)
+
+// JobSource is a job system juggler takes jobs from, e.g. intern or the local queue.
+// Calls may block on the network, the daemon makes them from the worker goroutine of the source
+type JobSource interface {
+	// Name is stored in juggler.Job.Source of the jobs of the source
+	Name() string
+	// Next returns the next job to print. ok is false if there is nothing to print
+	Next() (job juggler.Job, ok bool, err error)
+	// Get returns the job as the source sees it, e.g. with StatusCancelling if it was cancelled there
+	Get(id int) (juggler.Job, error)
+	// Update reports the status of the job. StatusButtonTimeout means it was not started and is given back
+	Update(job *juggler.Job) error
+	// Complete removes the finished or cancelled job from the source
+	Complete(job *juggler.Job) error
+	// Heartbeat reports the status of the printer
+	Heartbeat(status juggler.JobStatus) error
+	// Reschedule gives back the jobs assigned to the printer, e.g. after a restart
+	Reschedule() error
+}
+
+// notifyingSource is implemented by sources which signal new jobs, so the idle daemon doesn't wait for the next poll
+type notifyingSource interface {
+	Changes() <-chan struct{}
+}
+
+// statsSource is implemented by sources which take the statistics of the printer with the heartbeat
+type statsSource interface {
+	HeartbeatStats(status juggler.JobStatus, stats *Stats) error
+}
+
+// sourceChanges merges the signals of all notifying sources
+func (daemon *Daemon) sourceChanges() <-chan struct{} {
+	merged := make(chan struct{}, 1)
+	for _, src := range daemon.sources {
+		s, ok := src.(notifyingSource)
+		if !ok {
+			continue
+		}
+		go func(changes <-chan struct{}) {
+			for range changes {
+				select {
+				case merged <- struct{}{}:
+				default:
+				}
+			}
+		}(s.Changes())
+	}
+	return merged
+}
+
+// source returns the JobSource of the job
+func (daemon *Daemon) source(job *juggler.Job) JobSource {
+	name := job.Source
+	if name == "" {
+		// Saved before there were other sources
+		name = juggler.SourceIntern
+	}
+	for _, src := range daemon.sources {
+		if src.Name() == name {
+			return src
+		}
+	}
+	return nil
+}
+
+// fetchOrder returns the sources in the order they are asked for the next job. Loop only
+func (daemon *Daemon) fetchOrder() []JobSource {
+	sources := append([]JobSource(nil), daemon.sources...)
+	switch daemon.config.QueuePolicy {
+	case policyLocalFirst:
+		// Intern goes last
+		sort.SliceStable(sources, func(i, j int) bool {
+			return sources[i].Name() != juggler.SourceIntern && sources[j].Name() == juggler.SourceIntern
+		})
+		return sources
+	case policyInternFirst:
+		return sources
+	}
+	// The source after the one of the last job goes first
+	for i, src := range sources {
+		if src.Name() == daemon.lastSource {
+			return append(sources[i+1:], sources[:i+1]...)
+		}
+	}
+	return sources
+}
+
+// workerOf returns the worker which calls src
+func (daemon *Daemon) workerOf(src JobSource) *worker {
+	return daemon.workers[src.Name()]
+}
+
+// flush waits until the calls queued so far to all sources are made. It returns false on timeout
+func (daemon *Daemon) flush(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for _, w := range daemon.workers {
+		if !w.flush(time.Until(deadline)) {
+			return false
+		}
+	}
+	return true
+}
+
+// worker calls a job source in the order the calls were queued, so the daemon never waits for it.
+// Every source has its own worker, a slow one doesn't hold up the others
+type worker struct {
+	mu    sync.Mutex
+	queue []workerCall
+	wake  chan struct{}
+}
+
+type workerCall struct {
+	// key deduplicates calls: a newer call replaces a queued one with the same key. Empty key is never replaced
+	key string
+	fn  func()
+}
+
+func newWorker() *worker {
+	return &worker{wake: make(chan struct{}, 1)}
+}
+
+// push queues fn. It never blocks
+func (w *worker) push(key string, fn func()) {
+	w.mu.Lock()
+	if key != "" {
+		for i, c := range w.queue {
+			if c.key == key {
+				w.queue = append(w.queue[:i], w.queue[i+1:]...)
+				break
+			}
+		}
+	}
+	w.queue = append(w.queue, workerCall{key: key, fn: fn})
+	w.mu.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// flush waits until the calls queued so far are made. It returns false on timeout
+func (w *worker) flush(timeout time.Duration) bool {
+	done := make(chan struct{})
+	w.push("", func() { close(done) })
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (w *worker) run() {
+	for range w.wake {
+		for {
+			w.mu.Lock()
+			if len(w.queue) == 0 {
+				w.mu.Unlock()
+				break
+			}
+			c := w.queue[0]
+			w.queue = w.queue[1:]
+			w.mu.Unlock()
+			c.fn()
+		}
+	}
+}
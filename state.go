@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/leoleovich/3djuggler/history"
+	"github.com/leoleovich/3djuggler/internal/atomicfile"
+	"github.com/leoleovich/3djuggler/juggler"
+)
+
+// savedState is kept in PrinterConfig.StateFile, so the daemon can pick up its job after a restart
+type savedState struct {
+	// Job without FileContent, it is in JobFile
+	Job              juggler.Job
+	JobFile          string
+	EmergencyStopped bool
+	// History is the record of the job so far
+	History *history.Record
+	Saved   time.Time
+}
+
+// loadState returns nil if nothing was saved
+func loadState(path string) (*savedState, error) {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state savedState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// save writes the job to the state file. Loop only
+func (daemon *Daemon) save() {
+	job := daemon.Job()
+	job.FileContent = ""
+	b, err := json.MarshalIndent(savedState{
+		Job:              job,
+		JobFile:          daemon.jobfile,
+		EmergencyStopped: daemon.estopped,
+		History:          daemon.trail,
+		Saved:            time.Now(),
+	}, "", "  ")
+	if err != nil {
+		daemon.log.Error("Failed to encode state: ", err)
+		return
+	}
+	if err := atomicfile.Write(daemon.config.StateFile, b); err != nil {
+		daemon.log.Error("Failed to save state: ", err)
+	}
+}
+
+// restore picks up the job saved before the restart. It reconciles the job with its source and the printer
+// and either resumes it, fails it or gives it back to the source. It runs before the loop is started
+func (daemon *Daemon) restore() {
+	state, err := loadState(daemon.config.StateFile)
+	if err != nil {
+		daemon.log.Error("Failed to load state: ", err)
+	}
+	if state == nil {
+		daemon.requeue()
+		return
+	}
+	daemon.estopped = state.EmergencyStopped
+	daemon.trail = state.History
+	job := state.Job
+	if daemon.estopped {
+		daemon.log.Warning("Printer was emergency stopped before the restart")
+		job.Status = juggler.StatusEmergencyStopped
+		daemon.update(func(j *juggler.Job) { *j = job })
+		return
+	}
+	if job.ID == 0 {
+		daemon.requeue()
+		return
+	}
+	daemon.log.Infof("Restoring job %d in '%s' status", job.ID, job.Status)
+
+	// Whatever we had, it may have been cancelled in its source meanwhile
+	src := daemon.source(&job)
+	if src == nil {
+		daemon.log.Warningf("Job %d comes from unknown source %q", job.ID, job.Source)
+		daemon.requeue()
+		return
+	}
+	current, err := src.Get(job.ID)
+	status := current.Status
+	reason := "restart"
+	switch {
+	case err != nil:
+		daemon.log.Warningf("Job %d is gone from %s: %v", job.ID, src.Name(), err)
+		daemon.requeue()
+		return
+	case status == juggler.StatusCancelling, job.Status == juggler.StatusCancelling, job.Status == juggler.StatusFinished:
+		// The loop finishes the cleanup
+		if job.Status != juggler.StatusFinished {
+			job.Status = juggler.StatusCancelling
+		}
+		if status == juggler.StatusCancelling {
+			reason = "cancelled on " + src.Name()
+		}
+	case job.Status == juggler.StatusWaitingButton:
+		content, err := os.ReadFile(state.JobFile)
+		if err == nil && job.Scheduled.After(time.Now()) {
+			job.FileContent = string(content)
+			break
+		}
+		daemon.log.Infof("Job %d can't wait for the button anymore, giving it back", job.ID)
+		job.FileContent = string(content)
+		buttonTimeouts.Inc(daemon.config.Name)
+		daemon.track(job, juggler.StatusButtonTimeout, "restart")
+		daemon.giveBack(job)
+		daemon.requeue()
+		return
+	case job.Status == juggler.StatusSending, job.Status == juggler.StatusPrinting, job.Status == juggler.StatusPaused:
+		if daemon.attach() {
+			daemon.log.Infof("Job %d is still printing, following it again", job.ID)
+			job.Status = juggler.StatusPrinting
+			break
+		}
+		daemon.log.Warningf("Job %d was interrupted by the restart", job.ID)
+		job.Status = juggler.StatusCancelling
+		reason = reasonInterrupted
+	default:
+		daemon.requeue()
+		return
+	}
+	daemon.update(func(j *juggler.Job) { *j = job })
+	daemon.record(state.Job.Status, job.Status, reason)
+	daemon.track(job, job.Status, reason)
+	if state.Job.Status != job.Status {
+		daemon.notify(state.Job.Status, job.Status, reason)
+	}
+	daemon.report()
+}
+
+// attach follows the print which survived the restart if the printer backend can do that
+func (daemon *Daemon) attach() bool {
+	p, ok := daemon.printer.(attachablePrinter)
+	if !ok {
+		return false
+	}
+	attached, err := p.Attach()
+	if err != nil {
+		daemon.log.Error("Failed to attach to the printer: ", err)
+	}
+	return attached
+}
+
+// requeue starts from scratch and asks the sources to give jobs assigned to us to somebody else
+func (daemon *Daemon) requeue() {
+	for _, src := range daemon.sources {
+		src := src
+		daemon.workerOf(src).push("", func() {
+			if err := src.Reschedule(); err != nil {
+				daemon.log.Errorf("%s reschedule failed: %v", src.Name(), err)
+			}
+		})
+	}
+}
+
+// giveBack returns the job which was not started to its source
+func (daemon *Daemon) giveBack(job juggler.Job) {
+	src := daemon.source(&job)
+	if src == nil {
+		return
+	}
+	job.Status = juggler.StatusButtonTimeout
+	daemon.workerOf(src).push("", func() {
+		if err := src.Update(&job); err != nil {
+			daemon.log.Errorf("Failed to give job %d back to %s: %v", job.ID, src.Name(), err)
+		}
+	})
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/leoleovich/3djuggler/history"
+	"github.com/leoleovich/3djuggler/juggler"
+)
+
+// statsWindow is how far back the statistics look
+const statsWindow = 7 * 24 * time.Hour
+
+// maxRecent limits the records loaded from history for the statistics
+const maxRecent = 100000
+
+// Stats of the jobs of the printer over statsWindow, or since juggler knows the printer if that is shorter.
+// Rates are percents of the jobs which are over
+type Stats struct {
+	Since time.Time `json:"since"`
+	Jobs  int       `json:"jobs"`
+	// Utilization is the percent of the time the printer was printing, paused prints included
+	Utilization float64 `json:"utilization_percent"`
+	// IdleSeconds is how long the printer had no job, neither waiting for the button nor printing
+	IdleSeconds          float64 `json:"idle_seconds"`
+	AvgButtonWaitSeconds float64 `json:"avg_button_wait_seconds"`
+	ButtonTimeoutRate    float64 `json:"button_timeout_rate"`
+	SuccessRate          float64 `json:"success_rate"`
+	CancelRate           float64 `json:"cancel_rate"`
+	ErrorRate            float64 `json:"error_rate"`
+	// MeanPrintSeconds is the mean duration of the finished prints
+	MeanPrintSeconds float64 `json:"mean_print_seconds"`
+	// Failures counts the prints which were cancelled or failed by the status of the printer they ended in,
+	// e.g. Cancelled or Error, or by the reason if the status is unknown
+	Failures map[string]int `json:"failures"`
+}
+
+// loadRecent reads the records of statsWindow from history. It runs before the loop is started
+func (daemon *Daemon) loadRecent() {
+	if daemon.history == nil {
+		return
+	}
+	records, err := daemon.history.Find(history.Filter{
+		Printer: daemon.config.Name,
+		From:    time.Now().Add(-statsWindow),
+	}, maxRecent)
+	if err != nil {
+		daemon.log.Error("Failed to load the history for statistics: ", err)
+		return
+	}
+	daemon.recent = records
+}
+
+// stats computes the statistics from the recent records and the current job. Loop only
+func (daemon *Daemon) stats() *Stats {
+	now := time.Now()
+	since := now.Add(-statsWindow)
+	// Records are kept in the order they ended
+	i := 0
+	for i < len(daemon.recent) && daemon.recent[i].Ended.Before(since) {
+		i++
+	}
+	daemon.recent = daemon.recent[i:]
+
+	first := daemon.started
+	for _, r := range daemon.recent {
+		if r.Fetched.Before(first) {
+			first = r.Fetched
+		}
+	}
+	if first.After(since) {
+		since = first
+	}
+
+	stats := &Stats{Since: since, Jobs: len(daemon.recent), Failures: make(map[string]int)}
+	var busy, printing, wait, printed time.Duration
+	var pressed, finished, cancelled, failed, timedOut int
+	for _, r := range daemon.recent {
+		busy += overlap(r.Fetched, r.Ended, since, now)
+		if !r.PrintStarted.IsZero() {
+			printing += overlap(r.PrintStarted, r.Ended, since, now)
+		}
+		if !r.ButtonPressed.IsZero() {
+			pressed++
+			wait += r.ButtonPressed.Sub(r.Fetched)
+		}
+		switch r.Outcome {
+		case history.Finished:
+			finished++
+			printed += r.Ended.Sub(r.PrintStarted)
+		case history.Cancelled:
+			cancelled++
+		case history.Failed:
+			failed++
+		case history.TimedOut:
+			timedOut++
+		}
+		if (r.Outcome == history.Cancelled || r.Outcome == history.Failed) && !r.PrintStarted.IsZero() {
+			reason := r.FeederStatus
+			if reason == "" {
+				reason = r.Reason
+			}
+			stats.Failures[reason]++
+		}
+	}
+	if r := daemon.trail; r != nil {
+		busy += overlap(r.Fetched, now, since, now)
+		if !r.PrintStarted.IsZero() {
+			printing += overlap(r.PrintStarted, now, since, now)
+		}
+	}
+
+	observed := now.Sub(since)
+	if observed > 0 {
+		stats.Utilization = percent(float64(printing), float64(observed))
+	}
+	if idle := observed - busy; idle > 0 {
+		stats.IdleSeconds = math.Round(idle.Seconds())
+	}
+	if pressed > 0 {
+		stats.AvgButtonWaitSeconds = math.Round(wait.Seconds() / float64(pressed))
+	}
+	if finished > 0 {
+		stats.MeanPrintSeconds = math.Round(printed.Seconds() / float64(finished))
+	}
+	if jobs := float64(stats.Jobs); jobs > 0 {
+		stats.ButtonTimeoutRate = percent(float64(timedOut), jobs)
+		stats.SuccessRate = percent(float64(finished), jobs)
+		stats.CancelRate = percent(float64(cancelled), jobs)
+		stats.ErrorRate = percent(float64(failed), jobs)
+	}
+	return stats
+}
+
+// overlap returns how much of from-to falls into since-until
+func overlap(from, to, since, until time.Time) time.Duration {
+	if from.Before(since) {
+		from = since
+	}
+	if to.After(until) {
+		to = until
+	}
+	if !to.After(from) {
+		return 0
+	}
+	return to.Sub(from)
+}
+
+// percent rounds to a tenth
+func percent(part, whole float64) float64 {
+	return math.Round(part/whole*1000) / 10
+}
+
+// StatsHandler gives utilization and reliability statistics of the printer
+func (daemon *Daemon) StatsHandler(w http.ResponseWriter, _ *http.Request) {
+	daemon.log.Infof("Received stats handler request")
+	// Add headers to allow AJAX
+	juggler.SetHeaders(w)
+
+	var stats *Stats
+	_ = daemon.do("stats", func() error {
+		stats = daemon.stats()
+		return nil
+	})
+	b, err := json.Marshal(stats)
+	if err != nil {
+		daemon.log.Errorf("Failed to respond on /stats request: %v", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprint(w, string(b))
+}
@@ -0,0 +1,323 @@
+// Package webhook posts status changes of jobs to HTTP endpoints. Events are kept in an outbox directory
+// until the endpoint accepts them, so they survive network problems and restarts
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/leoleovich/3djuggler/internal/atomicfile"
+	"github.com/leoleovich/3djuggler/juggler"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	requestTimeout = 30 * time.Second
+	// Failed deliveries are retried after minBackoff, doubling up to maxBackoff
+	minBackoff = time.Second
+	maxBackoff = 5 * time.Minute
+	// maxAge is how long an event is retried before it is dropped, e.g. for an endpoint which is gone
+	maxAge = 72 * time.Hour
+)
+
+// rejectedDir is the subdirectory of the outbox with the events the webhook refused
+const rejectedDir = "rejected"
+
+// SignatureHeader carries "sha256=" and the hex HMAC-SHA256 of the body with the secret of the webhook
+const SignatureHeader = "X-Juggler-Signature"
+
+// Config of a webhook
+type Config struct {
+	// Name identifies the webhook in the log and names its outbox
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// Secret signs the payloads, see SignatureHeader. Payloads are not signed if it is empty
+	Secret string `json:"secret"`
+	// SecretFile is read into Secret by juggler, so the secret is not kept in its config
+	SecretFile string `json:"secret_file"`
+	// Statuses the jobs change to which are posted, e.g. ["Finished", "Cancelling"]. All if empty
+	Statuses []juggler.JobStatus `json:"statuses"`
+	// Printers whose jobs are posted. All if empty
+	Printers []string `json:"printers"`
+}
+
+// Job is the job of the Event
+type Job struct {
+	ID       int    `json:"id"`
+	Owner    string `json:"owner"`
+	Filename string `json:"file_name"`
+	Source   string `json:"source"`
+	Color    string `json:"color"`
+}
+
+// Event is the payload posted to the webhook
+type Event struct {
+	// ID is the same for all attempts to deliver the event, so receivers can drop duplicates
+	ID      string            `json:"id"`
+	Time    time.Time         `json:"time"`
+	Printer string            `json:"printer"`
+	Job     Job               `json:"job"`
+	From    juggler.JobStatus `json:"old_status"`
+	To      juggler.JobStatus `json:"new_status"`
+	// FeederStatus is the status of the printer, e.g. FSensorBusy
+	FeederStatus string  `json:"feeder_status"`
+	Progress     float64 `json:"progress"`
+	Reason       string  `json:"reason"`
+}
+
+// Hook delivers events to a webhook in the order they were added
+type Hook struct {
+	config Config
+	dir    string
+	client *http.Client
+	log    *log.Entry
+
+	// mu guards seq, the last sequence number of the outbox
+	mu  sync.Mutex
+	seq int64
+
+	wake chan struct{}
+	stop context.CancelFunc
+	done chan struct{}
+}
+
+// Open starts delivering the events kept in dir/name, creating it if needed
+func Open(config Config, dir string) (*Hook, error) {
+	dir = filepath.Join(dir, config.Name)
+	if err := os.MkdirAll(filepath.Join(dir, rejectedDir), 0755); err != nil {
+		return nil, err
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	h := &Hook{
+		config: config,
+		dir:    dir,
+		client: &http.Client{Timeout: requestTimeout},
+		log:    log.WithField("webhook", config.Name),
+		// Events added before the start are delivered right away
+		wake: make(chan struct{}, 1),
+		stop: stop,
+		done: make(chan struct{}),
+	}
+	h.wake <- struct{}{}
+	go h.run(ctx)
+	return h, nil
+}
+
+// Close stops the delivery. Events which are not delivered are kept for the next Open
+func (h *Hook) Close() {
+	h.stop()
+	<-h.done
+}
+
+// Config is what the hook was opened with
+func (h *Hook) Config() Config {
+	return h.config
+}
+
+// Dir is the outbox of the hook
+func (h *Hook) Dir() string {
+	return h.dir
+}
+
+// wants tells if the webhook is interested in the event
+func (h *Hook) wants(ev *Event) bool {
+	return (len(h.config.Statuses) == 0 || containsStatus(h.config.Statuses, ev.To)) &&
+		(len(h.config.Printers) == 0 || containsString(h.config.Printers, ev.Printer))
+}
+
+// Add stores the event in the outbox if the webhook wants it. It is delivered in the background
+func (h *Hook) Add(ev Event) error {
+	if !h.wants(&ev) {
+		return nil
+	}
+	if ev.ID == "" {
+		ev.ID = newID()
+	}
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	seq := ev.Time.UnixNano()
+	if seq <= h.seq {
+		seq = h.seq + 1
+	}
+	h.seq = seq
+	h.mu.Unlock()
+
+	// Names sort in the order the events were added
+	if err := atomicfile.Write(filepath.Join(h.dir, fmt.Sprintf("%020d.json", seq)), b); err != nil {
+		return err
+	}
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// run delivers the outbox until ctx is done, backing off while the webhook fails
+func (h *Hook) run(ctx context.Context) {
+	defer close(h.done)
+	backoff := minBackoff
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-h.wake:
+		}
+		for {
+			err := h.deliverNext(ctx)
+			if errors.Is(err, errEmpty) || ctx.Err() != nil {
+				break
+			}
+			if err == nil {
+				backoff = minBackoff
+				continue
+			}
+			h.log.Warningf("Failed to deliver, retrying in %s: %v", backoff, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+	}
+}
+
+var errEmpty = errors.New("outbox is empty")
+
+// rejectedError is a 4xx answer of the webhook. Sending the event again won't change it
+type rejectedError struct {
+	url, status string
+}
+
+func (e *rejectedError) Error() string {
+	return fmt.Sprintf("%s rejected the event with %s", e.url, e.status)
+}
+
+// deliverNext posts the oldest event of the outbox and removes it once the webhook accepted it
+func (h *Hook) deliverNext(ctx context.Context) error {
+	names, err := h.pending()
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return errEmpty
+	}
+	path := filepath.Join(h.dir, names[0])
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var ev Event
+	if err := json.Unmarshal(b, &ev); err != nil {
+		// Events are renamed into place once written, still a damaged one must not block the outbox
+		h.log.Errorf("Dropping %s: %v", path, err)
+		return os.Remove(path)
+	}
+	if time.Since(ev.Time) > maxAge {
+		h.log.Errorf("Dropping event %s of job %d, it was not delivered for %s", ev.ID, ev.Job.ID, maxAge)
+		return os.Remove(path)
+	}
+	var rejected *rejectedError
+	if err := h.post(ctx, b); errors.As(err, &rejected) {
+		h.log.Errorf("Moving event %s of job %d to %s: %v", ev.ID, ev.Job.ID, rejectedDir, err)
+		return os.Rename(path, filepath.Join(h.dir, rejectedDir, names[0]))
+	} else if err != nil {
+		return err
+	}
+	h.log.Debugf("Delivered event %s of job %d: %s -> %s", ev.ID, ev.Job.ID, ev.From, ev.To)
+	return os.Remove(path)
+}
+
+// pending returns the names of the events in the outbox, oldest first
+func (h *Hook) pending() ([]string, error) {
+	entries, err := os.ReadDir(h.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (h *Hook) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.config.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(h.config.Secret, body))
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	// Timeouts and rate limits pass, other client errors don't
+	if resp.StatusCode >= 400 && resp.StatusCode <= 499 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return &rejectedError{url: h.config.URL, status: resp.Status}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", h.config.URL, resp.Status)
+	}
+	return nil
+}
+
+// Sign returns the value of SignatureHeader for the body
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func containsStatus(statuses []juggler.JobStatus, status juggler.JobStatus) bool {
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
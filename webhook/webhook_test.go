@@ -0,0 +1,158 @@
+package webhook
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/leoleovich/3djuggler/juggler"
+)
+
+const testTimeout = 10 * time.Second
+
+func TestSign(t *testing.T) {
+	// echo -n '{"id":"1"}' | openssl dgst -sha256 -hmac secret
+	want := "sha256=6146142a2ce0159e84c0767881e4ec80bc397da62526e7d19f70795eb79460c0"
+	if got := Sign("secret", []byte(`{"id":"1"}`)); got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
+
+// receiver is a webhook which answers with the codes one by one and 200 once they are used up
+type receiver struct {
+	secret string
+
+	mu    sync.Mutex
+	codes []int
+	// got are the jobs of the accepted events, tried of all events
+	got   []int
+	tried []int
+	bad   []string
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var ev Event
+	if err := json.NewDecoder(req.Body).Decode(&ev); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.secret != "" && req.Header.Get(SignatureHeader) == "" {
+		r.bad = append(r.bad, ev.ID)
+	}
+	r.tried = append(r.tried, ev.Job.ID)
+	code := http.StatusOK
+	if len(r.codes) > 0 {
+		code, r.codes = r.codes[0], r.codes[1:]
+	}
+	if code == http.StatusOK {
+		r.got = append(r.got, ev.Job.ID)
+	}
+	w.WriteHeader(code)
+}
+
+// wait waits until the receiver accepted n events and returns the jobs of the events it was sent
+func (r *receiver) wait(t *testing.T, n int) (got, tried []int) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for {
+		r.mu.Lock()
+		got, tried = append([]int(nil), r.got...), append([]int(nil), r.tried...)
+		r.mu.Unlock()
+		if len(got) >= n {
+			return got, tried
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("receiver accepted %v, want %d events", got, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func open(t *testing.T, r *receiver) *Hook {
+	t.Helper()
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+	h, err := Open(Config{Name: "test", URL: server.URL, Secret: r.secret}, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(h.Close)
+	return h
+}
+
+func add(t *testing.T, h *Hook, jobs ...int) {
+	t.Helper()
+	for _, id := range jobs {
+		if err := h.Add(Event{Time: time.Now(), Job: Job{ID: id}, To: juggler.StatusFinished}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDeliveredInOrder(t *testing.T) {
+	r := &receiver{secret: "secret"}
+	h := open(t, r)
+	add(t, h, 1, 2, 3)
+
+	if got, _ := r.wait(t, 3); !reflect.DeepEqual(got, []int{1, 2, 3}) {
+		t.Fatalf("delivered %v, want [1 2 3]", got)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.bad) > 0 {
+		t.Fatalf("events %v were not signed", r.bad)
+	}
+}
+
+func TestFailedDeliveryIsRetried(t *testing.T) {
+	r := &receiver{codes: []int{http.StatusInternalServerError, http.StatusTooManyRequests}}
+	h := open(t, r)
+	add(t, h, 1, 2)
+
+	// The second event waits until the first is delivered
+	got, tried := r.wait(t, 2)
+	if !reflect.DeepEqual(got, []int{1, 2}) || !reflect.DeepEqual(tried, []int{1, 1, 1, 2}) {
+		t.Fatalf("delivered %v after sending %v, want [1 2] after [1 1 1 2]", got, tried)
+	}
+}
+
+func TestRejectedEventIsNotRetried(t *testing.T) {
+	r := &receiver{codes: []int{http.StatusBadRequest}}
+	h := open(t, r)
+	add(t, h, 1, 2)
+
+	got, tried := r.wait(t, 1)
+	if !reflect.DeepEqual(got, []int{2}) || !reflect.DeepEqual(tried, []int{1, 2}) {
+		t.Fatalf("delivered %v after sending %v, want [2] after [1 2]", got, tried)
+	}
+	// The accepted event is removed once the answer is read
+	deadline := time.Now().Add(testTimeout)
+	for {
+		pending, err := h.pending()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("outbox has %v, want it empty", pending)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	rejected, err := os.ReadDir(filepath.Join(h.Dir(), rejectedDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rejected) != 1 {
+		t.Fatalf("%d rejected events kept, want 1", len(rejected))
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/leoleovich/3djuggler/juggler"
+	"github.com/leoleovich/3djuggler/webhook"
+	log "github.com/sirupsen/logrus"
+)
+
+// openWebhooks opens the webhooks of the config. Hooks of open which are configured the same way are reused, the others are closed.
+// An outbox is delivered by a single hook, so a changed hook is closed before it is opened again
+func openWebhooks(configs []webhook.Config, dir string, open []*webhook.Hook) []*webhook.Hook {
+	reused := make(map[string]*webhook.Hook)
+	for _, hook := range open {
+		for _, wc := range configs {
+			if hook.Dir() == filepath.Join(dir, wc.Name) && reflect.DeepEqual(hook.Config(), wc) {
+				reused[wc.Name] = hook
+			}
+		}
+		if reused[hook.Config().Name] != hook {
+			hook.Close()
+		}
+	}
+	var hooks []*webhook.Hook
+	for _, wc := range configs {
+		if hook, ok := reused[wc.Name]; ok {
+			hooks = append(hooks, hook)
+			continue
+		}
+		hook, err := webhook.Open(wc, dir)
+		if err != nil {
+			log.Errorf("Webhook %s is disabled: %v", wc.Name, err)
+			continue
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks
+}
+
+// notify queues the status change of the current job for the webhooks. Loop only
+func (daemon *Daemon) notify(from, to juggler.JobStatus, reason string) {
+	if len(daemon.webhooks) == 0 {
+		return
+	}
+	job := daemon.Job()
+	ev := webhook.Event{
+		Time:    time.Now(),
+		Printer: daemon.config.Name,
+		Job: webhook.Job{
+			ID:       job.ID,
+			Owner:    job.Owner,
+			Filename: job.Filename,
+			Source:   job.Source,
+			Color:    job.Color,
+		},
+		From:         from,
+		To:           to,
+		FeederStatus: job.FeederStatus.String(),
+		Progress:     job.Progress,
+		Reason:       reason,
+	}
+	for _, hook := range daemon.webhooks {
+		if err := hook.Add(ev); err != nil {
+			daemon.log.Error("Failed to queue the webhook event: ", err)
+		}
+	}
+}